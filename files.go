@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+const defaultRemoteDir = "0:/gcodes"
+
+func filesCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:    "files",
+		Aliases: []string{"f"},
+		Usage:   "manage files on the SD card of a reprapfirmware device",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "remote directory for relative paths",
+				Value: defaultRemoteDir,
+			},
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:      "ls",
+				Usage:     "list files; the final path element may contain wildcards",
+				ArgsUsage: "host [path...]",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "recursive",
+						Aliases: []string{"R"},
+						Usage:   "list subdirectories recursively",
+					},
+				},
+				Action: filesAction(func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error {
+					if len(args) == 0 {
+						args = []string{c.String("dir")}
+					}
+					tw := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+					defer tw.Flush()
+					for _, a := range args {
+						err := listRemote(ctx, rrf, tw,
+							remotePath(c.String("dir"), a), c.Bool("recursive"))
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}),
+			},
+			{
+				Name:      "get",
+				Usage:     "download files",
+				ArgsUsage: "host path...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "to",
+						Usage: "local file or directory to download to",
+						Value: ".",
+					},
+				},
+				Action: filesAction(func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error {
+					names, err := expandRemote(ctx, rrf, c.String("dir"), args)
+					if err != nil {
+						return err
+					}
+					to := c.String("to")
+					st, err := os.Stat(to)
+					toDir := err == nil && st.IsDir()
+					if len(names) > 1 && !toDir {
+						return fmt.Errorf("%s must be a directory when downloading multiple files", to)
+					}
+					for _, name := range names {
+						local := to
+						if toDir {
+							local = filepath.Join(to, path.Base(name))
+						}
+						err := downloadFile(ctx, rrf, c.App.ErrWriter, name, local)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}),
+			},
+			{
+				Name:      "put",
+				Usage:     "upload files",
+				ArgsUsage: "host file...",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name: "to",
+						Usage: "remote file or directory (with trailing /) to upload to; " +
+							"defaults to the --dir directory",
+					},
+				},
+				Action: filesAction(func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error {
+					if len(args) == 0 {
+						return fmt.Errorf("at least one file is required")
+					}
+					to := c.String("to")
+					if to == "" {
+						to = c.String("dir") + "/"
+					}
+					toDir := strings.HasSuffix(to, "/")
+					if len(args) > 1 && !toDir {
+						return fmt.Errorf("%s must be a directory, ending in /, when uploading multiple files", to)
+					}
+					for _, local := range args {
+						remote := remotePath(c.String("dir"), to)
+						if toDir {
+							remote = path.Join(remote, filepath.Base(local))
+						}
+						err := uploadFile(ctx, rrf, c.App.ErrWriter, local, remote)
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}),
+			},
+			{
+				Name:      "rm",
+				Usage:     "delete files or empty directories",
+				ArgsUsage: "host path...",
+				Action: filesAction(func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error {
+					names, err := expandRemote(ctx, rrf, c.String("dir"), args)
+					if err != nil {
+						return err
+					}
+					for _, name := range names {
+						if err := rrf.Delete(ctx, name); err != nil {
+							return err
+						}
+					}
+					return nil
+				}),
+			},
+			{
+				Name:      "mv",
+				Usage:     "move or rename a file",
+				ArgsUsage: "host old new",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:    "force",
+						Aliases: []string{"f"},
+						Usage:   "replace any existing file",
+					},
+				},
+				Action: filesAction(func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error {
+					if len(args) != 2 {
+						return fmt.Errorf("old and new paths are required")
+					}
+					return rrf.Move(ctx,
+						remotePath(c.String("dir"), args[0]),
+						remotePath(c.String("dir"), args[1]),
+						c.Bool("force"))
+				}),
+			},
+			{
+				Name:      "mkdir",
+				Usage:     "create directories",
+				ArgsUsage: "host path...",
+				Action: filesAction(func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error {
+					if len(args) == 0 {
+						return fmt.Errorf("at least one directory is required")
+					}
+					for _, a := range args {
+						err := rrf.Mkdir(ctx, remotePath(c.String("dir"), a))
+						if err != nil {
+							return err
+						}
+					}
+					return nil
+				}),
+			},
+			{
+				Name:      "info",
+				Usage:     "show gcode file metadata",
+				ArgsUsage: "host path...",
+				Action: filesAction(func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error {
+					names, err := expandRemote(ctx, rrf, c.String("dir"), args)
+					if err != nil {
+						return err
+					}
+					for _, name := range names {
+						info, err := rrf.FileInfo(ctx, name)
+						if err != nil {
+							return err
+						}
+						writeFileInfo(stdout, name, info)
+					}
+					return nil
+				}),
+			},
+		},
+	}
+}
+
+type filesFunc func(ctx context.Context, c *cli.Context, rrf *netrrf.Client, args []string) error
+
+// filesAction creates the client for the host argument and passes the
+// remaining arguments to fn with a context that is cancelled on
+// interrupt.
+func filesAction(fn filesFunc) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		host := c.Args().First()
+		if host == "" {
+			return fmt.Errorf("host argument is required")
+		}
+		ctx, cancel := signal.NotifyContext(context.Background(),
+			os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		rrf := netrrf.NewClient(host, c.String("password"))
+		return fn(ctx, c, rrf, c.Args().Tail())
+	}
+}
+
+// remotePath returns the absolute path for p, which is relative to dir
+// unless it has a volume prefix (e.g. "0:/sys") or a leading slash.
+func remotePath(dir, p string) string {
+	switch {
+	case strings.Contains(p, ":/"):
+		return path.Clean(p)
+	case strings.HasPrefix(p, "/"):
+		return "0:" + path.Clean(p)
+	}
+	return path.Join(dir, p)
+}
+
+func expandRemote(ctx context.Context, rrf *netrrf.Client, dir string, args []string) ([]string, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("at least one path is required")
+	}
+	names := []string{}
+	for _, a := range args {
+		matches, err := rrf.Glob(ctx, remotePath(dir, a))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", a)
+		}
+		names = append(names, matches...)
+	}
+	return names, nil
+}
+
+func listRemote(ctx context.Context, rrf *netrrf.Client, w io.Writer, p string, recursive bool) error {
+	dir, pattern := p, "*"
+	if base := path.Base(p); strings.ContainsAny(base, "*?[") {
+		dir, pattern = path.Dir(p), base
+	}
+	files, err := rrf.Files(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if ok, err := path.Match(pattern, f.Name); err != nil {
+			return fmt.Errorf("invalid pattern %s: %w", p, err)
+		} else if !ok {
+			continue
+		}
+		name := path.Join(dir, f.Name)
+		size := fmt.Sprintf("%d", f.Size)
+		if f.Type == types.Directory {
+			name += "/"
+			size = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", size, f.Date, name)
+		if recursive && f.Type == types.Directory {
+			err := listRemote(ctx, rrf, w, path.Join(dir, f.Name), true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func downloadFile(ctx context.Context, rrf *netrrf.Client, progressw io.Writer, name, local string) error {
+	var size int64
+	if info, err := rrf.FileInfo(ctx, name); err == nil {
+		size = info.Size
+	}
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	p := newProgress(progressw, name, size)
+	_, err = rrf.Download(ctx, name, io.MultiWriter(f, p))
+	p.Done()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(local)
+	}
+	return err
+}
+
+func uploadFile(ctx context.Context, rrf *netrrf.Client, progressw io.Writer, local, name string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	p := newProgress(progressw, name, st.Size())
+	err = rrf.Upload(ctx, name, io.TeeReader(f, p), st.Size(), st.ModTime())
+	p.Done()
+	return err
+}
+
+func writeFileInfo(w io.Writer, name string, info *types.FileInfoResponse) {
+	fmt.Fprintf(w, "%s:\n", name)
+	fmt.Fprintf(w, "  Size: %d\n", info.Size)
+	if info.LastModified != "" {
+		fmt.Fprintf(w, "  Last modified: %s\n", info.LastModified)
+	}
+	if info.GeneratedBy != "" {
+		fmt.Fprintf(w, "  Generated by: %s\n", info.GeneratedBy)
+	}
+	if info.Height > 0 {
+		fmt.Fprintf(w, "  Height: %.2f mm\n", info.Height)
+	}
+	if info.FirstLayerHeight > 0 {
+		fmt.Fprintf(w, "  First layer height: %.2f mm\n", info.FirstLayerHeight)
+	}
+	if info.LayerHeight > 0 {
+		fmt.Fprintf(w, "  Layer height: %.2f mm\n", info.LayerHeight)
+	}
+	if info.PrintTime > 0 {
+		fmt.Fprintf(w, "  Print time: %s\n", formatTime(info.PrintTime))
+	}
+	if info.SimulatedTime > 0 {
+		fmt.Fprintf(w, "  Simulated time: %s\n", formatTime(info.SimulatedTime))
+	}
+	for i, f := range info.Filament {
+		fmt.Fprintf(w, "  Filament %d: %.1f mm\n", i, f)
+	}
+}
+
+// progress is an io.Writer that counts the bytes written and reports
+// the transfer progress on a single line.
+type progress struct {
+	w     io.Writer
+	name  string
+	total int64
+	n     int64
+	last  time.Time
+}
+
+func newProgress(w io.Writer, name string, total int64) *progress {
+	return &progress{w: w, name: name, total: total}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	if time.Since(p.last) >= 100*time.Millisecond {
+		p.last = time.Now()
+		p.print()
+	}
+	return len(b), nil
+}
+
+func (p *progress) print() {
+	if p.total > 0 {
+		fmt.Fprintf(p.w, "\r%s: %d/%d bytes (%d%%)", p.name, p.n, p.total,
+			p.n*100/p.total)
+		return
+	}
+	fmt.Fprintf(p.w, "\r%s: %d bytes", p.name, p.n)
+}
+
+func (p *progress) Done() {
+	p.print()
+	fmt.Fprintln(p.w)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/chzyer/readline"
+	"github.com/urfave/cli/v2"
+)
+
+func gcodeCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:    "gcode",
+		Aliases: []string{"g"},
+		Usage: "send gcode to a reprapfirmware device; with no gcode " +
+			"arguments an interactive console is started",
+		ArgsUsage: "host [gcode...]",
+		Action: func(c *cli.Context) error {
+			host := c.Args().First()
+			if host == "" {
+				return fmt.Errorf("host argument is required")
+			}
+			if c.Duration("poll-interval") <= 0 {
+				return fmt.Errorf("poll interval must be positive")
+			}
+			codes := c.Args().Tail()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			rrf := netrrf.NewClient(host, c.String("password"))
+			wait := c.Duration("reply-timeout")
+
+			for _, code := range codes {
+				if err := sendGCode(ctx, rrf, stdout, code, wait); err != nil {
+					return err
+				}
+			}
+			interactive := c.Bool("interactive")
+			if len(codes) > 0 && !interactive {
+				return nil
+			}
+			if !interactive && !readline.IsTerminal(int(os.Stdin.Fd())) {
+				// gcode piped on stdin
+				scanner := bufio.NewScanner(os.Stdin)
+				for scanner.Scan() {
+					code := strings.TrimSpace(scanner.Text())
+					if code == "" {
+						continue
+					}
+					err := sendGCode(ctx, rrf, stdout, code, wait)
+					if err != nil {
+						return err
+					}
+				}
+				return scanner.Err()
+			}
+			return gcodeConsole(ctx, rrf, host, c.String("history"),
+				c.Duration("poll-interval"))
+		},
+		Flags: []cli.Flag{
+			&cli.BoolFlag{
+				Name:    "interactive",
+				Aliases: []string{"I"},
+				Usage:   "start the interactive console after sending any gcode arguments",
+			},
+			&cli.DurationFlag{
+				Name:  "reply-timeout",
+				Usage: "maximum time to wait for the reply to each gcode",
+				Value: 2 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "poll-interval",
+				Usage: "interval between checks for replies and messages in the interactive console",
+				Value: 500 * time.Millisecond,
+			},
+			&cli.StringFlag{
+				Name:  "history",
+				Usage: "interactive console history file",
+				Value: defaultHistoryFile(),
+			},
+		},
+	}
+}
+
+func defaultHistoryFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, "."+appName+"_history")
+}
+
+func sendGCode(ctx context.Context, rrf *netrrf.Client, w io.Writer, code string, wait time.Duration) error {
+	reply, err := rrf.SendGCode(ctx, code, wait)
+	if err != nil {
+		return err
+	}
+	writeReply(w, reply)
+	return nil
+}
+
+func writeReply(w io.Writer, reply string) {
+	if reply == "" {
+		return
+	}
+	if !strings.HasSuffix(reply, "\n") {
+		reply += "\n"
+	}
+	fmt.Fprint(w, reply)
+}
+
+func gcodeConsole(ctx context.Context, rrf *netrrf.Client, host, history string, interval time.Duration) error {
+	// authenticate before the output is followed so that the client
+	// isn't authenticating concurrently
+	if err := rrf.Authenticate(ctx); err != nil {
+		return err
+	}
+	rl, err := readline.NewEx(&readline.Config{
+		Prompt:          host + "> ",
+		HistoryFile:     history,
+		InterruptPrompt: "^C",
+		EOFPrompt:       "exit",
+	})
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the client, and its session, is shared with the output follower
+	// so requests are serialised
+	var mu sync.Mutex
+	go followOutput(ctx, rrf, &mu, rl.Stdout(), interval)
+
+	for {
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			if line == "" {
+				return nil
+			}
+			continue
+		} else if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		code := strings.TrimSpace(line)
+		switch strings.ToLower(code) {
+		case "":
+			continue
+		case "exit", "quit":
+			return nil
+		}
+		mu.Lock()
+		_, err = rrf.GCode(ctx, code)
+		mu.Unlock()
+		if err != nil {
+			fmt.Fprintf(rl.Stderr(), "error: %s\n", err)
+		}
+	}
+}
+
+// followOutput writes replies, messages and beep notifications to w as
+// they become available in the same way as the Duet Web Control console.
+// Requests to the client are made with mu held.
+func followOutput(ctx context.Context, rrf *netrrf.Client, mu *sync.Mutex, w io.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	seq := -1
+	lastMessage := ""
+	// the firmware reports a beep until it ends so remember the last
+	// one to report each beep only once
+	type beep struct{ frequency, duration, seq int }
+	var lastBeep beep
+	for {
+		mu.Lock()
+		s, err := rrf.Status(ctx, 1)
+		mu.Unlock()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(w, "error: %s\n", err)
+		} else {
+			if seq != -1 && s.Seq != seq {
+				mu.Lock()
+				reply, err := rrf.Reply(ctx)
+				mu.Unlock()
+				if err != nil {
+					fmt.Fprintf(w, "error: %s\n", err)
+				} else {
+					writeReply(w, reply)
+				}
+			}
+			seq = s.Seq
+			message := ""
+			var b beep
+			if s.Output != nil {
+				message = s.Output.Message
+				if s.Output.BeepDuration > 0 {
+					b = beep{s.Output.BeepFrequency,
+						s.Output.BeepDuration, s.Seq}
+				}
+			}
+			if b.duration > 0 && b != lastBeep {
+				fmt.Fprintf(w, "\abeep: %d Hz for %d ms\n",
+					b.frequency, b.duration)
+			}
+			lastBeep = b
+			if message != "" && message != lastMessage {
+				fmt.Fprintf(w, "message: %s\n", message)
+			}
+			lastMessage = message
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const templatePrefix = "template="
+
+type hostInfo struct {
+	Host   string                `json:"host"`
+	Config *types.ConfigResponse `json:"config"`
+	// status2 is the key used before the output was an array
+	Status *types.StatusResponse `json:"status2"`
+}
+
+func infoCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:      "info",
+		Aliases:   []string{"i"},
+		Usage:     "fetch basic information about reprapfirmware device(s)",
+		ArgsUsage: "host [host...]",
+		Action: func(c *cli.Context) error {
+			format := c.String("output")
+			if err := validateOutputFormat(format); err != nil {
+				return err
+			}
+			if c.Int("parallel") < 1 {
+				return fmt.Errorf("parallel must be at least 1")
+			}
+			hosts := c.Args().Slice()
+			results := fetchAllInfo(context.Background(), hosts,
+				c.String("password"), c.Duration("timeout"), c.Int("parallel"))
+			infos := []*hostInfo{}
+			failed := []string{}
+			for i, r := range results {
+				if r.err != nil {
+					failed = append(failed,
+						fmt.Sprintf("  %s: %s", hosts[i], r.err))
+					continue
+				}
+				infos = append(infos, r.info)
+			}
+			if err := writeInfo(stdout, format, infos); err != nil {
+				return err
+			}
+			if len(failed) > 0 {
+				return cli.Exit(fmt.Sprintf("failed to query %d of %d hosts:\n%s",
+					len(failed), len(hosts), strings.Join(failed, "\n")), 1)
+			}
+			return nil
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage: "output format: text, json, yaml, wide or " +
+					"template=<go template> (e.g. 'template={{.Status.Name}}')",
+				Value: "text",
+			},
+			&cli.IntFlag{
+				Name:    "parallel",
+				Aliases: []string{"P"},
+				Usage:   "maximum number of devices to query concurrently",
+				Value:   4,
+			},
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Aliases: []string{"t"},
+				Usage:   "timeout for each request to a device",
+				Value:   30 * time.Second,
+			},
+		},
+	}
+}
+
+type infoResult struct {
+	info *hostInfo
+	err  error
+}
+
+// fetchAllInfo queries the hosts with at most parallel requests in flight
+// and returns the results in the same order as the hosts.  Parallel must
+// be at least 1.
+func fetchAllInfo(ctx context.Context, hosts []string, password string, timeout time.Duration, parallel int) []*infoResult {
+	results := make([]*infoResult, len(hosts))
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i := range hosts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			info, err := fetchInfo(ctx, hosts[i], password, timeout)
+			results[i] = &infoResult{info: info, err: err}
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+func fetchInfo(ctx context.Context, host, password string, timeout time.Duration) (*hostInfo, error) {
+	rrf := netrrf.NewClient(host, password).WithTimeout(timeout)
+	cfg, err := rrf.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s, err := rrf.FullStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &hostInfo{Host: host, Config: cfg, Status: s}, nil
+}
+
+func validateOutputFormat(format string) error {
+	switch format {
+	case "", "text", "json", "yaml", "wide":
+		return nil
+	}
+	if strings.HasPrefix(format, templatePrefix) {
+		_, err := template.New("output").Parse(format[len(templatePrefix):])
+		if err != nil {
+			return fmt.Errorf("invalid output template: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown output format '%s'", format)
+}
+
+func writeInfo(w io.Writer, format string, infos []*hostInfo) error {
+	switch format {
+	case "", "text":
+		for _, info := range infos {
+			writeInfoText(w, info)
+		}
+		return nil
+	case "json":
+		pj, err := json.MarshalIndent(infos, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(pj))
+		return nil
+	case "yaml":
+		// round trip via json so the yaml keys match the json ones
+		pj, err := json.Marshal(infos)
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		if err := json.Unmarshal(pj, &v); err != nil {
+			return err
+		}
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	case "wide":
+		writeInfoWide(w, infos)
+		return nil
+	}
+	if strings.HasPrefix(format, templatePrefix) {
+		tmpl, err := template.New("output").Parse(format[len(templatePrefix):])
+		if err != nil {
+			return fmt.Errorf("invalid output template: %w", err)
+		}
+		for _, info := range infos {
+			if err := tmpl.Execute(w, info); err != nil {
+				return fmt.Errorf("output template failed for %s: %w",
+					info.Host, err)
+			}
+			fmt.Fprintln(w)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown output format '%s'", format)
+}
+
+func writeInfoText(w io.Writer, info *hostInfo) {
+	cfg, s := info.Config, info.Status
+	fmt.Fprintf(w, `%s:
+  Name: %s
+  State: %s
+  Firmware: %s v%s (%s)
+  Electronics: %s
+  Geometry: %s
+`,
+		info.Host, s.Name, s.Status,
+		cfg.FirmwareName,
+		cfg.FirmwareVersion, cfg.FirmwareDate,
+		cfg.FirmwareElectronics,
+		s.Geometry,
+	)
+	for i := 0; i < s.Axes && i < len(s.Coordinates.XYZ); i++ {
+		var homed string
+		if i < len(s.Coordinates.AxesHomed) && !s.Coordinates.AxesHomed[i] {
+			homed = " (not homed)"
+		}
+		var min, max float64
+		if i < len(cfg.AxisMins) && i < len(cfg.AxisMaxes) {
+			min, max = cfg.AxisMins[i], cfg.AxisMaxes[i]
+		}
+		fmt.Fprintf(w,
+			"  Axis %d: %-7.2f (min=%.2f max=%.2f)%s\n",
+			i, s.Coordinates.XYZ[i], min, max, homed)
+	}
+}
+
+func writeInfoWide(w io.Writer, infos []*hostInfo) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw,
+		"HOST\tNAME\tSTATE\tFIRMWARE\tELECTRONICS\tGEOMETRY\tTOOLS\tTEMPS\tPOSITION")
+	for _, info := range infos {
+		cfg, s := info.Config, info.Status
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			info.Host, s.Name, s.Status,
+			cfg.FirmwareVersion+" ("+string(cfg.FirmwareDate)+")",
+			cfg.FirmwareElectronics, s.Geometry, len(s.Tools),
+			watchTemps(s), watchPosition(s))
+	}
+	tw.Flush()
+}
@@ -23,10 +23,9 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -34,8 +33,6 @@ import (
 
 	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
 	"github.com/beanz/rrf-go/pkg/ha"
-	"github.com/beanz/rrf-go/pkg/mock"
-	"github.com/beanz/rrf-go/pkg/netrrf"
 	"github.com/urfave/cli/v2"
 )
 
@@ -65,125 +62,78 @@ func main() {
 		},
 
 		Commands: []*cli.Command{
+			infoCommand(stdout),
+			watchCommand(stdout),
+			gcodeCommand(stdout),
+			filesCommand(stdout),
+			printCommand(stdout),
+			mockCommand(stdout),
+			recordCommand(stdout),
 			{
-				Name:    "info",
-				Aliases: []string{"i"},
-				Usage:   "fetch basic information about reprapfirmware device(s)",
-				Action: func(c *cli.Context) error {
-					pw := c.String("password")
-					ctx := context.Background()
-					for _, h := range c.Args().Slice() {
-						rrf := netrrf.NewClient(h, pw)
-						cfg, err := rrf.Config(ctx)
-						if err != nil {
-							return err
-						}
-						s2, err := rrf.Status(ctx, 2)
-						if err != nil {
-							return err
-						}
-						if c.String("output") == "json" {
-							pj, err := json.MarshalIndent(
-								map[string]interface{}{
-									"config":  cfg,
-									"status2": s2,
-								}, "", "  ")
-							if err != nil {
-								return err
-							}
-							fmt.Fprint(stdout, string(pj))
-							return nil
-						}
-						fmt.Fprintf(stdout, `%s:
-  Name: %s
-  State: %s
-  Firmware: %s v%s (%s)
-  Electronics: %s
-  Geometry: %s
-`,
-							h, s2.Name, s2.Status,
-							cfg.FirmwareName,
-							cfg.FirmwareVersion, cfg.FirmwareDate,
-							cfg.FirmwareElectronics,
-							s2.Geometry,
-						)
-						for i := 0; i < s2.Axes; i++ {
-							var homed string
-							if !s2.Coordinates.AxesHomed[i] {
-								homed = " (not homed)"
-							}
-							fmt.Fprintf(stdout,
-								"  Axis %d: %-7.2f (min=%.2f max=%.2f)%s\n",
-								i, s2.Coordinates.XYZ[i],
-								cfg.AxisMins[i], cfg.AxisMaxes[i], homed)
-						}
-					}
-					return nil
+				Name:      "homeassistant",
+				Aliases:   []string{"ha"},
+				Usage:     "homeassistant integration",
+				ArgsUsage: "[host...]",
+				Subcommands: []*cli.Command{
+					haPurgeCommand(stdout),
 				},
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "output",
-						Aliases: []string{"o"},
-						Usage:   "output format",
-					},
-				},
-			},
-			{
-				Name:    "mock",
-				Aliases: []string{"m"},
-				Usage:   "simple mock reprapfirmware device server for testing",
 				Action: func(c *cli.Context) error {
-					mock := mock.NewMockRRF(
-						log.New(stdout, "",
-							log.Ldate|log.Ltime|log.Lmicroseconds))
-					srv := &http.Server{
-						Addr:           c.String("bind"),
-						Handler:        mock.Router(),
-						ReadTimeout:    10 * time.Second,
-						WriteTimeout:   10 * time.Second,
-						MaxHeaderBytes: 1 << 20,
-					}
-					if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-						return fmt.Errorf("http server failed: %v", err)
+					cfg, err := haConfig(c)
+					if err != nil {
+						return err
 					}
-					return nil
-				},
-				Flags: []cli.Flag{
-					&cli.StringFlag{
-						Name:    "bind",
-						Aliases: []string{"b"},
-						Usage:   "address:port to bind mock server",
-						Value:   "127.0.0.1:8888",
-					},
-				},
-			},
-			{
-				Name:    "homeassistant",
-				Aliases: []string{"ha"},
-				Usage:   "homeassistant integration",
-				Action: func(c *cli.Context) error {
+
 					sigc := make(chan os.Signal, 1)
 					signal.Notify(sigc, os.Interrupt)
 					signal.Notify(sigc, syscall.SIGTERM)
+					hupc := make(chan os.Signal, 1)
+					signal.Notify(hupc, syscall.SIGHUP)
 
 					ctx, cancel := context.WithCancel(context.Background())
 					defer cancel()
 					errCh := make(chan error, 1)
+					logger := log.New(stdout, "",
+						log.Ldate|log.Ltime|log.Lmicroseconds)
+
+					changed := make(chan struct{}, 1)
+					path := c.String("config")
+					if i := c.Duration("config-check-interval"); path != "" && i > 0 {
+						go ha.WatchConfigFile(ctx, path, i, changed)
+					}
+					reload := make(chan *ha.Config)
+					go func() {
+						for {
+							select {
+							case <-ctx.Done():
+								return
+							case <-hupc:
+							case <-changed:
+							}
+							cfg, err := haConfig(c)
+							if err != nil {
+								logger.Printf("failed to reload configuration: %s\n", err)
+								continue
+							}
+							select {
+							case reload <- cfg:
+							case <-ctx.Done():
+								return
+							}
+						}
+					}()
 
 					go func(ctx context.Context, errCh chan error) {
-						logger := log.New(stdout, "",
-							log.Ldate|log.Ltime|log.Lmicroseconds)
 						mqttc, err := mqtt.NewClient(&mqtt.ClientConfig{
-							AppName:              appName,
-							Version:              Version,
-							Debug:                c.Bool("debug"),
+							AppName:              cfg.AppName,
+							Version:              cfg.Version,
+							Debug:                cfg.Debug,
 							Log:                  logger,
-							Broker:               c.String("broker"),
-							ClientID:             c.String("client-id"),
-							DataTopicPrefix:      c.String("topic-prefix"),
-							DiscoveryTopicPrefix: c.String("discovery-topic-prefix"),
-							ConnectRetryDelay:    c.Duration("connect-retry-delay"),
-							KeepAlive:            int16(c.Int("keepalive")),
+							Broker:               cfg.Broker,
+							ClientID:             cfg.ClientID,
+							DataTopicPrefix:      cfg.TopicPrefix,
+							DiscoveryTopicPrefix: cfg.DiscoveryTopicPrefix,
+							ConnectRetryDelay:    cfg.ConnectRetryDelay,
+							KeepAlive:            int16(cfg.KeepAlive),
 						}, logger)
 						if err != nil {
 							errCh <- fmt.Errorf("Failed to create MQTT client: %w", err)
@@ -193,20 +143,8 @@ func main() {
 						msgp := make(chan *mqtt.Msg, 300)
 						msgs := make(chan *mqtt.Msg, 1)
 
-						cfg := &ha.Config{
-							AppName:              appName,
-							Version:              Version,
-							Debug:                c.Bool("debug"),
-							Devices:              c.Args().Slice(),
-							Password:             c.String("password"),
-							TopicPrefix:          c.String("topic-prefix"),
-							DiscoveryTopicPrefix: c.String("discovery-topic-prefix"),
-							Interval:             c.Duration("interval"),
-							DiscoveryInterval:    c.Duration("discovery-interval"),
-						}
-						errCh <- ha.Run(ctx, cfg, logger, mqttc, msgp, msgs)
+						errCh <- ha.Run(ctx, cfg, logger, mqttc, msgp, msgs, reload)
 					}(ctx, errCh)
-					var err error
 				LOOP:
 					for {
 						select {
@@ -219,6 +157,17 @@ func main() {
 					return err
 				},
 				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "config",
+						Aliases: []string{"c"},
+						Usage:   "YAML configuration file with settings and per-device options",
+						EnvVars: []string{"RRF_CONFIG"},
+					},
+					&cli.DurationFlag{
+						Name:  "config-check-interval",
+						Usage: "interval between checks for changes to the configuration file; 0 to only reload on SIGHUP",
+						Value: time.Second * 10,
+					},
 					&cli.StringFlag{
 						Name:    "broker",
 						Usage:   "MQTT broker to connect to",
@@ -251,6 +200,43 @@ func main() {
 						EnvVars: []string{"RRF_INTERVAL"},
 						Value:   time.Second * 60,
 					},
+					&cli.DurationFlag{
+						Name:    "active-interval",
+						Usage:   "interval between polling devices that are printing or heating (default: interval)",
+						EnvVars: []string{"RRF_ACTIVE_INTERVAL"},
+					},
+					&cli.DurationFlag{
+						Name:    "idle-interval",
+						Usage:   "interval between polling idle devices (default: interval)",
+						EnvVars: []string{"RRF_IDLE_INTERVAL"},
+					},
+					&cli.DurationFlag{
+						Name:    "offline-max-interval",
+						Usage:   "maximum interval between polling offline devices; the interval doubles after each failure up to this limit (default: no backoff)",
+						EnvVars: []string{"RRF_OFFLINE_MAX_INTERVAL"},
+					},
+					&cli.DurationFlag{
+						Name:    "max-silence",
+						Usage:   "only publish state when it changes but at least this often (default: publish after every poll unless deadbands are set)",
+						EnvVars: []string{"RRF_MAX_SILENCE"},
+					},
+					&cli.StringFlag{
+						Name:    "state-topics",
+						Usage:   "publish state as a 'json' message, to a topic per variable ('variables') or 'both'",
+						EnvVars: []string{"RRF_STATE_TOPICS"},
+						Value:   ha.StateTopicsJSON,
+					},
+					&cli.StringSliceFlag{
+						Name:    "deadband",
+						Usage:   "change in value, as field=value or sensor-group=value, needed before state is published again (e.g. temperatures=0.5); enables publishing only on change",
+						EnvVars: []string{"RRF_DEADBAND"},
+					},
+					&cli.DurationFlag{
+						Name:    "timeout",
+						Usage:   "timeout for requests to devices",
+						EnvVars: []string{"RRF_TIMEOUT"},
+						Value:   time.Second * 30,
+					},
 					&cli.DurationFlag{
 						Name: "discovery-interval", Aliases: []string{"di"},
 						Usage:   "interval between publishing discovery messages",
@@ -277,3 +263,102 @@ func main() {
 		log.Fatal(err)
 	}
 }
+
+// haConfig creates the homeassistant configuration from the command
+// line flags, environment variables and optional configuration file.
+func haConfig(c *cli.Context) (*ha.Config, error) {
+	cfg, err := haSettings(c)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range c.Args().Slice() {
+		cfg.Devices = append(cfg.Devices, &ha.DeviceConfig{Host: h})
+	}
+	return cfg, cfg.Validate()
+}
+
+// haSettings returns the configuration from the flags and the
+// configuration file without validating it.
+func haSettings(c *cli.Context) (*ha.Config, error) {
+	cfg := &ha.Config{
+		AppName:              appName,
+		Version:              Version,
+		Debug:                c.Bool("debug"),
+		Password:             c.String("password"),
+		Broker:               c.String("broker"),
+		ClientID:             c.String("client-id"),
+		TopicPrefix:          c.String("topic-prefix"),
+		DiscoveryTopicPrefix: c.String("discovery-topic-prefix"),
+		Interval:             c.Duration("interval"),
+		ActiveInterval:       c.Duration("active-interval"),
+		IdleInterval:         c.Duration("idle-interval"),
+		OfflineMaxInterval:   c.Duration("offline-max-interval"),
+		Timeout:              c.Duration("timeout"),
+		DiscoveryInterval:    c.Duration("discovery-interval"),
+		ConnectRetryDelay:    c.Duration("connect-retry-delay"),
+		KeepAlive:            c.Int("keepalive"),
+		MaxSilence:           c.Duration("max-silence"),
+		StateTopics:          c.String("state-topics"),
+	}
+	deadbands, err := ha.ParseDeadbands(c.StringSlice("deadband"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Deadbands = deadbands
+	if path := c.String("config"); path != "" {
+		fc, err := ha.ReadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ApplyFile(fc, c.IsSet)
+	}
+	return cfg, nil
+}
+
+func haPurgeCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name: "purge",
+		Usage: "remove all retained messages published for devices; " +
+			"names are device topic names or hosts",
+		ArgsUsage: "name...",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:  "wait",
+				Usage: "time to wait for further retained messages from the broker",
+				Value: 2 * time.Second,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() == 0 {
+				return fmt.Errorf("at least one device name is required")
+			}
+			if c.Duration("wait") <= 0 {
+				return fmt.Errorf("wait must be positive")
+			}
+			cfg, err := haSettings(c)
+			if err != nil {
+				return err
+			}
+			if cfg.Broker == "" {
+				return fmt.Errorf("broker is required")
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(),
+				os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+			logger := log.New(stdout, "",
+				log.Ldate|log.Ltime|log.Lmicroseconds)
+			topics, err := ha.Purge(ctx, cfg, c.Args().Slice(),
+				c.Duration("wait"), logger)
+			if err != nil {
+				return err
+			}
+			for _, topic := range topics {
+				fmt.Fprintf(stdout, "cleared %s\n", topic)
+			}
+			if len(topics) == 0 {
+				fmt.Fprintln(stdout, "no retained messages found")
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/mock"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+func mockCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:    "mock",
+		Aliases: []string{"m"},
+		Usage:   "simulated reprapfirmware device server for testing",
+		Subcommands: []*cli.Command{
+			mockFleetCommand(stdout),
+		},
+		Action: func(c *cli.Context) error {
+			logger := log.New(stdout, "",
+				log.Ldate|log.Ltime|log.Lmicroseconds)
+			if path := c.String("replay"); path != "" {
+				mode, err := mock.ReplayModeByName(c.String("replay-mode"))
+				if err != nil {
+					return err
+				}
+				r, err := mock.ReadReplay(logger, path, mode)
+				if err != nil {
+					return err
+				}
+				r.WithLatency(c.Bool("replay-latency"))
+				return serveMock(c.String("bind"), r)
+			}
+			f, err := mock.FirmwareByName(c.String("firmware"))
+			if err != nil {
+				return err
+			}
+			m := mock.NewMockRRF(logger).WithFirmware(f)
+			if c.Float64("speed") != 1 {
+				m.WithClock(mock.ScaledClock(c.Float64("speed")))
+			}
+			if dir := c.String("sd-dir"); dir != "" {
+				if err := m.Printer().SD().LoadDir(dir); err != nil {
+					return fmt.Errorf("failed to load SD card: %w", err)
+				}
+			}
+			if c.Bool("demo") {
+				m.Printer().GCode(`M32 "demo.gcode"`)
+			}
+			if c.Bool("no-password") {
+				m.WithPassword("")
+			} else if c.IsSet("password") {
+				m.WithPassword(c.String("password"))
+			}
+			m.WithSessionTimeout(c.Duration("session-timeout")).
+				WithMaxSessions(c.Int("max-sessions"))
+			if path := c.String("scenario"); path != "" {
+				s, err := mock.ReadScenario(path)
+				if err != nil {
+					return err
+				}
+				m.WithScenario(s)
+			}
+			return serveMock(c.String("bind"), m.Router())
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "bind",
+				Aliases: []string{"b"},
+				Usage:   "address:port to bind mock server",
+				Value:   "127.0.0.1:8888",
+			},
+			&cli.BoolFlag{
+				Name:  "demo",
+				Usage: "start printing the demo job",
+			},
+			&cli.Float64Flag{
+				Name:  "speed",
+				Usage: "speed of the simulation relative to real time",
+				Value: 1,
+			},
+			&cli.StringFlag{
+				Name:  "firmware",
+				Usage: "firmware to emulate: legacy, rrf2, rrf3 or rrf3-model",
+				Value: "rrf2",
+			},
+			&cli.StringFlag{
+				Name:  "scenario",
+				Usage: "YAML file of scheduled faults to inject",
+			},
+			&cli.StringFlag{
+				Name:  "sd-dir",
+				Usage: "directory to copy on to the virtual SD card",
+			},
+			&cli.StringFlag{
+				Name:    "password",
+				Aliases: []string{"p"},
+				Usage:   "password to accept, reprap or passw0rd by default",
+			},
+			&cli.BoolFlag{
+				Name:  "no-password",
+				Usage: "accept any password and requests without connecting",
+			},
+			&cli.DurationFlag{
+				Name:  "session-timeout",
+				Usage: "time after the last request that a session expires",
+				Value: mock.DefaultSessionTimeout,
+			},
+			&cli.IntFlag{
+				Name:  "max-sessions",
+				Usage: "maximum number of sessions, 0 for no limit",
+			},
+			&cli.StringFlag{
+				Name:  "replay",
+				Usage: "file recorded with the record command to replay",
+			},
+			&cli.StringFlag{
+				Name:  "replay-mode",
+				Usage: "serve the recording in order or by URL",
+				Value: string(mock.ReplayURL),
+			},
+			&cli.BoolFlag{
+				Name:  "replay-latency",
+				Usage: "respond as slowly as when recorded",
+			},
+		},
+	}
+}
+
+func mockFleetCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:  "fleet",
+		Usage: "serve several simulated devices in different states",
+		Action: func(c *cli.Context) error {
+			n := c.Int("count")
+			if n < 1 {
+				return fmt.Errorf("count must be at least 1")
+			}
+			host, port, err := splitBind(c.String("bind"))
+			if err != nil {
+				return err
+			}
+			// keep the log out of a device list written to stdout
+			logw := stdout
+			if c.String("devices") == "-" {
+				logw = c.App.ErrWriter
+			}
+			fleet := mock.NewFleet(log.New(logw, "",
+				log.Ldate|log.Ltime|log.Lmicroseconds), n)
+			if c.Float64("speed") != 1 {
+				for _, m := range fleet.Printers {
+					m.WithClock(mock.ScaledClock(c.Float64("speed")))
+				}
+			}
+			fleet.Start()
+
+			devices := &fleetDevices{Password: "reprap"}
+			for i, name := range fleet.Names {
+				addr := net.JoinHostPort(host, strconv.Itoa(port+i))
+				if c.Bool("virtual-hosts") {
+					addr = net.JoinHostPort(name, strconv.Itoa(port))
+				}
+				devices.Devices = append(devices.Devices,
+					&fleetDevice{Host: addr, Name: name})
+			}
+			if err := writeFleetDevices(c.String("devices"), stdout,
+				devices); err != nil {
+				return err
+			}
+
+			if c.Bool("virtual-hosts") {
+				return serveMock(c.String("bind"), fleet.Router())
+			}
+			errc := make(chan error, n)
+			for i, m := range fleet.Printers {
+				addr := net.JoinHostPort(host, strconv.Itoa(port+i))
+				go func(addr string, h http.Handler) {
+					errc <- serveMock(addr, h)
+				}(addr, m.Router())
+			}
+			return <-errc
+		},
+		Flags: []cli.Flag{
+			&cli.IntFlag{
+				Name:    "count",
+				Aliases: []string{"n"},
+				Usage:   "number of devices",
+				Value:   4,
+			},
+			&cli.StringFlag{
+				Name:    "bind",
+				Aliases: []string{"b"},
+				Usage: "address:port to bind the first device, the others " +
+					"use the following ports",
+				Value: "127.0.0.1:8888",
+			},
+			&cli.BoolFlag{
+				Name: "virtual-hosts",
+				Usage: "serve all devices on one port and route by host " +
+					"name, which must resolve to the bind address",
+			},
+			&cli.StringFlag{
+				Name: "devices",
+				Usage: "file to write the device list for the ha command " +
+					"to, '-' for stdout with the log on stderr",
+				Value: "-",
+			},
+			&cli.Float64Flag{
+				Name:  "speed",
+				Usage: "speed of the simulation relative to real time",
+				Value: 1,
+			},
+		},
+	}
+}
+
+// fleetDevices is the part of the ha configuration file listing the
+// devices.
+type fleetDevices struct {
+	Password string         `yaml:"password"`
+	Devices  []*fleetDevice `yaml:"devices"`
+}
+
+type fleetDevice struct {
+	Host string `yaml:"host"`
+	Name string `yaml:"name"`
+}
+
+func writeFleetDevices(path string, stdout io.Writer, devices *fleetDevices) error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(devices); err != nil {
+		return fmt.Errorf("failed to encode device list: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return fmt.Errorf("failed to encode device list: %w", err)
+	}
+	if path == "-" {
+		_, err := stdout.Write(buf.Bytes())
+		return err
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write device list: %w", err)
+	}
+	return nil
+}
+
+// splitBind splits an address:port into the address and port number.
+func splitBind(bind string) (string, int, error) {
+	host, p, err := net.SplitHostPort(bind)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid bind address %s: %w", bind, err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid bind port %s: %w", bind, err)
+	}
+	return host, port, nil
+}
+
+func serveMock(addr string, h http.Handler) error {
+	srv := &http.Server{
+		Addr:           addr,
+		Handler:        h,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return fmt.Errorf("http server failed: %v", err)
+	}
+	return nil
+}
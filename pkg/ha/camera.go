@@ -0,0 +1,164 @@
+package ha
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+)
+
+// Default intervals between camera snapshots.
+const (
+	defaultCameraInterval       = time.Minute
+	defaultCameraActiveInterval = 10 * time.Second
+)
+
+// CameraConfig holds the settings for the webcam of a device.
+type CameraConfig struct {
+	// URL returns a JPEG snapshot
+	URL string `yaml:"url"`
+	// Interval is the time between snapshots, 1m by default
+	Interval time.Duration `yaml:"interval"`
+	// ActiveInterval is the time between snapshots while the device is
+	// printing or heating, 10s by default
+	ActiveInterval time.Duration `yaml:"active-interval"`
+}
+
+func (cc *CameraConfig) interval(active bool) time.Duration {
+	if active {
+		if cc.ActiveInterval > 0 {
+			return cc.ActiveInterval
+		}
+		return defaultCameraActiveInterval
+	}
+	if cc.Interval > 0 {
+		return cc.Interval
+	}
+	return defaultCameraInterval
+}
+
+// Camera is a camera discovery message with the device replaced by the
+// Device type.
+type Camera struct {
+	ha.Camera
+	Device Device `json:"device,omitempty"`
+}
+
+func CameraTopic(cfg *Config, name string) string {
+	return fmt.Sprintf("%s/%s/camera", cfg.TopicPrefix, name)
+}
+
+func CameraConfigTopic(cfg *Config, name string) string {
+	return fmt.Sprintf("%s/camera/%s_camera/config",
+		cfg.DiscoveryTopicPrefix, name)
+}
+
+func cameraDiscoveryMessage(cfg *Config, res *PollResult, availability []ha.Availability) *mqtt.Msg {
+	return &mqtt.Msg{
+		Topic: CameraConfigTopic(cfg, res.TopicFriendlyName),
+		Body: Camera{
+			Camera: ha.Camera{
+				Availability:     availability,
+				AvailabilityMode: "all",
+				Name:             res.FriendlyName() + " camera",
+				Icon:             "mdi:webcam",
+				UniqueID:         res.TopicFriendlyName + "_camera",
+				Topic:            CameraTopic(cfg, res.TopicFriendlyName),
+			},
+			Device: device(res),
+		},
+		Retain: true,
+	}
+}
+
+// cameraState is shared between a device loop and its camera loop.  The
+// topic name of the device is only known after it has been polled.
+type cameraState struct {
+	mu     sync.Mutex
+	name   string
+	active bool
+}
+
+func (cs *cameraState) set(name string, active bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.name, cs.active = name, active
+}
+
+func (cs *cameraState) get() (string, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.name, cs.active
+}
+
+// cameraLoop publishes snapshots from the camera until the context is
+// cancelled.  Snapshots are not taken until the device has been polled.
+func cameraLoop(ctx context.Context, cc *CameraConfig, cfg *Config, timeout time.Duration, state *cameraState, msgc chan *mqtt.Msg, logger *log.Logger) {
+	client := &http.Client{Timeout: timeout}
+	lastErr := ""
+	for {
+		name, active := state.get()
+		if name != "" {
+			img, err := snapshot(ctx, client, cc.URL)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				// only log changes so a broken camera doesn't fill the log
+				if err.Error() != lastErr {
+					logger.Printf("camera error: %s\n", err)
+				}
+				lastErr = err.Error()
+			} else {
+				lastErr = ""
+				select {
+				case msgc <- &mqtt.Msg{Topic: CameraTopic(cfg, name), Body: img}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		wait := cc.interval(active)
+		if name == "" {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// snapshot returns the image from url as a string so that it is
+// published unchanged.
+func snapshot(ctx context.Context, client *http.Client, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("snapshot from %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("snapshot from %s failed: %s", url, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" &&
+		!strings.HasPrefix(ct, "image/") {
+		return "", fmt.Errorf("snapshot from %s failed: content type %s is not an image", url, ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("snapshot from %s failed: %w", url, err)
+	}
+	return string(b), nil
+}
@@ -0,0 +1,105 @@
+package ha
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+	"github.com/beanz/rrf-go/pkg/mock"
+)
+
+// jpeg is not a valid image but has the start of image marker and a
+// byte that is not valid UTF-8
+const jpeg = "\xff\xd8\xff\xe0snapshot"
+
+func cameraServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpeg")
+		_, _ = w.Write([]byte(jpeg))
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	return httptest.NewServer(mux)
+}
+
+func Test_Snapshot(t *testing.T) {
+	ts := cameraServer()
+	defer ts.Close()
+	ctx := context.Background()
+
+	img, err := snapshot(ctx, ts.Client(), ts.URL+"/snapshot")
+	require.NoError(t, err)
+	assert.Equal(t, jpeg, img)
+
+	_, err = snapshot(ctx, ts.Client(), ts.URL+"/missing")
+	assert.EqualError(t, err,
+		"snapshot from "+ts.URL+"/missing failed: 404 Not Found")
+	_, err = snapshot(ctx, ts.Client(), ts.URL+"/html")
+	assert.EqualError(t, err, "snapshot from "+ts.URL+
+		"/html failed: content type text/html is not an image")
+}
+
+func Test_CameraInterval(t *testing.T) {
+	cc := &CameraConfig{}
+	assert.Equal(t, time.Minute, cc.interval(false))
+	assert.Equal(t, 10*time.Second, cc.interval(true))
+	cc = &CameraConfig{Interval: time.Hour, ActiveInterval: time.Second}
+	assert.Equal(t, time.Hour, cc.interval(false))
+	assert.Equal(t, time.Second, cc.interval(true))
+}
+
+func Test_DeviceLoopCamera(t *testing.T) {
+	var buf bytes.Buffer
+	m := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(m.Router())
+	defer ts.Close()
+	cs := cameraServer()
+	defer cs.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	msgc := make(chan *mqtt.Msg, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go deviceLoop(ctx, &DeviceConfig{
+		Host:   host,
+		Topic:  "one",
+		Camera: &CameraConfig{URL: cs.URL + "/snapshot"},
+	}, &Config{
+		Password:             "passw0rd",
+		Interval:             time.Minute,
+		DiscoveryInterval:    time.Hour,
+		TopicPrefix:          "rrfdata",
+		DiscoveryTopicPrefix: "rrfdisc",
+	}, msgc, log.New(&buf, "", 0), nil)
+
+	published := map[string]interface{}{}
+	// the camera loop checks for the device name once a second
+	timeout := time.After(2500 * time.Millisecond)
+LOOP:
+	for {
+		select {
+		case msg := <-msgc:
+			published[msg.Topic] = msg.Body
+		case <-timeout:
+			break LOOP
+		}
+	}
+	require.Contains(t, published, "rrfdisc/camera/one_camera/config")
+	camera := published["rrfdisc/camera/one_camera/config"].(Camera)
+	assert.Equal(t, "rrfdata/one/camera", camera.Topic)
+	assert.Equal(t, "one_camera", camera.UniqueID)
+	assert.Equal(t, []string{"one"}, camera.Device.Identifiers)
+	assert.Equal(t, jpeg, published["rrfdata/one/camera"])
+}
@@ -0,0 +1,85 @@
+package ha
+
+import (
+	"math"
+	"reflect"
+	"time"
+)
+
+// deadband returns the amount by which the value of the variable must
+// change before a new state is published.  A deadband for the variable
+// field takes precedence over one for its sensor group.
+func (cfg *Config) deadband(v *Variable) float64 {
+	if d, ok := cfg.Deadbands[v.field]; ok {
+		return d
+	}
+	return cfg.Deadbands[v.group]
+}
+
+// changed returns true if the set of variables is different from the
+// last published values or any value has changed by more than its
+// deadband.
+func (cfg *Config) changed(last map[string]interface{}, variables []*Variable) bool {
+	if last == nil || len(last) != len(variables) {
+		return true
+	}
+	for _, v := range variables {
+		prev, ok := last[v.field]
+		if !ok {
+			return true
+		}
+		a, aok := numeric(prev)
+		b, bok := numeric(v.value)
+		if aok && bok {
+			if math.Abs(a-b) > cfg.deadband(v) {
+				return true
+			}
+			continue
+		}
+		if !reflect.DeepEqual(prev, v.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// numeric returns the value of v as a float64 if it is a number.
+func numeric(v interface{}) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
+// values returns the values of the variables keyed by field.
+func values(variables []*Variable) map[string]interface{} {
+	m := make(map[string]interface{}, len(variables))
+	for _, v := range variables {
+		m[v.field] = v.value
+	}
+	return m
+}
+
+// changesOnly returns true if the state is only published when it
+// changes, which is the case when either a heartbeat or deadbands are
+// configured.
+func (cfg *Config) changesOnly() bool {
+	return cfg.MaxSilence > 0 || len(cfg.Deadbands) > 0
+}
+
+// shouldPublish returns true if the state should be published because
+// it has changed or the heartbeat is due.
+func (cfg *Config) shouldPublish(last map[string]interface{}, variables []*Variable, silence time.Duration) bool {
+	if !cfg.changesOnly() || cfg.changed(last, variables) {
+		return true
+	}
+	return cfg.MaxSilence > 0 && silence >= cfg.MaxSilence
+}
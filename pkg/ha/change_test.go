@@ -0,0 +1,98 @@
+package ha
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_Changed(t *testing.T) {
+	cfg := &Config{
+		Deadbands: map[string]float64{
+			SensorsTemperatures: 0.5,
+			SensorsPosition:     0.1,
+			"z":                 0.01,
+		},
+	}
+	last := map[string]interface{}{
+		"state":               "idle",
+		"layer":               1,
+		"file_time_remaining": types.Time(100),
+		"temp_bed":            60.0,
+		"x":                   10.0,
+		"z":                   1.0,
+	}
+	variables := func(changes map[string]interface{}) []*Variable {
+		vs := []*Variable{
+			{field: "state", group: SensorsState, value: "idle"},
+			{field: "layer", group: SensorsLayer, value: 1},
+			{field: "file_time_remaining", group: SensorsTimes,
+				value: types.Time(100)},
+			{field: "temp_bed", group: SensorsTemperatures, value: 60.0},
+			{field: "x", group: SensorsPosition, value: 10.0},
+			{field: "z", group: SensorsPosition, value: 1.0},
+		}
+		for _, v := range vs {
+			if nv, ok := changes[v.field]; ok {
+				v.value = nv
+			}
+		}
+		return vs
+	}
+	tests := []struct {
+		name    string
+		changes map[string]interface{}
+		want    bool
+	}{
+		{"unchanged", nil, false},
+		{"string", map[string]interface{}{"state": "printing"}, true},
+		{"int", map[string]interface{}{"layer": 2}, true},
+		{"time", map[string]interface{}{
+			"file_time_remaining": types.Time(99)}, true},
+		{"within group deadband", map[string]interface{}{
+			"temp_bed": 60.4, "x": 10.05}, false},
+		{"outside group deadband", map[string]interface{}{
+			"temp_bed": 60.6}, true},
+		{"field deadband", map[string]interface{}{"z": 1.05}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want,
+				cfg.changed(last, variables(tc.changes)))
+		})
+	}
+	assert.True(t, cfg.changed(nil, variables(nil)))
+	assert.True(t, cfg.changed(last, variables(nil)[1:]))
+	assert.True(t, cfg.changed(last, append(variables(nil)[1:],
+		&Variable{field: "y", value: 0.0})))
+}
+
+func Test_ShouldPublish(t *testing.T) {
+	last := map[string]interface{}{"temp_bed": 60.0}
+	same := []*Variable{{field: "temp_bed", group: SensorsTemperatures,
+		value: 60.0}}
+	tests := []struct {
+		name    string
+		cfg     *Config
+		silence time.Duration
+		want    bool
+	}{
+		{"every poll", &Config{}, 0, true},
+		{"deadband only", &Config{
+			Deadbands: map[string]float64{SensorsTemperatures: 0.5}},
+			time.Hour, false},
+		{"heartbeat not due", &Config{MaxSilence: time.Minute},
+			time.Second, false},
+		{"heartbeat due", &Config{MaxSilence: time.Minute},
+			time.Minute, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want,
+				tc.cfg.shouldPublish(last, same, tc.silence))
+		})
+	}
+}
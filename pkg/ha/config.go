@@ -1,21 +1,460 @@
 package ha
 
 import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	AppName              string
 	Version              string
 	Debug                bool
-	Devices              []string
+	Devices              []*DeviceConfig
 	Password             string
 	Broker               string
 	ClientID             string
 	TopicPrefix          string
 	DiscoveryTopicPrefix string
 	Interval             time.Duration
-	DiscoveryInterval    time.Duration
-	ConnectRetryDelay    time.Duration
-	KeepAlive            int
+	// ActiveInterval and IdleInterval override Interval when a device
+	// is printing or heating and when it is idle respectively
+	ActiveInterval time.Duration
+	IdleInterval   time.Duration
+	// OfflineMaxInterval is the limit for the interval, doubled after
+	// each failed poll, when a device is offline.  Zero disables the
+	// backoff.
+	OfflineMaxInterval time.Duration
+	Timeout            time.Duration
+	// MaxSilence enables publishing state only when it changes; the
+	// state is still published at least this often.  Zero, without
+	// deadbands, publishes the state after every poll.
+	MaxSilence time.Duration
+	// Deadbands maps variable fields or sensor groups to the change in
+	// value needed before the state is published again.  Deadbands
+	// also enable publishing state only when it changes.
+	Deadbands map[string]float64
+	// StateTopics selects whether the state is published as a JSON
+	// message, to a topic per variable or both
+	StateTopics       string
+	DiscoveryInterval time.Duration
+	ConnectRetryDelay time.Duration
+	KeepAlive         int
+}
+
+// DeviceConfig holds the settings for a single device.  Zero values
+// mean that the corresponding global setting from Config is used.
+type DeviceConfig struct {
+	Host           string        `yaml:"host"`
+	Name           string        `yaml:"name"`
+	Password       string        `yaml:"password"`
+	Interval       time.Duration `yaml:"interval"`
+	ActiveInterval time.Duration `yaml:"active-interval"`
+	IdleInterval   time.Duration `yaml:"idle-interval"`
+	Timeout        time.Duration `yaml:"timeout"`
+	// Sensors is the list of enabled sensor groups; all groups are
+	// enabled if it is empty
+	Sensors []string `yaml:"sensors"`
+	// Topic overrides the topic name derived from the device name
+	Topic string `yaml:"topic"`
+	// Area is the area suggested to Home Assistant for the device
+	Area string `yaml:"area"`
+	// MAC is the MAC address of the device for firmware that does not
+	// report it
+	MAC string `yaml:"mac"`
+	// Camera enables publishing snapshots from a webcam
+	Camera *CameraConfig `yaml:"camera"`
+}
+
+// Sensor groups that can be enabled for a device.
+const (
+	SensorsState        = "state"
+	SensorsTimes        = "times"
+	SensorsMCU          = "mcu"
+	SensorsVIN          = "vin"
+	SensorsGeometry     = "geometry"
+	SensorsLayer        = "layer"
+	SensorsSpeed        = "speed"
+	SensorsPosition     = "position"
+	SensorsExtruders    = "extruders"
+	SensorsTemperatures = "temperatures"
+)
+
+// Values for Config.StateTopics.
+const (
+	// StateTopicsJSON publishes the state as a single JSON message on
+	// the state topic.  It is the default.
+	StateTopicsJSON = "json"
+	// StateTopicsVariables publishes each variable to its own topic.
+	StateTopicsVariables = "variables"
+	// StateTopicsBoth publishes both but discovery uses the JSON state.
+	StateTopicsBoth = "both"
+)
+
+var SensorGroups = []string{
+	SensorsState, SensorsTimes, SensorsMCU, SensorsVIN, SensorsGeometry,
+	SensorsLayer, SensorsSpeed, SensorsPosition, SensorsExtruders,
+	SensorsTemperatures,
+}
+
+// FileConfig is the content of a configuration file.  The keys are the
+// same as the names of the corresponding command line flags.
+type FileConfig struct {
+	Password             string             `yaml:"password"`
+	Broker               string             `yaml:"broker"`
+	ClientID             string             `yaml:"client-id"`
+	TopicPrefix          string             `yaml:"topic-prefix"`
+	DiscoveryTopicPrefix string             `yaml:"discovery-topic-prefix"`
+	Interval             time.Duration      `yaml:"interval"`
+	ActiveInterval       time.Duration      `yaml:"active-interval"`
+	IdleInterval         time.Duration      `yaml:"idle-interval"`
+	OfflineMaxInterval   time.Duration      `yaml:"offline-max-interval"`
+	Timeout              time.Duration      `yaml:"timeout"`
+	MaxSilence           time.Duration      `yaml:"max-silence"`
+	Deadbands            map[string]float64 `yaml:"deadbands"`
+	StateTopics          string             `yaml:"state-topics"`
+	DiscoveryInterval    time.Duration      `yaml:"discovery-interval"`
+	ConnectRetryDelay    time.Duration      `yaml:"connect-retry-delay"`
+	KeepAlive            int                `yaml:"keepalive"`
+	Devices              []*DeviceConfig    `yaml:"devices"`
+}
+
+// ReadConfigFile reads a YAML configuration file.  Unknown keys are
+// rejected so that typos are reported rather than silently ignored.
+func ReadConfigFile(path string) (*FileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	var fc FileConfig
+	err = dec.Decode(&fc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return &fc, nil
+}
+
+// ApplyFile merges the settings from the configuration file.  Settings
+// for which isSet returns true, given the flag name, were set explicitly
+// on the command line or by environment variable and take precedence
+// over the file.  Devices from the file are added before any existing
+// devices.
+func (cfg *Config) ApplyFile(fc *FileConfig, isSet func(name string) bool) {
+	str := func(name string, dst *string, v string) {
+		if v != "" && !isSet(name) {
+			*dst = v
+		}
+	}
+	dur := func(name string, dst *time.Duration, v time.Duration) {
+		if v != 0 && !isSet(name) {
+			*dst = v
+		}
+	}
+	str("password", &cfg.Password, fc.Password)
+	str("broker", &cfg.Broker, fc.Broker)
+	str("client-id", &cfg.ClientID, fc.ClientID)
+	str("topic-prefix", &cfg.TopicPrefix, fc.TopicPrefix)
+	str("discovery-topic-prefix", &cfg.DiscoveryTopicPrefix,
+		fc.DiscoveryTopicPrefix)
+	str("state-topics", &cfg.StateTopics, fc.StateTopics)
+	dur("interval", &cfg.Interval, fc.Interval)
+	dur("active-interval", &cfg.ActiveInterval, fc.ActiveInterval)
+	dur("idle-interval", &cfg.IdleInterval, fc.IdleInterval)
+	dur("offline-max-interval", &cfg.OfflineMaxInterval,
+		fc.OfflineMaxInterval)
+	dur("timeout", &cfg.Timeout, fc.Timeout)
+	dur("max-silence", &cfg.MaxSilence, fc.MaxSilence)
+	if len(fc.Deadbands) > 0 && !isSet("deadband") {
+		cfg.Deadbands = fc.Deadbands
+	}
+	dur("discovery-interval", &cfg.DiscoveryInterval, fc.DiscoveryInterval)
+	dur("connect-retry-delay", &cfg.ConnectRetryDelay, fc.ConnectRetryDelay)
+	if fc.KeepAlive != 0 && !isSet("keepalive") {
+		cfg.KeepAlive = fc.KeepAlive
+	}
+	cfg.Devices = append(fc.Devices, cfg.Devices...)
+}
+
+// Validate checks the configuration and returns an error describing
+// every problem found.
+func (cfg *Config) Validate() error {
+	errs := []string{}
+	if cfg.Broker == "" {
+		errs = append(errs, "broker is required")
+	}
+	if cfg.Interval <= 0 {
+		errs = append(errs, "interval must be positive")
+	}
+	if cfg.DiscoveryInterval <= 0 {
+		errs = append(errs, "discovery interval must be positive")
+	}
+	if cfg.ActiveInterval < 0 {
+		errs = append(errs, "active interval must not be negative")
+	}
+	if cfg.IdleInterval < 0 {
+		errs = append(errs, "idle interval must not be negative")
+	}
+	if cfg.OfflineMaxInterval < 0 {
+		errs = append(errs, "offline max interval must not be negative")
+	}
+	if cfg.Timeout < 0 {
+		errs = append(errs, "timeout must not be negative")
+	}
+	switch cfg.StateTopics {
+	case "", StateTopicsJSON, StateTopicsVariables, StateTopicsBoth:
+	default:
+		errs = append(errs, fmt.Sprintf(
+			"state topics must be one of %s, %s or %s",
+			StateTopicsJSON, StateTopicsVariables, StateTopicsBoth))
+	}
+	if cfg.MaxSilence < 0 {
+		errs = append(errs, "max silence must not be negative")
+	}
+	names := make([]string, 0, len(cfg.Deadbands))
+	for name := range cfg.Deadbands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if cfg.Deadbands[name] < 0 {
+			errs = append(errs, fmt.Sprintf(
+				"deadband for %s must not be negative", name))
+		}
+	}
+	if len(cfg.Devices) == 0 {
+		errs = append(errs, "at least one device is required")
+	}
+	hosts := map[string]bool{}
+	topics := map[string]bool{}
+	for i, dev := range cfg.Devices {
+		prefix := fmt.Sprintf("device %d", i+1)
+		if dev == nil || dev.Host == "" {
+			errs = append(errs, prefix+": host is required")
+			continue
+		}
+		prefix += " (" + dev.Host + ")"
+		if hosts[dev.Host] {
+			errs = append(errs, prefix+": duplicate host")
+		}
+		hosts[dev.Host] = true
+		if dev.Topic != "" {
+			if dev.Topic != topicSafe(dev.Topic) {
+				errs = append(errs, fmt.Sprintf(
+					"%s: topic '%s' is not topic safe, try '%s'",
+					prefix, dev.Topic, topicSafe(dev.Topic)))
+			}
+			if topics[dev.Topic] {
+				errs = append(errs, fmt.Sprintf("%s: duplicate topic '%s'",
+					prefix, dev.Topic))
+			}
+			topics[dev.Topic] = true
+		}
+		if dev.Interval < 0 {
+			errs = append(errs, prefix+": interval must not be negative")
+		}
+		if dev.ActiveInterval < 0 {
+			errs = append(errs, prefix+": active interval must not be negative")
+		}
+		if dev.IdleInterval < 0 {
+			errs = append(errs, prefix+": idle interval must not be negative")
+		}
+		if dev.Timeout < 0 {
+			errs = append(errs, prefix+": timeout must not be negative")
+		}
+		if cc := dev.Camera; cc != nil {
+			if u, err := url.Parse(cc.URL); err != nil ||
+				(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Sprintf(
+					"%s: camera url '%s' is not a valid http url",
+					prefix, cc.URL))
+			}
+			if cc.Interval < 0 || cc.ActiveInterval < 0 {
+				errs = append(errs,
+					prefix+": camera intervals must not be negative")
+			}
+		}
+		for _, g := range dev.Sensors {
+			if !validSensorGroup(g) {
+				errs = append(errs, fmt.Sprintf(
+					"%s: unknown sensor group '%s' (valid groups are: %s)",
+					prefix, g, strings.Join(SensorGroups, ", ")))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s",
+			strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+// ParseDeadbands parses deadbands given as "name=value" where name is a
+// variable field or sensor group.
+func ParseDeadbands(specs []string) (map[string]float64, error) {
+	deadbands := map[string]float64{}
+	for _, spec := range specs {
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid deadband %q, expected name=value", spec)
+		}
+		v, err := strconv.ParseFloat(spec[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deadband %q: %w", spec, err)
+		}
+		deadbands[spec[:i]] = v
+	}
+	return deadbands, nil
+}
+
+func validSensorGroup(g string) bool {
+	for _, sg := range SensorGroups {
+		if g == sg {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonState returns true if the state is published as a JSON message.
+func (cfg *Config) jsonState() bool {
+	return cfg.StateTopics != StateTopicsVariables
+}
+
+// variableState returns true if each variable is published to its own
+// topic.
+func (cfg *Config) variableState() bool {
+	return cfg.StateTopics == StateTopicsVariables ||
+		cfg.StateTopics == StateTopicsBoth
+}
+
+func (cfg *Config) password(dev *DeviceConfig) string {
+	if dev.Password != "" {
+		return dev.Password
+	}
+	return cfg.Password
+}
+
+func (cfg *Config) interval(dev *DeviceConfig) time.Duration {
+	if dev.Interval > 0 {
+		return dev.Interval
+	}
+	return cfg.Interval
+}
+
+// pollInterval returns the interval before the next poll of the device
+// given the latest status, which is nil if the device is offline, and
+// the number of consecutive failed polls.
+func (cfg *Config) pollInterval(dev *DeviceConfig, s *types.StatusResponse, failures int) time.Duration {
+	interval := cfg.interval(dev)
+	if s == nil {
+		if cfg.OfflineMaxInterval <= 0 {
+			return interval
+		}
+		for i := 1; i < failures && interval < cfg.OfflineMaxInterval; i++ {
+			interval *= 2
+		}
+		if interval > cfg.OfflineMaxInterval {
+			interval = cfg.OfflineMaxInterval
+		}
+		return interval
+	}
+	if isActive(s) {
+		if dev.ActiveInterval > 0 {
+			return dev.ActiveInterval
+		}
+		if cfg.ActiveInterval > 0 {
+			return cfg.ActiveInterval
+		}
+		return interval
+	}
+	if dev.IdleInterval > 0 {
+		return dev.IdleInterval
+	}
+	if cfg.IdleInterval > 0 {
+		return cfg.IdleInterval
+	}
+	return interval
+}
+
+// isActive returns true if the device is printing, moving or has a
+// heater that is heating.
+func isActive(s *types.StatusResponse) bool {
+	switch s.Status {
+	case types.Idle, types.Stopped, types.Halted:
+	default:
+		return true
+	}
+	for _, st := range s.Temps.State {
+		if st == types.Active {
+			return true
+		}
+	}
+	return false
+}
+
+func (cfg *Config) timeout(dev *DeviceConfig) time.Duration {
+	if dev.Timeout > 0 {
+		return dev.Timeout
+	}
+	return cfg.Timeout
+}
+
+// sensorsEnabled returns true if the sensor group is enabled for the
+// device.
+func (dev *DeviceConfig) sensorsEnabled(group string) bool {
+	if dev == nil || len(dev.Sensors) == 0 {
+		return true
+	}
+	for _, g := range dev.Sensors {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchConfigFile checks the file at path every interval and sends on
+// changed when its modification time or size changes.  It returns when
+// the context is cancelled.
+func WatchConfigFile(ctx context.Context, path string, interval time.Duration, changed chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last os.FileInfo
+	if st, err := os.Stat(path); err == nil {
+		last = st
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		st, err := os.Stat(path)
+		if err != nil {
+			// the file may be in the process of being replaced
+			continue
+		}
+		if last != nil && st.ModTime().Equal(last.ModTime()) &&
+			st.Size() == last.Size() {
+			continue
+		}
+		last = st
+		select {
+		case changed <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -0,0 +1,217 @@
+package ha
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/mock"
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_ReadConfigFile(t *testing.T) {
+	fc, err := ReadConfigFile("testdata/config.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, &FileConfig{
+		Broker:            "tcp://mqtt.example.com:1883",
+		Password:          "reprap",
+		Interval:          30 * time.Second,
+		DiscoveryInterval: 2 * time.Hour,
+		Devices: []*DeviceConfig{
+			{
+				Host:     "printer1.example.com",
+				Name:     "Workshop Printer",
+				Password: "secret",
+				Interval: 10 * time.Second,
+				Timeout:  5 * time.Second,
+				Sensors:  []string{"state", "temperatures"},
+				Topic:    "workshop",
+			},
+			{
+				Host: "printer2.example.com",
+			},
+		},
+	}, fc)
+
+	_, err = ReadConfigFile("testdata/missing.yaml")
+	assert.Error(t, err)
+
+	bad := filepath.Join(t.TempDir(), "bad.yaml")
+	require.NoError(t, os.WriteFile(bad, []byte("brokr: tcp://foo:1883\n"), 0600))
+	_, err = ReadConfigFile(bad)
+	assert.Error(t, err)
+}
+
+func Test_ApplyFile(t *testing.T) {
+	fc, err := ReadConfigFile("testdata/config.yaml")
+	require.NoError(t, err)
+	cfg := &Config{
+		Broker:            "tcp://localhost:1883",
+		Password:          "flag",
+		Interval:          time.Minute,
+		DiscoveryInterval: time.Hour,
+		Devices:           []*DeviceConfig{{Host: "printer3.example.com"}},
+	}
+	cfg.ApplyFile(fc, func(name string) bool { return name == "password" })
+	assert.Equal(t, "tcp://mqtt.example.com:1883", cfg.Broker)
+	assert.Equal(t, "flag", cfg.Password)
+	assert.Equal(t, 30*time.Second, cfg.Interval)
+	assert.Equal(t, 2*time.Hour, cfg.DiscoveryInterval)
+	assert.Equal(t, 3, len(cfg.Devices))
+	assert.Equal(t, "printer3.example.com", cfg.Devices[2].Host)
+	assert.NoError(t, cfg.Validate())
+
+	dev := cfg.Devices[0]
+	assert.Equal(t, "secret", cfg.password(dev))
+	assert.Equal(t, 10*time.Second, cfg.interval(dev))
+	assert.Equal(t, 5*time.Second, cfg.timeout(dev))
+	dev = cfg.Devices[1]
+	assert.Equal(t, "flag", cfg.password(dev))
+	assert.Equal(t, 30*time.Second, cfg.interval(dev))
+	assert.Equal(t, time.Duration(0), cfg.timeout(dev))
+}
+
+func Test_Validate(t *testing.T) {
+	cfg := &Config{
+		Interval: -1,
+		Devices: []*DeviceConfig{
+			{Host: "a", Topic: "Bad Topic", Sensors: []string{"temps"}},
+			{Host: "a", Interval: -1},
+			{Name: "no host"},
+			{Host: "b", Topic: "x", Timeout: -1},
+			{Host: "c", Topic: "x"},
+		},
+	}
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.Equal(t, `invalid configuration:
+  broker is required
+  interval must be positive
+  discovery interval must be positive
+  device 1 (a): topic 'Bad Topic' is not topic safe, try 'bad topic'
+  device 1 (a): unknown sensor group 'temps' (valid groups are: state, times, mcu, vin, geometry, layer, speed, position, extruders, temperatures)
+  device 2 (a): duplicate host
+  device 2 (a): interval must not be negative
+  device 3: host is required
+  device 4 (b): timeout must not be negative
+  device 5 (c): duplicate topic 'x'`, err.Error())
+
+	err = (&Config{}).Validate()
+	assert.Contains(t, err.Error(), "at least one device is required")
+
+	err = (&Config{Devices: []*DeviceConfig{{
+		Host:   "a",
+		Camera: &CameraConfig{URL: "rtsp://cam/stream", Interval: -1},
+	}}}).Validate()
+	assert.Contains(t, err.Error(), "device 1 (a): camera url 'rtsp://cam/stream' is not a valid http url")
+	assert.Contains(t, err.Error(), "device 1 (a): camera intervals must not be negative")
+
+	err = (&Config{StateTopics: "split"}).Validate()
+	assert.Contains(t, err.Error(),
+		"state topics must be one of json, variables or both")
+}
+
+func Test_VariablesFromResultsSensorGroups(t *testing.T) {
+	v := variablesFromResults(&PollResult{
+		Host: "foo",
+		Device: &DeviceConfig{
+			Host:    "foo",
+			Sensors: []string{SensorsState, SensorsPosition},
+		},
+		Status: mock.FullStatusResponse(0),
+	})
+	fields := []string{}
+	for _, variable := range v {
+		fields = append(fields, variable.field)
+	}
+	assert.Equal(t, []string{"state", "state_code", "x", "y", "z"}, fields)
+}
+
+func Test_WatchConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("broker: tcp://a:1883\n"), 0600))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed := make(chan struct{}, 1)
+	go WatchConfigFile(ctx, path, 10*time.Millisecond, changed)
+
+	select {
+	case <-changed:
+		t.Fatal("unexpected change")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, os.WriteFile(path,
+		[]byte("broker: tcp://bb:1883\n"), 0600))
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("change not detected")
+	}
+}
+
+func Test_PollInterval(t *testing.T) {
+	cfg := &Config{
+		Interval:           time.Minute,
+		ActiveInterval:     5 * time.Second,
+		IdleInterval:       2 * time.Minute,
+		OfflineMaxInterval: 10 * time.Minute,
+	}
+	status := func(st types.Status, heaters ...types.TempState) *types.StatusResponse {
+		s := &types.StatusResponse{Status: st}
+		s.Temps.State = heaters
+		return s
+	}
+	tests := []struct {
+		name     string
+		dev      *DeviceConfig
+		status   *types.StatusResponse
+		failures int
+		want     time.Duration
+	}{
+		{"printing", &DeviceConfig{}, status(types.Printing), 0, 5 * time.Second},
+		{"busy", &DeviceConfig{}, status(types.Busy), 0, 5 * time.Second},
+		{"idle", &DeviceConfig{}, status(types.Idle), 0, 2 * time.Minute},
+		{"idle heating", &DeviceConfig{},
+			status(types.Idle, types.Off, types.Active), 0, 5 * time.Second},
+		{"idle standby", &DeviceConfig{},
+			status(types.Idle, types.Standby), 0, 2 * time.Minute},
+		{"paused", &DeviceConfig{}, status(types.Stopped), 0, 2 * time.Minute},
+		{"device active", &DeviceConfig{ActiveInterval: time.Second},
+			status(types.Printing), 0, time.Second},
+		{"device idle", &DeviceConfig{IdleInterval: time.Hour},
+			status(types.Idle), 0, time.Hour},
+		{"offline", &DeviceConfig{}, nil, 1, time.Minute},
+		{"offline backoff", &DeviceConfig{}, nil, 3, 4 * time.Minute},
+		{"offline limit", &DeviceConfig{}, nil, 10, 10 * time.Minute},
+		{"offline device interval", &DeviceConfig{Interval: time.Second},
+			nil, 4, 8 * time.Second},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want,
+				cfg.pollInterval(tc.dev, tc.status, tc.failures))
+		})
+	}
+
+	cfg = &Config{Interval: time.Minute}
+	assert.Equal(t, time.Minute,
+		cfg.pollInterval(&DeviceConfig{}, status(types.Printing), 0))
+	assert.Equal(t, time.Minute,
+		cfg.pollInterval(&DeviceConfig{}, nil, 5))
+}
+
+func Test_ParseDeadbands(t *testing.T) {
+	d, err := ParseDeadbands([]string{"temperatures=0.5", "z=0.01"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"temperatures": 0.5, "z": 0.01}, d)
+
+	for _, spec := range []string{"temperatures", "=1", "x=one"} {
+		_, err := ParseDeadbands([]string{spec})
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,154 @@
+package ha
+
+import (
+	"context"
+	"log"
+	"time"
+
+	mqtt "github.com/beanz/homeassistant-go/pkg/mqtt"
+)
+
+// deviceUpdate is sent to a running device loop when the configuration
+// is reloaded.  A nil dev means that the device has been removed.
+type deviceUpdate struct {
+	dev *DeviceConfig
+	cfg *Config
+}
+
+type deviceRunner struct {
+	updc chan *deviceUpdate
+	done chan struct{}
+}
+
+// update passes u to the device loop replacing any update that has not
+// been received yet so that the caller never blocks.
+func (r *deviceRunner) update(u *deviceUpdate) {
+	select {
+	case <-r.updc:
+	default:
+	}
+	r.updc <- u
+}
+
+// deviceSet keeps track of the running device loops.
+type deviceSet struct {
+	ctx     context.Context
+	msgc    chan *mqtt.Msg
+	logger  *log.Logger
+	cfg     *Config
+	runners map[string]*deviceRunner
+	// done channels of removed devices that may still be clearing
+	// their topics
+	removed map[string]chan struct{}
+}
+
+func newDeviceSet(ctx context.Context, msgc chan *mqtt.Msg, logger *log.Logger) *deviceSet {
+	return &deviceSet{
+		ctx:     ctx,
+		msgc:    msgc,
+		logger:  logger,
+		runners: map[string]*deviceRunner{},
+		removed: map[string]chan struct{}{},
+	}
+}
+
+// apply starts loops for new devices, stops loops for removed devices
+// and passes the new configuration to the others.
+func (ds *deviceSet) apply(cfg *Config) {
+	if ds.cfg != nil {
+		cfg = ds.keepFixedSettings(cfg)
+	}
+	seen := map[string]bool{}
+	for _, dev := range cfg.Devices {
+		seen[dev.Host] = true
+		if r, ok := ds.runners[dev.Host]; ok {
+			r.update(&deviceUpdate{dev: dev, cfg: cfg})
+			continue
+		}
+		if ds.cfg != nil {
+			ds.logger.Printf("adding device %s\n", dev.Host)
+		}
+		ds.runners[dev.Host] = ds.start(dev, cfg, ds.removed[dev.Host])
+		delete(ds.removed, dev.Host)
+	}
+	for host, r := range ds.runners {
+		if !seen[host] {
+			r.update(&deviceUpdate{})
+			ds.removed[host] = r.done
+			delete(ds.runners, host)
+		}
+	}
+	ds.cfg = cfg
+}
+
+// start runs a device loop once any previous loop for the same host,
+// signalled by prev, has finished.
+func (ds *deviceSet) start(dev *DeviceConfig, cfg *Config, prev chan struct{}) *deviceRunner {
+	r := &deviceRunner{
+		updc: make(chan *deviceUpdate, 1),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		if prev != nil {
+			select {
+			case <-prev:
+			case <-ds.ctx.Done():
+				return
+			}
+		}
+		deviceLoop(ds.ctx, dev, cfg, ds.msgc, ds.logger, r.updc)
+	}()
+	return r
+}
+
+// keepFixedSettings returns a copy of cfg with the settings used by the
+// MQTT client replaced by the current values since they cannot be
+// changed without a restart.
+func (ds *deviceSet) keepFixedSettings(cfg *Config) *Config {
+	c := *cfg
+	for _, s := range []struct {
+		name     string
+		cur, new *string
+	}{
+		{"broker", &ds.cfg.Broker, &c.Broker},
+		{"client-id", &ds.cfg.ClientID, &c.ClientID},
+		{"topic-prefix", &ds.cfg.TopicPrefix, &c.TopicPrefix},
+		{"discovery-topic-prefix", &ds.cfg.DiscoveryTopicPrefix,
+			&c.DiscoveryTopicPrefix},
+	} {
+		if *s.new != *s.cur {
+			ds.logger.Printf("ignoring change of %s setting; a restart is required\n", s.name)
+			*s.new = *s.cur
+		}
+	}
+	if c.KeepAlive != ds.cfg.KeepAlive ||
+		c.ConnectRetryDelay != ds.cfg.ConnectRetryDelay {
+		ds.logger.Printf("ignoring change of broker connection settings; a restart is required\n")
+		c.KeepAlive = ds.cfg.KeepAlive
+		c.ConnectRetryDelay = ds.cfg.ConnectRetryDelay
+	}
+	return &c
+}
+
+// wait waits until all the device loops have finished or the deadline
+// has passed.  It returns false if the deadline passed.
+func (ds *deviceSet) wait(deadline time.Time) bool {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	done := []chan struct{}{}
+	for _, r := range ds.runners {
+		done = append(done, r.done)
+	}
+	for _, d := range ds.removed {
+		done = append(done, d)
+	}
+	for _, d := range done {
+		select {
+		case <-d:
+		case <-timer.C:
+			return false
+		}
+	}
+	return true
+}
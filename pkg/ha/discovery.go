@@ -0,0 +1,65 @@
+package ha
+
+import (
+	"strings"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+)
+
+// Device is the device registry information in discovery messages.  It
+// is used in place of the homeassistant-go type which has no hardware
+// version and represents connections as a list of strings rather than
+// a list of type and value pairs.
+type Device struct {
+	ConfigurationURL string      `json:"configuration_url,omitempty"`
+	Connections      [][2]string `json:"connections,omitempty"`
+	Identifiers      []string    `json:"identifiers,omitempty"`
+	Manufacturer     string      `json:"manufacturer,omitempty"`
+	Model            string      `json:"model,omitempty"`
+	Name             string      `json:"name,omitempty"`
+	SuggestedArea    string      `json:"suggested_area,omitempty"`
+	SwVersion        string      `json:"sw_version,omitempty"`
+	HwVersion        string      `json:"hw_version,omitempty"`
+	ViaDevice        string      `json:"via_device,omitempty"`
+}
+
+// Sensor is a sensor discovery message with the device replaced by the
+// Device type above.  EnabledByDefault is replaced so that false, which
+// is omitted by the homeassistant-go type, can be sent.
+type Sensor struct {
+	ha.Sensor
+	Device           Device `json:"device,omitempty"`
+	EnabledByDefault *bool  `json:"enabled_by_default,omitempty"`
+}
+
+// device returns the device registry information for the poll result.
+// Every entity of a device has the same identity so that they are all
+// grouped under a single device in Home Assistant.
+func device(res *PollResult) Device {
+	d := Device{
+		Identifiers:      []string{res.TopicFriendlyName},
+		ConfigurationURL: "http://" + res.Host,
+		Name:             res.FriendlyName(),
+		Manufacturer:     manufacturer(res.BoardType, res.Config.FirmwareElectronics),
+		Model:            res.Config.FirmwareElectronics,
+		HwVersion:        res.BoardType,
+		SwVersion:        res.Config.FirmwareName + " v" + res.Config.FirmwareVersion + " (" + string(res.Config.FirmwareDate) + ")",
+	}
+	if res.Device != nil {
+		d.SuggestedArea = res.Device.Area
+	}
+	if res.MAC != "" {
+		d.Connections = [][2]string{{"mac", strings.ToLower(res.MAC)}}
+	}
+	return d
+}
+
+// manufacturer returns the manufacturer of boards that can be
+// identified from the board type or electronics description.
+func manufacturer(boardType, electronics string) string {
+	if strings.HasPrefix(strings.ToLower(boardType), "duet") ||
+		strings.HasPrefix(electronics, "Duet") {
+		return "Duet3D"
+	}
+	return ""
+}
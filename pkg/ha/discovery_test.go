@@ -0,0 +1,74 @@
+package ha
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ha "github.com/beanz/homeassistant-go/pkg/types"
+	"github.com/beanz/rrf-go/pkg/mock"
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_Device(t *testing.T) {
+	d := device(&PollResult{
+		Host:              "printer.example.com",
+		Device:            &DeviceConfig{Name: "Workshop", Area: "Garage"},
+		BoardType:         "duet3mb6hc",
+		MAC:               "BE:EF:DE:AD:FE:ED",
+		TopicFriendlyName: "workshop",
+		Config: &types.ConfigResponse{
+			FirmwareElectronics: "Duet 3 MB6HC v1.01",
+			FirmwareName:        "RepRapFirmware for Duet 3 MB6HC",
+			FirmwareVersion:     "3.4.0",
+			FirmwareDate:        "2022-03-15",
+		},
+		Status: mock.FullStatusResponse(0),
+	})
+	assert.Equal(t, Device{
+		ConfigurationURL: "http://printer.example.com",
+		Connections:      [][2]string{{"mac", "be:ef:de:ad:fe:ed"}},
+		Identifiers:      []string{"workshop"},
+		Manufacturer:     "Duet3D",
+		Model:            "Duet 3 MB6HC v1.01",
+		Name:             "Workshop",
+		SuggestedArea:    "Garage",
+		SwVersion:        "RepRapFirmware for Duet 3 MB6HC v3.4.0 (2022-03-15)",
+		HwVersion:        "duet3mb6hc",
+	}, d)
+
+	assert.Equal(t, "", manufacturer("lpc", "LPC 1768"))
+}
+
+func Test_SensorJSON(t *testing.T) {
+	disabled := false
+	b, err := json.Marshal(Sensor{
+		Sensor: ha.Sensor{
+			Name:           "Workshop vin_min",
+			StateTopic:     "rrf/state",
+			StateClass:     StateClassMeasurement,
+			EntityCategory: ha.DiagnosticEntity,
+		},
+		EnabledByDefault: &disabled,
+		Device: Device{
+			Identifiers: []string{"workshop"},
+			Connections: [][2]string{{"mac", "be:ef:de:ad:fe:ed"}},
+			HwVersion:   "duet3mb6hc",
+		},
+	})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"name": "Workshop vin_min",
+		"state_topic": "rrf/state",
+		"state_class": "measurement",
+		"entity_category": "diagnostic",
+		"enabled_by_default": false,
+		"device": {
+			"identifiers": ["workshop"],
+			"connections": [["mac", "be:ef:de:ad:fe:ed"]],
+			"hw_version": "duet3mb6hc"
+		}
+	}`, string(b))
+}
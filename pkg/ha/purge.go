@@ -0,0 +1,213 @@
+package ha
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+)
+
+// minPurgeTick is the shortest interval between checks for further
+// retained messages.
+const minPurgeTick = 10 * time.Millisecond
+
+// Purge removes the retained messages published for the named devices.
+// Each name may be a device topic name or a host; hosts are resolved to
+// the names used for their topics by purgeNames.  The broker is asked
+// for every retained discovery config and data topic and those
+// belonging to the devices are cleared by publishing empty retained
+// messages.  Retained messages are collected until none have been
+// received for the quiet period.  It returns the topics that were
+// cleared.
+func Purge(ctx context.Context, cfg *Config, names []string, quiet time.Duration, logger *log.Logger) ([]string, error) {
+	names = purgeNames(ctx, cfg, names, logger)
+	broker, err := url.Parse(cfg.Broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url: %w", err)
+	}
+	var mu sync.Mutex
+	last := time.Now()
+	matched := map[string]bool{}
+	// connect in the same way as the MQTT client used by the bridge so
+	// that the same broker urls are supported
+	cmCfg := autopaho.ClientConfig{
+		BrokerUrls:        []*url.URL{broker},
+		KeepAlive:         uint16(cfg.KeepAlive),
+		ConnectRetryDelay: cfg.ConnectRetryDelay,
+		OnConnectError: func(err error) {
+			logger.Printf("error whilst attempting connection: %s\n", err)
+		},
+		Debug: paho.NOOPLogger{},
+		ClientConfig: paho.ClientConfig{
+			ClientID: cfg.ClientID + "-purge",
+			Router: paho.NewSingleHandlerRouter(func(p *paho.Publish) {
+				mu.Lock()
+				defer mu.Unlock()
+				last = time.Now()
+				if !p.Retain || len(p.Payload) == 0 {
+					return
+				}
+				for _, name := range names {
+					if purgeMatch(cfg, name, p.Topic, p.Payload) {
+						matched[p.Topic] = true
+					}
+				}
+			}),
+		},
+	}
+	cmCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c, err := autopaho.NewConnection(cmCtx, cmCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", cfg.Broker, err)
+	}
+	if err := c.AwaitConnection(ctx); err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", cfg.Broker, err)
+	}
+	defer func() {
+		dctx, dcancel := context.WithTimeout(cmCtx, 5*time.Second)
+		defer dcancel()
+		_ = c.Disconnect(dctx)
+	}()
+
+	subs := map[string]paho.SubscribeOptions{
+		cfg.DiscoveryTopicPrefix + "/+/+/config": {QoS: 1},
+	}
+	for _, name := range names {
+		subs[cfg.TopicPrefix+"/"+name+"/#"] = paho.SubscribeOptions{QoS: 1}
+	}
+	if _, err := c.Subscribe(ctx, &paho.Subscribe{Subscriptions: subs}); err != nil {
+		return nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	mu.Lock()
+	last = time.Now()
+	mu.Unlock()
+
+	tick := quiet / 10
+	if tick < minPurgeTick {
+		tick = minPurgeTick
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		mu.Lock()
+		done := time.Since(last) >= quiet
+		mu.Unlock()
+		if done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	mu.Lock()
+	topics := make([]string, 0, len(matched))
+	for topic := range matched {
+		topics = append(topics, topic)
+	}
+	mu.Unlock()
+	sort.Strings(topics)
+	for _, topic := range topics {
+		if cfg.Debug {
+			logger.Printf("clearing %s\n", topic)
+		}
+		_, err := c.Publish(ctx, &paho.Publish{
+			QoS:    1,
+			Topic:  topic,
+			Retain: true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to clear %s: %w", topic, err)
+		}
+	}
+	return topics, nil
+}
+
+// purgeMatch returns true if the retained message was published for the
+// device with the given topic name.  Discovery config topics must also
+// identify the device in the payload so that devices whose names share
+// a prefix are not matched.
+func purgeMatch(cfg *Config, name, topic string, payload []byte) bool {
+	if strings.HasPrefix(topic, cfg.TopicPrefix+"/"+name+"/") {
+		return true
+	}
+	if !strings.HasPrefix(topic, cfg.DiscoveryTopicPrefix+"/") {
+		return false
+	}
+	parts := strings.Split(
+		strings.TrimPrefix(topic, cfg.DiscoveryTopicPrefix+"/"), "/")
+	if len(parts) != 3 || parts[2] != "config" ||
+		!strings.HasPrefix(parts[1], name+"_") {
+		return false
+	}
+	var disc struct {
+		Device struct {
+			Identifiers []string `json:"identifiers"`
+		} `json:"device"`
+	}
+	if err := json.Unmarshal(payload, &disc); err != nil {
+		return false
+	}
+	for _, id := range disc.Device.Identifiers {
+		if id == name {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeNames returns the topic names used for the devices given as
+// names or hosts.  The availability topic of a device is named after
+// its host while its discovery and state topics are named after the
+// name the printer reports, so hosts, whether configured or not, are
+// queried for their name.  Arguments that cannot be queried are
+// treated as topic names only.
+func purgeNames(ctx context.Context, cfg *Config, args []string, logger *log.Logger) []string {
+	seen := map[string]bool{}
+	names := []string{}
+	add := func(name string) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for _, arg := range args {
+		add(topicSafe(arg))
+		dev := &DeviceConfig{Host: arg}
+		for _, d := range cfg.Devices {
+			if d != nil && d.Host == arg {
+				dev = d
+			}
+		}
+		if dev.Topic != "" {
+			add(dev.Topic)
+			continue
+		}
+		rrf := netrrf.NewClient(arg, cfg.password(dev))
+		if t := cfg.timeout(dev); t > 0 {
+			rrf.WithTimeout(t)
+		}
+		s, err := rrf.Status(ctx, 2)
+		if err != nil {
+			if cfg.Debug {
+				logger.Printf("treating %s as a name: %s\n", arg, err)
+			}
+			continue
+		}
+		add(topicSafe(s.Name))
+	}
+	return names
+}
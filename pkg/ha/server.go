@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"reflect"
 	"strings"
 	"time"
 
@@ -14,19 +15,65 @@ import (
 	ha "github.com/beanz/homeassistant-go/pkg/types"
 )
 
-func Run(ctx context.Context, cfg *Config, logger *log.Logger, mqttc mqtt.PubSubServer, msgp, msgs chan *mqtt.Msg) error {
-	childCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// shutdownTimeout is the maximum time to wait for the devices to
+// publish that they are offline when shutting down and shutdownFlush
+// is the time allowed for the MQTT client to send the messages.
+var (
+	shutdownTimeout = 5 * time.Second
+	shutdownFlush   = 500 * time.Millisecond
+)
 
-	for i := range cfg.Devices {
-		go deviceLoop(childCtx, cfg.Devices[i], cfg, msgp, logger)
-	}
+// Run polls the devices and publishes the results until the context is
+// cancelled.  Configurations received on reload replace the current
+// configuration without restarting the devices that remain.
+//
+// The MQTT client publishes "online" to the bridge availability topic
+// when it connects and registers a last will of "offline" so that all
+// entities become unavailable if the bridge dies.  On a graceful
+// shutdown every device is also published as offline before the client
+// is stopped.
+func Run(ctx context.Context, cfg *Config, logger *log.Logger, mqttc mqtt.PubSubServer, msgp, msgs chan *mqtt.Msg, reload <-chan *Config) error {
+	// the client is stopped after the devices so it has its own context
+	mqttCtx, cancelMQTT := context.WithCancel(context.Background())
+	defer cancelMQTT()
+	deviceCtx, cancelDevices := context.WithCancel(ctx)
+	defer cancelDevices()
 
-	return mqttc.Run(childCtx, msgp, msgs)
+	devices := newDeviceSet(deviceCtx, msgp, logger)
+	devices.apply(cfg)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- mqttc.Run(mqttCtx, msgp, msgs)
+	}()
+	for {
+		select {
+		case err := <-errc:
+			return err
+		case newCfg := <-reload:
+			logger.Printf("reloading configuration\n")
+			devices.apply(newCfg)
+		case <-ctx.Done():
+			cancelDevices()
+			deadline := time.Now().Add(shutdownTimeout)
+			if !devices.wait(deadline) {
+				logger.Printf("timeout waiting for devices to stop\n")
+			}
+			for len(msgp) > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			time.Sleep(shutdownFlush)
+			cancelMQTT()
+			return <-errc
+		}
+	}
 }
 
 type PollResult struct {
 	Host              string
+	Device            *DeviceConfig
+	BoardType         string
+	MAC               string
 	TopicFriendlyName string
 	AvailabilityTopic string
 	StateTopic        string
@@ -34,21 +81,123 @@ type PollResult struct {
 	Status            *types.StatusResponse
 }
 
-func deviceLoop(ctx context.Context, host string, cfg *Config, msgc chan *mqtt.Msg, logger *log.Logger) {
-	ticker := time.NewTicker(cfg.Interval)
+// FriendlyName returns the configured name for the device or the name
+// reported by the device.
+func (res *PollResult) FriendlyName() string {
+	if res.Device != nil && res.Device.Name != "" {
+		return res.Device.Name
+	}
+	return res.Status.Name
+}
 
-	availabilityTopic := AvailabilityTopic(cfg, topicSafe(host))
+func deviceLoop(ctx context.Context, dev *DeviceConfig, cfg *Config, msgc chan *mqtt.Msg, logger *log.Logger, updc <-chan *deviceUpdate) {
+	interval := cfg.interval(dev)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
 
+	send := func(msg *mqtt.Msg) bool {
+		select {
+		case msgc <- msg:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// retained discovery topics that have been published so that they
+	// can be cleared when the entities, or the device, are removed
+	published := map[string]bool{}
 	var lastDiscovery *time.Time
 	lastAvailability := ""
+	// the last published values and time for change detection
+	var lastValues map[string]interface{}
+	var lastPublish time.Time
+	availabilityTopic := AvailabilityTopic(cfg, availabilityName(dev))
+	defer func() {
+		if ctx.Err() == nil || lastAvailability == "" {
+			return
+		}
+		// shutting down so send without waiting on the cancelled context
+		select {
+		case msgc <- &mqtt.Msg{Topic: availabilityTopic, Body: "offline", Retain: true}:
+		default:
+			logger.Printf("failed to publish %s offline\n", dev.Host)
+		}
+	}()
+	clear := func() bool {
+		for topic := range published {
+			if !send(&mqtt.Msg{Topic: topic, Body: "", Retain: true}) {
+				return false
+			}
+		}
+		published = map[string]bool{}
+		lastAvailability = ""
+		return send(&mqtt.Msg{Topic: availabilityTopic, Body: "", Retain: true})
+	}
+
+	// the camera loop is restarted if the camera settings change
+	var camera *cameraState
+	var stopCamera context.CancelFunc
+	startCamera := func() {
+		if stopCamera != nil {
+			stopCamera()
+			stopCamera, camera = nil, nil
+		}
+		if dev.Camera == nil {
+			return
+		}
+		timeout := cfg.timeout(dev)
+		if timeout <= 0 {
+			timeout = 30 * time.Second
+		}
+		var cameraCtx context.Context
+		cameraCtx, stopCamera = context.WithCancel(ctx)
+		camera = &cameraState{}
+		go cameraLoop(cameraCtx, dev.Camera, cfg, timeout, camera, msgc,
+			logger)
+	}
+	startCamera()
+	defer func() {
+		if stopCamera != nil {
+			stopCamera()
+		}
+	}()
+
 	for {
+		host := dev.Host
 		newAvailability := "offline"
 		if cfg.Debug {
 			logger.Printf("%s tick\n", host)
 		}
 		now := time.Now()
 		needsDiscovery := lastDiscovery == nil || (*lastDiscovery).Add(cfg.DiscoveryInterval).Before(now)
-		r, err := pollDevice(ctx, host, cfg, needsDiscovery)
+		r, err := pollDevice(ctx, dev, cfg, needsDiscovery)
+		if ctx.Err() != nil {
+			return
+		}
+		var status *types.StatusResponse
+		if r != nil {
+			status = r.Status
+			failures = 0
+		} else {
+			failures++
+			lastValues = nil
+		}
+		if camera != nil {
+			if r != nil {
+				camera.set(r.TopicFriendlyName, isActive(r.Status))
+			} else {
+				camera.set("", false)
+			}
+		}
+		if next := cfg.pollInterval(dev, status, failures); next != interval {
+			if cfg.Debug {
+				logger.Printf("%s polling every %s\n", host, next)
+			}
+			interval = next
+			ticker.Reset(interval)
+		}
 		if r != nil {
 			newAvailability = "online"
 		}
@@ -57,7 +206,9 @@ func deviceLoop(ctx context.Context, host string, cfg *Config, msgc chan *mqtt.M
 				logger.Printf("poll error: %s\n", err)
 			}
 			lastAvailability = newAvailability
-			msgc <- &mqtt.Msg{Topic: availabilityTopic, Body: newAvailability, Retain: true}
+			if !send(&mqtt.Msg{Topic: availabilityTopic, Body: newAvailability, Retain: true}) {
+				return
+			}
 		}
 		if r != nil {
 			r.AvailabilityTopic = availabilityTopic
@@ -71,35 +222,118 @@ func deviceLoop(ctx context.Context, host string, cfg *Config, msgc chan *mqtt.M
 			variables := variablesFromResults(r)
 			if r.Config != nil {
 				msgs := discoveryMessages(cfg, r, variables)
+				current := map[string]bool{}
 				for _, msg := range msgs {
-					msgc <- msg
+					current[msg.Topic] = true
+					if !send(msg) {
+						return
+					}
 				}
+				// clear the topics of entities that no longer exist
+				for topic := range published {
+					if current[topic] {
+						continue
+					}
+					if cfg.Debug {
+						logger.Printf("clearing %s\n", topic)
+					}
+					if !send(&mqtt.Msg{Topic: topic, Body: "", Retain: true}) {
+						return
+					}
+				}
+				published = current
+				lastValues = nil
+			}
+			if cfg.shouldPublish(lastValues, variables,
+				now.Sub(lastPublish)) {
+				msgs := []*mqtt.Msg{}
+				if cfg.jsonState() {
+					msgs = append(msgs, resultMessage(r, now, variables))
+				}
+				if cfg.variableState() {
+					msgs = append(msgs,
+						variableMessages(cfg, r, variables)...)
+				}
+				for _, msg := range msgs {
+					if !send(msg) {
+						return
+					}
+				}
+				lastValues = values(variables)
+				lastPublish = now
+			} else if cfg.Debug {
+				logger.Printf("%s unchanged\n", host)
 			}
-			msg := resultMessage(r, now, variables)
-			msgc <- msg
 		}
 
-		<-ticker.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case u := <-updc:
+			if u.dev == nil {
+				logger.Printf("removing device %s\n", host)
+				clear()
+				return
+			}
+			if availabilityName(u.dev) != availabilityName(dev) {
+				if !clear() {
+					return
+				}
+				availabilityTopic = AvailabilityTopic(u.cfg, availabilityName(u.dev))
+			}
+			cameraChanged := !reflect.DeepEqual(dev.Camera, u.dev.Camera)
+			dev, cfg = u.dev, u.cfg
+			if cameraChanged {
+				startCamera()
+			}
+			// names or sensors may have changed so publish discovery
+			// messages on the next poll
+			lastDiscovery = nil
+		}
+	}
+}
+
+// availabilityName returns the name used in the availability topic for
+// the device.
+func availabilityName(dev *DeviceConfig) string {
+	if dev.Topic != "" {
+		return dev.Topic
 	}
+	return topicSafe(dev.Host)
 }
 
-func pollDevice(ctx context.Context, host string, cfg *Config, needsDiscovery bool) (*PollResult, error) {
-	rrf := netrrf.NewClient(host, cfg.Password)
+func pollDevice(ctx context.Context, dev *DeviceConfig, cfg *Config, needsDiscovery bool) (*PollResult, error) {
+	host := dev.Host
+	rrf := netrrf.NewClient(host, cfg.password(dev))
+	if t := cfg.timeout(dev); t > 0 {
+		rrf.WithTimeout(t)
+	}
 	var cr *types.ConfigResponse
 	var err error
+	mac := dev.MAC
 	if needsDiscovery {
 		cr, err = rrf.Config(ctx)
 		if err != nil {
 			return nil, fmt.Errorf("poll of config from %s failed: %v", host, err)
 		}
+		if mac == "" {
+			mac = macAddress(ctx, rrf)
+		}
 	}
 	s, err := rrf.FullStatus(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("poll of status of %s failed: %v", host, err)
 	}
-	name := topicSafe(s.Name)
+	name := dev.Topic
+	if name == "" {
+		name = topicSafe(s.Name)
+	}
 	return &PollResult{
 		Host:              host,
+		Device:            dev,
+		BoardType:         rrf.BoardType(),
+		MAC:               mac,
 		TopicFriendlyName: name,
 		StateTopic:        StateTopic(cfg, name),
 		Config:            cr,
@@ -107,6 +341,24 @@ func pollDevice(ctx context.Context, host string, cfg *Config, needsDiscovery bo
 	}, nil
 }
 
+// macAddress returns the MAC address of the first network interface
+// from the object model or an empty string if it is not available, as
+// is the case before RepRapFirmware 3.
+func macAddress(ctx context.Context, rrf *netrrf.Client) string {
+	var ifaces []struct {
+		MAC string `json:"mac"`
+	}
+	if err := rrf.Model(ctx, "network.interfaces", "", &ifaces); err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		if iface.MAC != "" {
+			return iface.MAC
+		}
+	}
+	return ""
+}
+
 func topicSafe(s string) string {
 	r := strings.ReplaceAll(s, "/", "_slash_")
 	r = strings.ReplaceAll(r, "#", "_hash_")
@@ -127,16 +379,47 @@ func StateTopic(cfg *Config, name string) string {
 	return fmt.Sprintf("%s/%s/state", cfg.TopicPrefix, name)
 }
 
+// reservedTopicLeaves maps variable fields that would clash with the
+// other topics for a device to the topic leaf used instead.
+var reservedTopicLeaves = map[string]string{
+	"state":        "status",
+	"availability": "availability_value",
+	"camera":       "camera_value",
+}
+
+// VariableTopic returns the topic for the value of a single variable.
+// Fields that clash with the state, availability or camera topics are
+// published to a different leaf, so the state variable is published
+// to <prefix>/<name>/status.
+func VariableTopic(cfg *Config, name, field string) string {
+	if leaf, ok := reservedTopicLeaves[field]; ok {
+		field = leaf
+	}
+	return fmt.Sprintf("%s/%s/%s", cfg.TopicPrefix, name, field)
+}
+
 func AvailabilityTopic(cfg *Config, name string) string {
 	return fmt.Sprintf("%s/%s/availability", cfg.TopicPrefix, name)
 }
 
+// State classes for sensors.
+const (
+	StateClassMeasurement     = "measurement"
+	StateClassTotalIncreasing = "total_increasing"
+)
+
 type Variable struct {
-	field       string
-	icon        string
-	units       string
-	deviceClass *ha.DeviceClass
-	value       interface{}
+	field          string
+	group          string
+	icon           string
+	units          string
+	deviceClass    *ha.DeviceClass
+	stateClass     string
+	entityCategory ha.EntityCategory
+	// disabledByDefault entities must be enabled in Home Assistant
+	// before they are updated
+	disabledByDefault bool
+	value             interface{}
 }
 
 func variablesFromResults(res *PollResult) []*Variable {
@@ -158,96 +441,143 @@ func variablesFromResults(res *PollResult) []*Variable {
 		types.ToolChanging: 3,
 	}
 
-	variables := []*Variable{
-		{
+	variables := []*Variable{}
+	add := func(group string, vs ...*Variable) {
+		if !res.Device.sensorsEnabled(group) {
+			return
+		}
+		for _, v := range vs {
+			v.group = group
+		}
+		variables = append(variables, vs...)
+	}
+	add(SensorsState,
+		&Variable{
 			field: "state",
 			value: res.Status.Status.String(),
 		},
-		{
-			field: "state_code",
-			value: stateCode[res.Status.Status],
-		},
-		{
-			field: "file_time_remaining",
-			value: res.Status.TimesLeft.File,
-		},
-		{
-			field: "filament_time_remaining",
-			value: res.Status.TimesLeft.Filament,
-		},
-		{
-			field: "layer_time_remaining",
-			value: res.Status.TimesLeft.Layer,
-		},
-		{
-			field:       "mcu_temp_min",
-			units:       "°C",
-			deviceClass: &dcTemp,
-			value:       res.Status.MCUTemp.Min,
-		},
-		{
-			field:       "mcu_temp_cur",
-			units:       "°C",
-			deviceClass: &dcTemp,
-			value:       res.Status.MCUTemp.Cur,
-		},
-		{
-			field:       "mcu_temp_max",
-			units:       "°C",
-			deviceClass: &dcTemp,
-			value:       res.Status.MCUTemp.Max,
-		},
-		{
-			field:       "vin_min",
-			units:       "V",
-			deviceClass: &dcVolt,
-			value:       res.Status.VIN.Min,
-		},
-		{
-			field:       "vin_cur",
-			units:       "V",
-			deviceClass: &dcVolt,
-			value:       res.Status.VIN.Cur,
-		},
-		{
-			field:       "vin_max",
-			units:       "V",
-			deviceClass: &dcVolt,
-			value:       res.Status.VIN.Max,
-		},
-		{
-			field: "geometry",
-			value: res.Status.Geometry,
-		},
-		{
-			field: "layer",
-			value: res.Status.CurrentLayer,
-		},
-		{
-			field: "speed_requested",
-			value: res.Status.Speeds.Requested,
-			units: "mm/s",
+		&Variable{
+			field:      "state_code",
+			stateClass: StateClassMeasurement,
+			value:      stateCode[res.Status.Status],
+		})
+	add(SensorsTimes,
+		&Variable{
+			field:      "file_time_remaining",
+			stateClass: StateClassMeasurement,
+			value:      res.Status.TimesLeft.File,
 		},
-		{
-			field: "speed_top",
-			value: res.Status.Speeds.Top,
-			units: "mm/s",
+		&Variable{
+			field:      "filament_time_remaining",
+			stateClass: StateClassMeasurement,
+			value:      res.Status.TimesLeft.Filament,
 		},
+		&Variable{
+			field:      "layer_time_remaining",
+			stateClass: StateClassMeasurement,
+			value:      res.Status.TimesLeft.Layer,
+		})
+	if res.Status.MCUTemp != nil {
+		add(SensorsMCU,
+			&Variable{
+				field:             "mcu_temp_min",
+				stateClass:        StateClassMeasurement,
+				entityCategory:    ha.DiagnosticEntity,
+				disabledByDefault: true,
+				units:             "°C",
+				deviceClass:       &dcTemp,
+				value:             res.Status.MCUTemp.Min,
+			},
+			&Variable{
+				field:          "mcu_temp_cur",
+				stateClass:     StateClassMeasurement,
+				entityCategory: ha.DiagnosticEntity,
+				units:          "°C",
+				deviceClass:    &dcTemp,
+				value:          res.Status.MCUTemp.Cur,
+			},
+			&Variable{
+				field:             "mcu_temp_max",
+				stateClass:        StateClassMeasurement,
+				entityCategory:    ha.DiagnosticEntity,
+				disabledByDefault: true,
+				units:             "°C",
+				deviceClass:       &dcTemp,
+				value:             res.Status.MCUTemp.Max,
+			})
 	}
+	if res.Status.VIN != nil {
+		add(SensorsVIN,
+			&Variable{
+				field:             "vin_min",
+				stateClass:        StateClassMeasurement,
+				entityCategory:    ha.DiagnosticEntity,
+				disabledByDefault: true,
+				units:             "V",
+				deviceClass:       &dcVolt,
+				value:             res.Status.VIN.Min,
+			},
+			&Variable{
+				field:          "vin_cur",
+				stateClass:     StateClassMeasurement,
+				entityCategory: ha.DiagnosticEntity,
+				units:          "V",
+				deviceClass:    &dcVolt,
+				value:          res.Status.VIN.Cur,
+			},
+			&Variable{
+				field:             "vin_max",
+				stateClass:        StateClassMeasurement,
+				entityCategory:    ha.DiagnosticEntity,
+				disabledByDefault: true,
+				units:             "V",
+				deviceClass:       &dcVolt,
+				value:             res.Status.VIN.Max,
+			})
+	}
+	add(SensorsGeometry,
+		&Variable{
+			field:          "geometry",
+			entityCategory: ha.DiagnosticEntity,
+			value:          res.Status.Geometry,
+		})
+	add(SensorsLayer,
+		&Variable{
+			field:      "layer",
+			stateClass: StateClassMeasurement,
+			value:      res.Status.CurrentLayer,
+		})
+	add(SensorsSpeed,
+		&Variable{
+			field:      "speed_requested",
+			stateClass: StateClassMeasurement,
+			value:      res.Status.Speeds.Requested,
+			units:      "mm/s",
+		},
+		&Variable{
+			field:      "speed_top",
+			stateClass: StateClassMeasurement,
+			value:      res.Status.Speeds.Top,
+			units:      "mm/s",
+		})
 	if len(res.Status.Coordinates.XYZ) == 3 {
 		for i, v := range []string{"x", "y", "z"} {
-			variables = append(variables, &Variable{
-				field: v,
-				icon:  "mdi:axis-" + v + "-arrow",
-				value: res.Status.Coordinates.XYZ[i],
+			add(SensorsPosition, &Variable{
+				field:      v,
+				icon:       "mdi:axis-" + v + "-arrow",
+				stateClass: StateClassMeasurement,
+				value:      res.Status.Coordinates.XYZ[i],
 			})
 		}
 	}
 	for i := range res.Status.Coordinates.Extruder {
-		variables = append(variables, &Variable{
+		add(SensorsExtruders, &Variable{
 			field: fmt.Sprintf("e%d", i),
 			icon:  "mdi:mdi-printer-3d-nozzle",
-			value: res.Status.Coordinates.Extruder[i],
+			// extruder positions accumulate until reset by G92 or
+			// a reboot
+			stateClass: StateClassTotalIncreasing,
+			value:      res.Status.Coordinates.Extruder[i],
 		})
 	}
 	for i := range res.Status.Temps.Current {
@@ -261,9 +591,10 @@ func variablesFromResults(res *PollResult) []*Variable {
 				temp = "temp_" + temp
 			}
 		}
-		variables = append(variables, &Variable{
+		add(SensorsTemperatures, &Variable{
 			field:       temp,
 			units:       "°C",
+			stateClass:  StateClassMeasurement,
 			deviceClass: &dcTemp,
 			value:       res.Status.Temps.Current[i],
 		})
@@ -276,28 +607,27 @@ func discoveryMessages(cfg *Config, res *PollResult, variables []*Variable) []*m
 		{Topic: AvailabilityTopic(cfg, "bridge")},
 		{Topic: res.AvailabilityTopic},
 	}
-	realName := res.Status.Name
+	realName := res.FriendlyName()
+	dev := device(res)
 
 	msgs := []*mqtt.Msg{}
 	for _, v := range variables {
-		sensor := ha.Sensor{
-			Availability:     availability,
-			AvailabilityMode: "all",
-			Name:             realName + " " + v.field,
-			Icon:             "mdi:printer-3d",
-			UniqueID:         res.TopicFriendlyName + "_" + v.field,
-			Device: ha.Device{
-				Identifiers: []string{
-					res.TopicFriendlyName,
-					res.TopicFriendlyName + "_" + v.field,
-				},
-				ConfigurationURL: "http://" + res.Host,
-				Name:             realName,
-				SwVersion:        res.Config.FirmwareName + " v" + res.Config.FirmwareVersion + " (" + string(res.Config.FirmwareDate) + ")",
-				Model:            res.Config.FirmwareElectronics,
+		sensor := Sensor{
+			Sensor: ha.Sensor{
+				Availability:     availability,
+				AvailabilityMode: "all",
+				Name:             realName + " " + v.field,
+				Icon:             "mdi:printer-3d",
+				UniqueID:         res.TopicFriendlyName + "_" + v.field,
+				StateTopic:       res.StateTopic,
+				ValueTemplate:    "{{ value_json." + v.field + "}}",
 			},
-			StateTopic:    res.StateTopic,
-			ValueTemplate: "{{ value_json." + v.field + "}}",
+			Device: dev,
+		}
+		if !cfg.jsonState() {
+			sensor.StateTopic = VariableTopic(cfg, res.TopicFriendlyName,
+				v.field)
+			sensor.ValueTemplate = ""
 		}
 		if v.units != "" {
 			sensor.UnitOfMeasurement = v.units
@@ -308,12 +638,21 @@ func discoveryMessages(cfg *Config, res *PollResult, variables []*Variable) []*m
 		if v.icon != "" {
 			sensor.Icon = v.icon
 		}
+		sensor.StateClass = v.stateClass
+		sensor.EntityCategory = v.entityCategory
+		if v.disabledByDefault {
+			disabled := false
+			sensor.EnabledByDefault = &disabled
+		}
 		msgs = append(msgs, &mqtt.Msg{
 			Topic:  ConfigTopic(cfg, res.TopicFriendlyName, v.field),
 			Body:   sensor,
 			Retain: true,
 		})
 	}
+	if res.Device != nil && res.Device.Camera != nil {
+		msgs = append(msgs, cameraDiscoveryMessage(cfg, res, availability))
+	}
 	return msgs
 }
 
@@ -327,3 +666,14 @@ func resultMessage(res *PollResult, t time.Time, variables []*Variable) *mqtt.Ms
 	}
 	return &mqtt.Msg{Topic: res.StateTopic, Body: msg, Retain: false}
 }
+
+func variableMessages(cfg *Config, res *PollResult, variables []*Variable) []*mqtt.Msg {
+	msgs := make([]*mqtt.Msg, 0, len(variables))
+	for _, v := range variables {
+		msgs = append(msgs, &mqtt.Msg{
+			Topic: VariableTopic(cfg, res.TopicFriendlyName, v.field),
+			Body:  v.value,
+		})
+	}
+	return msgs
+}
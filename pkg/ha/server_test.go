@@ -3,10 +3,12 @@ package ha
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"time"
 
 	"testing"
@@ -22,14 +24,18 @@ import (
 
 func Test_PollDevice(t *testing.T) {
 	var buf bytes.Buffer
-	m := mock.NewMockRRF(log.New(&buf, "", 0))
+	// a fixed clock so the simulated printer does not change
+	now := time.Now()
+	m := mock.NewMockRRF(log.New(&buf, "", 0)).WithClock(
+		func() time.Time { return now })
 	ts := httptest.NewServer(m.Router())
 	defer ts.Close()
 
 	host := strings.Split(ts.URL, "://")[1]
 	ctx, cancel := context.WithCancel(context.Background())
+	dev := &DeviceConfig{Host: host}
 	r, err := pollDevice(ctx,
-		host, &Config{
+		dev, &Config{
 			Password:             "passw0rd",
 			Interval:             60,
 			TopicPrefix:          "rrfdata",
@@ -40,15 +46,19 @@ func Test_PollDevice(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, &PollResult{
 		Host:              host,
+		Device:            dev,
+		BoardType:         "mockrrf",
 		TopicFriendlyName: "mockrrf",
 		StateTopic:        "rrfdata/mockrrf/state",
 		Config:            mock.ConfigResponse(),
-		Status:            mock.FullStatusResponse(0),
+		Status:            m.Printer().FullStatus(),
 	}, r)
 }
 
 func Test_PollDeviceErrorCases(t *testing.T) {
-	for _, call := range []int{0, 1, 2, 3} {
+	// call 2 is the object model request for the MAC address which is
+	// allowed to fail
+	for _, call := range []int{0, 1, 3, 4} {
 		t.Run(fmt.Sprintf("fail on call #%d", call), func(t *testing.T) {
 
 			var buf bytes.Buffer
@@ -62,7 +72,7 @@ func Test_PollDeviceErrorCases(t *testing.T) {
 			host := strings.Split(ts.URL, "://")[1]
 			ctx, cancel := context.WithCancel(context.Background())
 			_, err := pollDevice(ctx,
-				host, &Config{
+				&DeviceConfig{Host: host}, &Config{
 					Password:             "passw0rd",
 					Interval:             60,
 					TopicPrefix:          "rrfdata",
@@ -75,6 +85,51 @@ func Test_PollDeviceErrorCases(t *testing.T) {
 	}
 }
 
+func Test_PollDeviceFirmwares(t *testing.T) {
+	tests := []struct {
+		firmware  *mock.Firmware
+		boardType string
+		mac       string
+		err       string
+	}{
+		{firmware: mock.FirmwareLegacy, err: "poll of config from"},
+		{firmware: mock.Firmware2, boardType: "mockrrf"},
+		{firmware: mock.Firmware3, boardType: "duet3mini5plus"},
+		{firmware: mock.Firmware3Model, boardType: "duet3mb6hc",
+			mac: "be:ef:de:ad:fe:ed"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.firmware.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := mock.NewMockRRF(log.New(&buf, "", 0)).
+				WithFirmware(tc.firmware)
+			ts := httptest.NewServer(m.Router())
+			defer ts.Close()
+			host := strings.Split(ts.URL, "://")[1]
+
+			r, err := pollDevice(context.Background(),
+				&DeviceConfig{Host: host}, &Config{
+					Password:             "passw0rd",
+					Interval:             60,
+					TopicPrefix:          "rrfdata",
+					DiscoveryTopicPrefix: "rrfdisc",
+				}, true)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.boardType, r.BoardType)
+			assert.Equal(t, tc.mac, r.MAC)
+			assert.Equal(t, tc.firmware.FirmwareVersion,
+				r.Config.FirmwareVersion)
+			assert.Equal(t, types.Idle, r.Status.Status)
+			assert.NotEmpty(t, variablesFromResults(r))
+		})
+	}
+}
+
 func Test_VariablesFromResults(t *testing.T) {
 	v := variablesFromResults(&PollResult{
 		Host:              "foo",
@@ -89,106 +144,157 @@ func Test_VariablesFromResults(t *testing.T) {
 	assert.Equal(t, []*Variable{
 		{
 			field: "state",
+			group: SensorsState,
 			value: "printing",
 		},
 		{
-			field: "state_code",
-			value: 3,
+			field:      "state_code",
+			stateClass: StateClassMeasurement,
+			group:      SensorsState,
+			value:      3,
 		},
 		{
-			field: "file_time_remaining",
-			value: types.Time(1980),
+			field:      "file_time_remaining",
+			stateClass: StateClassMeasurement,
+			group:      SensorsTimes,
+			value:      types.Time(1980),
 		},
 		{
-			field: "filament_time_remaining",
-			value: types.Time(1980),
+			field:      "filament_time_remaining",
+			stateClass: StateClassMeasurement,
+			group:      SensorsTimes,
+			value:      types.Time(1980),
 		},
 		{
-			field: "layer_time_remaining",
-			value: types.Time(1980),
+			field:      "layer_time_remaining",
+			stateClass: StateClassMeasurement,
+			group:      SensorsTimes,
+			value:      types.Time(1980),
 		},
 		{
-			field:       "mcu_temp_min",
-			units:       "°C",
-			deviceClass: &dcTemp,
-			value:       31.0,
+			field:             "mcu_temp_min",
+			stateClass:        StateClassMeasurement,
+			entityCategory:    ha.DiagnosticEntity,
+			disabledByDefault: true,
+			group:             SensorsMCU,
+			units:             "°C",
+			deviceClass:       &dcTemp,
+			value:             31.0,
 		},
 		{
-			field:       "mcu_temp_cur",
-			units:       "°C",
-			deviceClass: &dcTemp,
-			value:       38.4,
+			field:          "mcu_temp_cur",
+			stateClass:     StateClassMeasurement,
+			entityCategory: ha.DiagnosticEntity,
+			group:          SensorsMCU,
+			units:          "°C",
+			deviceClass:    &dcTemp,
+			value:          38.4,
 		},
 		{
-			field:       "mcu_temp_max",
-			units:       "°C",
-			deviceClass: &dcTemp,
-			value:       38.6,
+			field:             "mcu_temp_max",
+			stateClass:        StateClassMeasurement,
+			entityCategory:    ha.DiagnosticEntity,
+			disabledByDefault: true,
+			group:             SensorsMCU,
+			units:             "°C",
+			deviceClass:       &dcTemp,
+			value:             38.6,
 		},
 		{
-			field:       "vin_min",
-			units:       "V",
-			deviceClass: &dcVolt,
-			value:       11.9,
+			field:             "vin_min",
+			stateClass:        StateClassMeasurement,
+			entityCategory:    ha.DiagnosticEntity,
+			disabledByDefault: true,
+			group:             SensorsVIN,
+			units:             "V",
+			deviceClass:       &dcVolt,
+			value:             11.9,
 		},
 		{
-			field:       "vin_cur",
-			units:       "V",
-			deviceClass: &dcVolt,
-			value:       12.1,
+			field:          "vin_cur",
+			stateClass:     StateClassMeasurement,
+			entityCategory: ha.DiagnosticEntity,
+			group:          SensorsVIN,
+			units:          "V",
+			deviceClass:    &dcVolt,
+			value:          12.1,
 		},
 		{
-			field:       "vin_max",
-			units:       "V",
-			deviceClass: &dcVolt,
-			value:       12.2,
+			field:             "vin_max",
+			stateClass:        StateClassMeasurement,
+			entityCategory:    ha.DiagnosticEntity,
+			disabledByDefault: true,
+			group:             SensorsVIN,
+			units:             "V",
+			deviceClass:       &dcVolt,
+			value:             12.2,
 		},
 		{
-			field: "geometry",
-			value: "delta",
+			field:          "geometry",
+			entityCategory: ha.DiagnosticEntity,
+			group:          SensorsGeometry,
+			value:          "delta",
 		},
 		{
-			field: "layer",
-			value: 1,
+			field:      "layer",
+			stateClass: StateClassMeasurement,
+			group:      SensorsLayer,
+			value:      1,
 		},
 		{
-			field: "speed_requested",
-			value: 20.0,
-			units: "mm/s",
+			field:      "speed_requested",
+			stateClass: StateClassMeasurement,
+			group:      SensorsSpeed,
+			value:      20.0,
+			units:      "mm/s",
 		},
 		{
-			field: "speed_top",
-			value: 30.0,
-			units: "mm/s",
+			field:      "speed_top",
+			stateClass: StateClassMeasurement,
+			group:      SensorsSpeed,
+			value:      30.0,
+			units:      "mm/s",
 		},
 		{
-			field: "x",
-			icon:  "mdi:axis-x-arrow",
-			value: 100.0,
+			field:      "x",
+			stateClass: StateClassMeasurement,
+			group:      SensorsPosition,
+			icon:       "mdi:axis-x-arrow",
+			value:      100.0,
 		},
 		{
-			field: "y",
-			icon:  "mdi:axis-y-arrow",
-			value: 0.0,
+			field:      "y",
+			stateClass: StateClassMeasurement,
+			group:      SensorsPosition,
+			icon:       "mdi:axis-y-arrow",
+			value:      0.0,
 		},
 		{
-			field: "z",
-			icon:  "mdi:axis-z-arrow",
-			value: 100.0,
+			field:      "z",
+			stateClass: StateClassMeasurement,
+			group:      SensorsPosition,
+			icon:       "mdi:axis-z-arrow",
+			value:      100.0,
 		},
 		{
-			field: "e0",
-			icon:  "mdi:mdi-printer-3d-nozzle",
-			value: 0.0,
+			field:      "e0",
+			stateClass: StateClassTotalIncreasing,
+			group:      SensorsExtruders,
+			icon:       "mdi:mdi-printer-3d-nozzle",
+			value:      0.0,
 		},
 		{
 			field:       "temp_bed",
+			stateClass:  StateClassMeasurement,
+			group:       SensorsTemperatures,
 			units:       "°C",
 			deviceClass: &dcTemp,
 			value:       80.0,
 		},
 		{
 			field:       "temp1",
+			stateClass:  StateClassMeasurement,
+			group:       SensorsTemperatures,
 			units:       "°C",
 			deviceClass: &dcTemp,
 			value:       205.0,
@@ -198,6 +304,15 @@ func Test_VariablesFromResults(t *testing.T) {
 
 func Test_DiscoveryMessages(t *testing.T) {
 	dcTemp := ha.DeviceClassTemperature
+	mockDevice := Device{
+		ConfigurationURL: "http://foo",
+		Identifiers:      []string{"mockrrf"},
+		Manufacturer:     "Duet3D",
+		Model:            "Duet WiFi 1.0 or 1.01",
+		HwVersion:        "mockrrf",
+		Name:             "MockRRF",
+		SwVersion:        "RepRapFirmware for Duet 2 WiFi/Ethernet v2.05.1 (2020-02-09b1)",
+	}
 	tests := []struct {
 		name     string
 		variable *Variable
@@ -208,28 +323,24 @@ func Test_DiscoveryMessages(t *testing.T) {
 			variable: &Variable{field: "state", value: "printing"},
 			want: &mqtt.Msg{
 				Topic: "rrfdisc/sensor/mockrrf_state/config",
-				Body: ha.Sensor{
-					Availability: []ha.Availability{
-						{
-							Topic: "rrfdata/bridge/availability",
-						},
-						{
-							Topic: "rrfdata/mockrrf/availability",
+				Body: Sensor{
+					Sensor: ha.Sensor{
+						Availability: []ha.Availability{
+							{
+								Topic: "rrfdata/bridge/availability",
+							},
+							{
+								Topic: "rrfdata/mockrrf/availability",
+							},
 						},
+						AvailabilityMode: "all",
+						Icon:             "mdi:printer-3d",
+						Name:             "MockRRF state",
+						StateTopic:       "rrfdata/mockrrf/state",
+						UniqueID:         "mockrrf_state",
+						ValueTemplate:    "{{ value_json.state}}",
 					},
-					AvailabilityMode: "all",
-					Device: ha.Device{
-						ConfigurationURL: "http://foo",
-						Identifiers:      []string{"mockrrf", "mockrrf_state"},
-						Model:            "Duet WiFi 1.0 or 1.01",
-						Name:             "MockRRF",
-						SwVersion:        "RepRapFirmware for Duet 2 WiFi/Ethernet v2.05.1 (2020-02-09b1)",
-					},
-					Icon:          "mdi:printer-3d",
-					Name:          "MockRRF state",
-					StateTopic:    "rrfdata/mockrrf/state",
-					UniqueID:      "mockrrf_state",
-					ValueTemplate: "{{ value_json.state}}",
+					Device: mockDevice,
 				},
 				Retain: true,
 			},
@@ -245,31 +356,26 @@ func Test_DiscoveryMessages(t *testing.T) {
 			},
 			want: &mqtt.Msg{
 				Topic: "rrfdisc/sensor/mockrrf_hotend_temp/config",
-				Body: ha.Sensor{
-					Availability: []ha.Availability{
-						{
-							Topic: "rrfdata/bridge/availability",
-						},
-						{
-							Topic: "rrfdata/mockrrf/availability",
+				Body: Sensor{
+					Sensor: ha.Sensor{
+						Availability: []ha.Availability{
+							{
+								Topic: "rrfdata/bridge/availability",
+							},
+							{
+								Topic: "rrfdata/mockrrf/availability",
+							},
 						},
+						AvailabilityMode:  "all",
+						DeviceClass:       "temperature",
+						UnitOfMeasurement: "°C",
+						Icon:              "mdi:mdi-printer-3d-nozzle",
+						Name:              "MockRRF hotend_temp",
+						StateTopic:        "rrfdata/mockrrf/state",
+						UniqueID:          "mockrrf_hotend_temp",
+						ValueTemplate:     "{{ value_json.hotend_temp}}",
 					},
-					AvailabilityMode: "all",
-					Device: ha.Device{
-						ConfigurationURL: "http://foo",
-						Identifiers: []string{"mockrrf",
-							"mockrrf_hotend_temp"},
-						Model:     "Duet WiFi 1.0 or 1.01",
-						Name:      "MockRRF",
-						SwVersion: "RepRapFirmware for Duet 2 WiFi/Ethernet v2.05.1 (2020-02-09b1)",
-					},
-					DeviceClass:       "temperature",
-					UnitOfMeasurement: "°C",
-					Icon:              "mdi:mdi-printer-3d-nozzle",
-					Name:              "MockRRF hotend_temp",
-					StateTopic:        "rrfdata/mockrrf/state",
-					UniqueID:          "mockrrf_hotend_temp",
-					ValueTemplate:     "{{ value_json.hotend_temp}}",
+					Device: mockDevice,
 				},
 				Retain: true,
 			},
@@ -277,6 +383,7 @@ func Test_DiscoveryMessages(t *testing.T) {
 	}
 	res := &PollResult{
 		Host:              "foo",
+		BoardType:         "mockrrf",
 		TopicFriendlyName: "mockrrf",
 		AvailabilityTopic: "rrfdata/mockrrf/availability",
 		StateTopic:        "rrfdata/mockrrf/state",
@@ -292,6 +399,44 @@ func Test_DiscoveryMessages(t *testing.T) {
 			assert.Equal(t, tc.want, msgs[0])
 		})
 	}
+
+	disabled := false
+	msgs := discoveryMessages(&Config{
+		DiscoveryTopicPrefix: "rrfdisc",
+		TopicPrefix:          "rrfdata",
+	}, res, []*Variable{{
+		field:             "vin_min",
+		stateClass:        StateClassMeasurement,
+		entityCategory:    ha.DiagnosticEntity,
+		disabledByDefault: true,
+		value:             11.9,
+	}})
+	sensor := msgs[0].Body.(Sensor)
+	assert.Equal(t, StateClassMeasurement, sensor.StateClass)
+	assert.Equal(t, ha.DiagnosticEntity, sensor.EntityCategory)
+	assert.Equal(t, &disabled, sensor.EnabledByDefault)
+
+	msgs = discoveryMessages(&Config{
+		DiscoveryTopicPrefix: "rrfdisc",
+		TopicPrefix:          "rrfdata",
+		StateTopics:          StateTopicsVariables,
+	}, res, []*Variable{tests[0].variable})
+	sensor = msgs[0].Body.(Sensor)
+	assert.Equal(t, "rrfdata/mockrrf/status", sensor.StateTopic)
+	assert.Equal(t, "", sensor.ValueTemplate)
+
+	// extruder positions accumulate so they are totals
+	res.Device = &DeviceConfig{Sensors: []string{SensorsExtruders}}
+	extruders := variablesFromResults(res)
+	require.NotEmpty(t, extruders)
+	msgs = discoveryMessages(&Config{
+		DiscoveryTopicPrefix: "rrfdisc",
+		TopicPrefix:          "rrfdata",
+	}, res, extruders)
+	assert.Equal(t, "rrfdisc/sensor/mockrrf_e0/config", msgs[0].Topic)
+	b, err := json.Marshal(msgs[0].Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"state_class":"total_increasing"`)
 }
 
 func Test_ResultMessages(t *testing.T) {
@@ -311,6 +456,21 @@ func Test_ResultMessages(t *testing.T) {
 	}, msg)
 }
 
+func Test_VariableMessages(t *testing.T) {
+	msgs := variableMessages(
+		&Config{TopicPrefix: "rrfdata"},
+		&PollResult{TopicFriendlyName: "mockrrf"},
+		[]*Variable{
+			{field: "state", value: "printing"},
+			{field: "temp_bed", value: 60.5},
+		},
+	)
+	assert.Equal(t, []*mqtt.Msg{
+		{Topic: "rrfdata/mockrrf/status", Body: "printing"},
+		{Topic: "rrfdata/mockrrf/temp_bed", Body: 60.5},
+	}, msgs)
+}
+
 func Test_DeviceLoop(t *testing.T) {
 	var buf bytes.Buffer
 	mock := mock.NewMockRRF(log.New(&buf, "", 0))
@@ -326,12 +486,12 @@ func Test_DeviceLoop(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		deviceLoop(ctx,
-			host, &Config{
+			&DeviceConfig{Host: host}, &Config{
 				Password:             "passw0rd",
 				Interval:             time.Second * 60,
 				TopicPrefix:          "rrfdata",
 				DiscoveryTopicPrefix: "rrfdisc",
-			}, msgc, polllog)
+			}, msgc, polllog, nil)
 	}()
 	defer cancel()
 
@@ -373,12 +533,12 @@ func Test_DeviceLoopError(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() {
 		deviceLoop(ctx,
-			host, &Config{
+			&DeviceConfig{Host: host}, &Config{
 				Password:             "incorrect",
 				Interval:             time.Second * 60,
 				TopicPrefix:          "rrfdata",
 				DiscoveryTopicPrefix: "rrfdisc",
-			}, msgc, polllog)
+			}, msgc, polllog, nil)
 	}()
 	defer cancel()
 
@@ -406,14 +566,14 @@ func Test_Run(t *testing.T) {
 		Interval:             time.Second * 60,
 		TopicPrefix:          "rrfdata",
 		DiscoveryTopicPrefix: "rrfdisc",
-		Devices:              []string{host},
+		Devices:              []*DeviceConfig{{Host: host}},
 	}
 	msgp := make(chan *mqtt.Msg, 30)
 	msgs := make(chan *mqtt.Msg, 1)
 	var runBuf bytes.Buffer
 	log := log.New(&runBuf, "", 0)
 	go func() {
-		err := Run(ctx, cfg, log, &MockPS{}, msgp, msgs)
+		err := Run(ctx, cfg, log, &MockPS{}, msgp, msgs, nil)
 		assert.NoError(t, err)
 	}()
 
@@ -450,3 +610,438 @@ func (ps *MockPS) Run(ctx context.Context, msgp, msgs chan *mqtt.Msg) error {
 	<-ctx.Done()
 	return nil
 }
+
+func Test_RunReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var buf bytes.Buffer
+	m1 := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts1 := httptest.NewServer(m1.Router())
+	defer ts1.Close()
+	m2 := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts2 := httptest.NewServer(m2.Router())
+	defer ts2.Close()
+	host1 := strings.Split(ts1.URL, "://")[1]
+	host2 := strings.Split(ts2.URL, "://")[1]
+
+	cfg := &Config{
+		Password:             "passw0rd",
+		Interval:             time.Second * 60,
+		DiscoveryInterval:    time.Hour,
+		TopicPrefix:          "rrfdata",
+		DiscoveryTopicPrefix: "rrfdisc",
+		Devices:              []*DeviceConfig{{Host: host1, Topic: "one"}},
+	}
+	msgp := make(chan *mqtt.Msg, 100)
+	msgs := make(chan *mqtt.Msg, 1)
+	reload := make(chan *Config)
+	var runBuf bytes.Buffer
+	go func() {
+		err := Run(ctx, cfg, log.New(&runBuf, "", 0), &MockPS{}, msgp,
+			msgs, reload)
+		assert.NoError(t, err)
+	}()
+
+	// collect returns the messages published until none arrive for a
+	// short time
+	collect := func() map[string]interface{} {
+		published := map[string]interface{}{}
+		for {
+			select {
+			case msg := <-msgp:
+				published[msg.Topic] = msg.Body
+			case <-time.After(500 * time.Millisecond):
+				return published
+			}
+		}
+	}
+	published := collect()
+	assert.Equal(t, "online", published["rrfdata/one/availability"])
+	assert.Equal(t, 23, len(published)) // availability, state and discovery
+
+	// add a device
+	reload <- &Config{
+		Password:             "passw0rd",
+		Interval:             time.Second * 60,
+		DiscoveryInterval:    time.Hour,
+		TopicPrefix:          "rrfdata",
+		DiscoveryTopicPrefix: "rrfdisc",
+		Devices: []*DeviceConfig{
+			{Host: host1, Topic: "one"},
+			{Host: host2, Topic: "two"},
+		},
+	}
+	published = collect()
+	assert.Equal(t, "online", published["rrfdata/two/availability"])
+	assert.Contains(t, published, "rrfdisc/sensor/two_state/config")
+	// the existing device is rediscovered but not restarted
+	assert.NotContains(t, published, "rrfdata/one/availability")
+	assert.Contains(t, published, "rrfdisc/sensor/one_state/config")
+
+	// remove a device; a change of broker is ignored
+	reload <- &Config{
+		Password:             "passw0rd",
+		Broker:               "tcp://other:1883",
+		Interval:             time.Second * 60,
+		DiscoveryInterval:    time.Hour,
+		TopicPrefix:          "rrfdata",
+		DiscoveryTopicPrefix: "rrfdisc",
+		Devices:              []*DeviceConfig{{Host: host2, Topic: "two"}},
+	}
+	published = collect()
+	assert.Equal(t, "", published["rrfdata/one/availability"])
+	assert.Equal(t, "", published["rrfdisc/sensor/one_state/config"])
+	assert.Contains(t, runBuf.String(), "ignoring change of broker setting")
+	assert.Contains(t, runBuf.String(), "removing device "+host1)
+}
+
+func Test_DeviceLoopClearsRemovedEntities(t *testing.T) {
+	var buf bytes.Buffer
+	mock := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(mock.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	cfg := &Config{
+		Password:             "passw0rd",
+		Interval:             time.Second * 60,
+		DiscoveryInterval:    time.Hour,
+		TopicPrefix:          "rrfdata",
+		DiscoveryTopicPrefix: "rrfdisc",
+	}
+	msgc := make(chan *mqtt.Msg, 100)
+	updc := make(chan *deviceUpdate, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go deviceLoop(ctx, &DeviceConfig{Host: host}, cfg, msgc,
+		log.New(&buf, "", 0), updc)
+
+	collect := func() map[string]interface{} {
+		published := map[string]interface{}{}
+		for {
+			select {
+			case msg := <-msgc:
+				published[msg.Topic] = msg.Body
+			case <-time.After(500 * time.Millisecond):
+				return published
+			}
+		}
+	}
+	published := collect()
+	assert.Contains(t, published, "rrfdisc/sensor/mockrrf_x/config")
+
+	updc <- &deviceUpdate{
+		dev: &DeviceConfig{Host: host, Sensors: []string{SensorsState}},
+		cfg: cfg,
+	}
+	published = collect()
+	assert.Equal(t, "", published["rrfdisc/sensor/mockrrf_x/config"])
+	assert.Equal(t, "", published["rrfdisc/sensor/mockrrf_layer/config"])
+	assert.IsType(t, Sensor{},
+		published["rrfdisc/sensor/mockrrf_state/config"])
+	assert.Equal(t, 22, len(published)) // 2 sensors, 19 cleared and state
+}
+
+func Test_PurgeMatch(t *testing.T) {
+	cfg := &Config{TopicPrefix: "rrfdata", DiscoveryTopicPrefix: "rrfdisc"}
+	disc := func(ids ...string) []byte {
+		b, err := json.Marshal(ha.Sensor{Device: ha.Device{Identifiers: ids}})
+		require.NoError(t, err)
+		return b
+	}
+	tests := []struct {
+		name    string
+		topic   string
+		payload []byte
+		want    bool
+	}{
+		{"availability", "rrfdata/mockrrf/availability", []byte("online"), true},
+		{"other device", "rrfdata/mockrrf2/availability", []byte("online"), false},
+		{"bridge", "rrfdata/bridge/availability", []byte("online"), false},
+		{"discovery",
+			"rrfdisc/sensor/mockrrf_state/config",
+			disc("mockrrf", "mockrrf_state"), true},
+		{"discovery of device with same prefix",
+			"rrfdisc/sensor/mockrrf_2_state/config",
+			disc("mockrrf_2", "mockrrf_2_state"), false},
+		{"discovery other component",
+			"rrfdisc/camera/mockrrf_webcam/config",
+			disc("mockrrf"), true},
+		{"invalid payload",
+			"rrfdisc/sensor/mockrrf_state/config", []byte("{"), false},
+		{"other prefix",
+			"homeassistant/sensor/mockrrf_state/config",
+			disc("mockrrf"), false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want,
+				purgeMatch(cfg, "mockrrf", tc.topic, tc.payload))
+		})
+	}
+}
+
+func Test_PurgeNames(t *testing.T) {
+	var buf bytes.Buffer
+	mock := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(mock.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	cfg := &Config{
+		Password: "passw0rd",
+		Timeout:  100 * time.Millisecond,
+		Devices:  []*DeviceConfig{{Host: "configured", Topic: "printer"}},
+	}
+	logger := log.New(&buf, "", 0)
+	assert.Equal(t, []string{topicSafe(host), "mockrrf"},
+		purgeNames(context.Background(), cfg, []string{host}, logger))
+	assert.Equal(t, []string{"configured", "printer"},
+		purgeNames(context.Background(), cfg, []string{"configured"}, logger))
+	assert.Equal(t, []string{"mockrrf"},
+		purgeNames(context.Background(), cfg, []string{"mockrrf"}, logger))
+}
+
+func Test_RunShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var buf bytes.Buffer
+	mock := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(mock.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	cfg := &Config{
+		Password:             "passw0rd",
+		Interval:             time.Second * 60,
+		DiscoveryInterval:    time.Hour,
+		TopicPrefix:          "rrfdata",
+		DiscoveryTopicPrefix: "rrfdisc",
+		Devices:              []*DeviceConfig{{Host: host, Topic: "one"}},
+	}
+	msgp := make(chan *mqtt.Msg, 100)
+	msgs := make(chan *mqtt.Msg, 1)
+	ps := &MockPS{}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Run(ctx, cfg, log.New(&buf, "", 0), ps, msgp, msgs, nil)
+	}()
+
+	msg := <-msgp
+	assert.Equal(t, "online", msg.Body)
+	for i := 0; i < 22; i++ {
+		<-msgp
+	}
+	cancel()
+	msg = <-msgp
+	assert.Equal(t, &mqtt.Msg{
+		Topic:  "rrfdata/one/availability",
+		Body:   "offline",
+		Retain: true,
+	}, msg)
+	select {
+	case err := <-errc:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+	}
+}
+
+func Test_DeviceLoopPublishesOnChange(t *testing.T) {
+	var buf bytes.Buffer
+	m := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(m.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	// a second printer that is moving slowly for the whole test
+	moving := mock.NewMockRRF(log.New(&buf, "", 0))
+	moving.Printer().GCode("G28\nG1 X-100 F60")
+	ts2 := httptest.NewServer(moving.Router())
+	defer ts2.Close()
+	movingHost := strings.Split(ts2.URL, "://")[1]
+
+	// count the state messages published by a device loop in a short
+	// time; the idle printer only changes its uptime
+	states := func(host string, cfg *Config, sensors []string) int {
+		msgc := make(chan *mqtt.Msg, 100)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go deviceLoop(ctx,
+			&DeviceConfig{Host: host, Topic: "one", Sensors: sensors},
+			cfg, msgc, log.New(&buf, "", 0), nil)
+		count := 0
+		timeout := time.After(500 * time.Millisecond)
+		for {
+			select {
+			case msg := <-msgc:
+				if msg.Topic == "rrfdata/one/state" {
+					count++
+				}
+			case <-timeout:
+				return count
+			}
+		}
+	}
+	cfg := func(maxSilence time.Duration) *Config {
+		return &Config{
+			Password:             "passw0rd",
+			Interval:             50 * time.Millisecond,
+			DiscoveryInterval:    time.Hour,
+			MaxSilence:           maxSilence,
+			TopicPrefix:          "rrfdata",
+			DiscoveryTopicPrefix: "rrfdisc",
+			Deadbands:            map[string]float64{SensorsLayer: 1000},
+		}
+	}
+	static := []string{SensorsState, SensorsGeometry}
+	assert.Equal(t, 1, states(host, cfg(time.Hour), static))
+	assert.Equal(t, 1, states(host, cfg(time.Hour),
+		append(static, SensorsLayer)))
+	assert.Equal(t, 1, states(movingHost, cfg(time.Hour),
+		append(static, SensorsLayer)))
+	assert.Greater(t, states(movingHost, cfg(time.Hour),
+		append(static, SensorsPosition)), 2)
+	// heartbeat
+	assert.Greater(t, states(host, cfg(100*time.Millisecond), static), 2)
+	// deadbands without a heartbeat
+	assert.Equal(t, 1, states(host, cfg(0), static))
+	// change detection disabled
+	every := cfg(0)
+	every.Deadbands = nil
+	assert.Greater(t, states(host, every, static), 5)
+}
+
+func Test_DeviceLoopStateTopics(t *testing.T) {
+	var buf bytes.Buffer
+	mock := mock.NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(mock.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	tests := []struct {
+		stateTopics string
+		json        bool
+		variables   bool
+	}{
+		{"", true, false},
+		{StateTopicsJSON, true, false},
+		{StateTopicsVariables, false, true},
+		{StateTopicsBoth, true, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.stateTopics, func(t *testing.T) {
+			msgc := make(chan *mqtt.Msg, 100)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// the default sensors include the state variable
+			go deviceLoop(ctx, &DeviceConfig{Host: host, Topic: "one"},
+				&Config{
+					Password:             "passw0rd",
+					Interval:             time.Minute,
+					DiscoveryInterval:    time.Hour,
+					TopicPrefix:          "rrfdata",
+					DiscoveryTopicPrefix: "rrfdisc",
+					StateTopics:          tc.stateTopics,
+				}, msgc, log.New(&buf, "", 0), nil)
+			published := map[string][]interface{}{}
+			timeout := time.After(500 * time.Millisecond)
+		LOOP:
+			for {
+				select {
+				case msg := <-msgc:
+					published[msg.Topic] = append(published[msg.Topic],
+						msg.Body)
+				case <-timeout:
+					break LOOP
+				}
+			}
+			states, ok := published["rrfdata/one/state"]
+			assert.Equal(t, tc.json, ok)
+			for _, body := range states {
+				assert.IsType(t, map[string]interface{}{}, body)
+			}
+			_, ok = published["rrfdata/one/temp_bed"]
+			assert.Equal(t, tc.variables, ok)
+			_, ok = published["rrfdata/one/status"]
+			assert.Equal(t, tc.variables, ok)
+		})
+	}
+}
+
+// manualClock is a clock for mock printers that only moves when it is
+// advanced.
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func Test_DeviceLoopRecovers(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario *mock.Scenario
+	}{
+		{"busy", mock.NewScenario().Busy(time.Second, time.Second)},
+		{"truncate", mock.NewScenario().Truncate(time.Second, time.Second)},
+		{"disconnect", mock.NewScenario().Disconnect(time.Second, time.Second)},
+		{"timeout", mock.NewScenario().Timeout(time.Second, time.Second)},
+		{"reboot", mock.NewScenario().Reboot(time.Second, time.Second)},
+		{"status only", mock.NewScenario().Busy(time.Second, time.Second).
+			OnPath("/rr_status")},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf, loopBuf bytes.Buffer
+			clock := &manualClock{now: time.Now()}
+			m := mock.NewMockRRF(log.New(&buf, "", 0)).
+				WithClock(clock.Now).WithScenario(tc.scenario)
+			ts := httptest.NewServer(m.Router())
+			defer ts.Close()
+			host := strings.Split(ts.URL, "://")[1]
+
+			msgc := make(chan *mqtt.Msg, 100)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go deviceLoop(ctx,
+				&DeviceConfig{Host: host, Topic: "one",
+					Timeout: 100 * time.Millisecond},
+				&Config{
+					Password:             "passw0rd",
+					Interval:             50 * time.Millisecond,
+					TopicPrefix:          "rrfdata",
+					DiscoveryTopicPrefix: "rrfdisc",
+				}, msgc, log.New(&loopBuf, "", 0), nil)
+
+			availability := func() string {
+				timeout := time.After(2 * time.Second)
+				for {
+					select {
+					case msg := <-msgc:
+						if msg.Topic == "rrfdata/one/availability" {
+							return msg.Body.(string)
+						}
+					case <-timeout:
+						return "timeout"
+					}
+				}
+			}
+			assert.Equal(t, "online", availability())
+			clock.advance(time.Second)
+			assert.Equal(t, "offline", availability())
+			clock.advance(time.Second)
+			assert.Equal(t, "online", availability())
+		})
+	}
+}
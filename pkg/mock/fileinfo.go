@@ -0,0 +1,100 @@
+package mock
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// Slicer comments that describe a G-code file, as written by
+// PrusaSlicer, Cura and Simplify3D.
+var (
+	generatedByRE      = regexp.MustCompile(`(?i)^(?:g-code )?generated (?:by|with) (.+)$`)
+	layerHeightRE      = regexp.MustCompile(`(?i)^(?:layer_height\s*=|layer height\s*:|layerHeight,)\s*([\d.]+)`)
+	firstLayerHeightRE = regexp.MustCompile(`(?i)^first_layer_height\s*=\s*([\d.]+)(%?)`)
+	filamentMMRE       = regexp.MustCompile(`(?i)^(?:filament used \[mm\]\s*=|filament length\s*:)\s*([\d., ]+)`)
+	filamentMetresRE   = regexp.MustCompile(`(?i)^filament used\s*:\s*([\d.]+m(?:\s*,\s*[\d.]+m)*)`)
+	printTimeRE        = regexp.MustCompile(`(?i)^(?:estimated printing time(?: \(normal mode\))?\s*=|build time\s*:)\s*(.+)$`)
+	printSecondsRE     = regexp.MustCompile(`^TIME:(\d+)`)
+	timePartRE         = regexp.MustCompile(`(?i)(\d+)\s*([dhms])`)
+)
+
+// fileInfo returns the rr_fileinfo response for a G-code file.  Like
+// the firmware, values from slicer comments are preferred to those
+// found by scanning the moves.
+func fileInfo(data []byte, modTime time.Time) *types.FileInfoResponse {
+	info := scanJob(data)
+	fi := &types.FileInfoResponse{
+		Size:             int64(len(data)),
+		LastModified:     types.Date(modTime.Format(sdDateFormat)),
+		Height:           round(info.height),
+		FirstLayerHeight: round(info.firstLayerHeight),
+		LayerHeight:      round(info.layerHeight),
+	}
+	if info.filament > 0 {
+		fi.Filament = []float64{round(info.filament)}
+	}
+	firstLayerPercent := false
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, ";") {
+			continue
+		}
+		comment := strings.TrimSpace(strings.TrimPrefix(line, ";"))
+		if m := generatedByRE.FindStringSubmatch(comment); m != nil {
+			if fi.GeneratedBy == "" {
+				fi.GeneratedBy = m[1]
+			}
+		} else if m := layerHeightRE.FindStringSubmatch(comment); m != nil {
+			fi.LayerHeight = parseFloat(m[1])
+		} else if m := firstLayerHeightRE.FindStringSubmatch(comment); m != nil {
+			fi.FirstLayerHeight = parseFloat(m[1])
+			firstLayerPercent = m[2] == "%"
+		} else if m := filamentMMRE.FindStringSubmatch(comment); m != nil {
+			fi.Filament = parseFloats(m[1], "", 1)
+		} else if m := filamentMetresRE.FindStringSubmatch(comment); m != nil {
+			fi.Filament = parseFloats(m[1], "m", 1000)
+		} else if m := printTimeRE.FindStringSubmatch(comment); m != nil {
+			fi.PrintTime = parsePrintTime(m[1])
+		} else if m := printSecondsRE.FindStringSubmatch(comment); m != nil {
+			fi.PrintTime = types.Time(parseFloat(m[1]))
+		}
+	}
+	if firstLayerPercent {
+		fi.FirstLayerHeight = round(fi.LayerHeight * fi.FirstLayerHeight / 100)
+	}
+	return fi
+}
+
+func parseFloat(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// parseFloats parses a comma separated list of numbers with an
+// optional unit and scales them.
+func parseFloats(s, unit string, scale float64) []float64 {
+	res := []float64{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSuffix(strings.TrimSpace(v), unit)
+		if v == "" {
+			continue
+		}
+		res = append(res, round(parseFloat(v)*scale))
+	}
+	return res
+}
+
+// parsePrintTime parses a time such as "1d 2h 3m 4s" or "1 hours 2
+// minutes".
+func parsePrintTime(s string) types.Time {
+	units := map[string]float64{"d": 86400, "h": 3600, "m": 60, "s": 1}
+	var t float64
+	for _, m := range timePartRE.FindAllStringSubmatch(s, -1) {
+		t += parseFloat(m[1]) * units[strings.ToLower(m[2])]
+	}
+	return types.Time(t)
+}
@@ -0,0 +1,84 @@
+package mock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_FileInfo(t *testing.T) {
+	modTime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.Local)
+	moves := "G1 Z0.3\nG1 X10 E1\nG1 Z0.5\nG1 X20 E2\nG1 Z0.7\nG1 X30 E3\n"
+	tests := []struct {
+		name  string
+		gcode string
+		want  *types.FileInfoResponse
+	}{
+		{
+			name:  "moves only",
+			gcode: moves,
+			want: &types.FileInfoResponse{
+				Height:           0.7,
+				FirstLayerHeight: 0.3,
+				LayerHeight:      0.2,
+				Filament:         []float64{3},
+			},
+		},
+		{
+			name: "prusaslicer",
+			gcode: "; generated by PrusaSlicer 2.3.0+linux-x64 on 2021-03-04 at 05:06:07 UTC\n" +
+				moves +
+				"; filament used [mm] = 1234.56, 78.9\n" +
+				"; estimated printing time (normal mode) = 1d 2h 3m 4s\n" +
+				"; layer_height = 0.15\n" +
+				"; first_layer_height = 200%\n",
+			want: &types.FileInfoResponse{
+				Height:           0.7,
+				FirstLayerHeight: 0.3,
+				LayerHeight:      0.15,
+				Filament:         []float64{1234.56, 78.9},
+				PrintTime:        93784,
+				GeneratedBy:      "PrusaSlicer 2.3.0+linux-x64 on 2021-03-04 at 05:06:07 UTC",
+			},
+		},
+		{
+			name: "cura",
+			gcode: ";FLAVOR:RepRap\n;TIME:3723\n;Filament used: 1.5m, 0.25m\n" +
+				";Layer height: 0.1\n;Generated with Cura_SteamEngine 4.8.0\n" +
+				moves,
+			want: &types.FileInfoResponse{
+				Height:           0.7,
+				FirstLayerHeight: 0.3,
+				LayerHeight:      0.1,
+				Filament:         []float64{1500, 250},
+				PrintTime:        3723,
+				GeneratedBy:      "Cura_SteamEngine 4.8.0",
+			},
+		},
+		{
+			name: "simplify3d",
+			gcode: "; G-Code generated by Simplify3D(R) Version 4.1.2\n" +
+				";   layerHeight,0.25\n" + moves +
+				"; Build time: 1 hours 2 minutes\n" +
+				"; Filament length: 987.6 mm (0.99 m)\n",
+			want: &types.FileInfoResponse{
+				Height:           0.7,
+				FirstLayerHeight: 0.3,
+				LayerHeight:      0.25,
+				Filament:         []float64{987.6},
+				PrintTime:        3720,
+				GeneratedBy:      "Simplify3D(R) Version 4.1.2",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.want.Size = int64(len(tc.gcode))
+			tc.want.LastModified = "2021-03-04T05:06:07"
+			assert.Equal(t, tc.want, fileInfo([]byte(tc.gcode), modTime))
+		})
+	}
+}
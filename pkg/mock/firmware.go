@@ -0,0 +1,261 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// Firmware is a profile of a generation of RepRapFirmware.  It sets
+// the endpoints the mock serves, the shape of the responses and the
+// board metadata.
+type Firmware struct {
+	// Name is used to select the profile with the mock command
+	Name                string
+	FirmwareName        string
+	FirmwareVersion     string
+	FirmwareDate        types.Date
+	FirmwareElectronics string
+	DWSVersion          string
+	// BoardType is reported by rr_connect if it is not empty
+	BoardType string
+	// MAC is the address of the network interface in the object model
+	MAC string
+	// Legacy firmware has only the original status response, which
+	// ignores the type and includes the G-code reply, and has no
+	// rr_config or rr_reply
+	Legacy bool
+	// Version3 firmware reports the bed heater separately, only lists
+	// the configured heaters and reports the fan speeds as an array
+	Version3 bool
+	// Model is true if the object model is available from rr_model
+	Model bool
+	// SessionKeys is true if rr_connect returns a key that clients
+	// send to identify their session
+	SessionKeys bool
+}
+
+// Firmware profiles.
+var (
+	// FirmwareLegacy is RepRapFirmware 1.x before typed status
+	// responses
+	FirmwareLegacy = &Firmware{
+		Name:                "legacy",
+		FirmwareName:        "RepRapFirmware",
+		FirmwareVersion:     "1.04",
+		FirmwareDate:        "2015-03-22",
+		FirmwareElectronics: "Duet 0.8.5",
+		Legacy:              true,
+	}
+	// Firmware2 is RepRapFirmware 2.x and the default profile
+	Firmware2 = &Firmware{
+		Name:                "rrf2",
+		FirmwareName:        "RepRapFirmware for Duet 2 WiFi/Ethernet",
+		FirmwareVersion:     "2.05.1",
+		FirmwareDate:        "2020-02-09b1",
+		FirmwareElectronics: "Duet WiFi 1.0 or 1.01",
+		DWSVersion:          "1.23",
+		BoardType:           "mockrrf",
+	}
+	// Firmware3 is RepRapFirmware 3.x in standalone mode before the
+	// object model could be queried over HTTP
+	Firmware3 = &Firmware{
+		Name:                "rrf3",
+		FirmwareName:        "RepRapFirmware for Duet 3 Mini 5+",
+		FirmwareVersion:     "3.0",
+		FirmwareDate:        "2020-01-03b3",
+		FirmwareElectronics: "Duet 3 Mini 5+ WiFi",
+		BoardType:           "duet3mini5plus",
+		Version3:            true,
+	}
+	// Firmware3Model is RepRapFirmware 3.x in standalone mode with the
+	// object model
+	Firmware3Model = &Firmware{
+		Name:                "rrf3-model",
+		FirmwareName:        "RepRapFirmware for Duet 3 MB6HC",
+		FirmwareVersion:     "3.4.5",
+		FirmwareDate:        "2022-11-30 19:35:23",
+		FirmwareElectronics: "Duet 3 MB6HC v1.01 or later",
+		BoardType:           "duet3mb6hc",
+		MAC:                 "be:ef:de:ad:fe:ed",
+		Version3:            true,
+		Model:               true,
+		SessionKeys:         true,
+	}
+)
+
+// Firmwares are the available firmware profiles, oldest first.
+var Firmwares = []*Firmware{
+	FirmwareLegacy, Firmware2, Firmware3, Firmware3Model,
+}
+
+// FirmwareByName returns the firmware profile with the given name.
+func FirmwareByName(name string) (*Firmware, error) {
+	names := []string{}
+	for _, f := range Firmwares {
+		if f.Name == name {
+			return f, nil
+		}
+		names = append(names, f.Name)
+	}
+	return nil, fmt.Errorf("unknown firmware '%s', should be one of %s",
+		name, strings.Join(names, ", "))
+}
+
+// configResponse returns the rr_config response for the firmware.
+func (f *Firmware) configResponse() *types.ConfigResponse {
+	cr := ConfigResponse()
+	cr.FirmwareName = f.FirmwareName
+	cr.FirmwareVersion = f.FirmwareVersion
+	cr.FirmwareDate = f.FirmwareDate
+	cr.FirmwareElectronics = f.FirmwareElectronics
+	cr.DWSVersion = f.DWSVersion
+	return cr
+}
+
+// legacyStatus is the status response of RepRapFirmware 1.x.
+type legacyStatus struct {
+	Status     types.Status      `json:"status"`
+	Heaters    []float64         `json:"heaters"`
+	Active     []float64         `json:"active"`
+	Standby    []float64         `json:"standby"`
+	HStat      []types.TempState `json:"hstat"`
+	Pos        []float64         `json:"pos"`
+	Machine    []float64         `json:"machine"`
+	SFactor    float64           `json:"sfactor"`
+	EFactor    []float64         `json:"efactor"`
+	BabyStep   float64           `json:"babystep"`
+	Tool       int               `json:"tool"`
+	Probe      string            `json:"probe"`
+	FanPercent []float64         `json:"fanPercent"`
+	FanRPM     float64           `json:"fanRPM"`
+	Homed      []types.RRFBool   `json:"homed"`
+	MsgBoxMode int               `json:"msgBox.mode"`
+	Seq        int               `json:"seq"`
+	Resp       string            `json:"resp"`
+}
+
+// newLegacyStatus returns the legacy form of a status response.
+func newLegacyStatus(s *types.StatusResponse, resp string) *legacyStatus {
+	ls := &legacyStatus{
+		Status:     s.Status,
+		Pos:        s.Coordinates.XYZ,
+		Machine:    s.Coordinates.Machine,
+		SFactor:    s.Params.SpeedFactor,
+		EFactor:    s.Params.ExtruderFactors,
+		Tool:       s.CurrentTool,
+		Probe:      "0",
+		FanPercent: s.Params.FanPercent,
+		Homed:      s.Coordinates.AxesHomed,
+		MsgBoxMode: -1,
+		Seq:        s.Seq,
+		Resp:       resp,
+	}
+	if len(s.Sensors.FanRPM) > 0 {
+		ls.FanRPM = s.Sensors.FanRPM[0]
+	}
+	for i, state := range s.Temps.State {
+		if state == types.Off && s.Temps.Current[i] == 2000 {
+			break
+		}
+		active := 0.0
+		if t := i - heaterHotend; t >= 0 && t < len(s.Temps.Tools.Active) {
+			active = s.Temps.Tools.Active[t][0]
+		}
+		ls.Heaters = append(ls.Heaters, s.Temps.Current[i])
+		ls.Active = append(ls.Active, active)
+		ls.Standby = append(ls.Standby, 0)
+		ls.HStat = append(ls.HStat, state)
+	}
+	return ls
+}
+
+// encodeStatus returns the JSON status response in the shape used by
+// the firmware.  Before RepRapFirmware 3, the fan speed is a number
+// rather than an array when there is only one fan with a tachometer.
+func (f *Firmware) encodeStatus(s *types.StatusResponse, resp string) ([]byte, error) {
+	if f.Legacy {
+		return json.Marshal(newLegacyStatus(s, resp))
+	}
+	data, err := json.Marshal(s)
+	if err != nil || f.Version3 || len(s.Sensors.FanRPM) != 1 {
+		return data, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	obj["sensors"], err = json.Marshal(&struct {
+		ProbeValue float64 `json:"probeValue"`
+		FanRPM     float64 `json:"fanRPM"`
+	}{s.Sensors.ProbeValue, s.Sensors.FanRPM[0]})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(obj)
+}
+
+// modelStatus is the object model name of each status.
+var modelStatus = map[types.Status]string{
+	types.Idle:     "idle",
+	types.Busy:     "busy",
+	types.Printing: "processing",
+	types.Pausing:  "pausing",
+	types.Stopped:  "paused",
+	types.Resuming: "resuming",
+	types.Halted:   "halted",
+}
+
+// model returns the part of the object model available over HTTP.
+func (f *Firmware) model(s *types.StatusResponse) map[string]interface{} {
+	return map[string]interface{}{
+		"boards": []interface{}{
+			map[string]interface{}{
+				"firmwareName":    f.FirmwareName,
+				"firmwareVersion": f.FirmwareVersion,
+				"firmwareDate":    f.FirmwareDate,
+				"name":            f.FirmwareElectronics,
+				"shortName":       f.BoardType,
+				"mcuTemp":         s.MCUTemp,
+				"vIn":             s.VIN,
+			},
+		},
+		"network": map[string]interface{}{
+			"name": s.Name,
+			"interfaces": []interface{}{
+				map[string]interface{}{
+					"type": "lan",
+					"mac":  f.MAC,
+				},
+			},
+		},
+		"state": map[string]interface{}{
+			"status":      modelStatus[s.Status],
+			"currentTool": s.CurrentTool,
+			"upTime":      s.UpTime,
+		},
+	}
+}
+
+// lookup returns the value of a dotted key, such as
+// network.interfaces, in the object model.  The empty key returns the
+// whole model.
+func lookup(model map[string]interface{}, key string) (interface{}, bool) {
+	var v interface{} = model
+	if key == "" {
+		return v, true
+	}
+	for _, k := range strings.Split(key, ".") {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = obj[k]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
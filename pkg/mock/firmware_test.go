@@ -0,0 +1,143 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_FirmwareByName(t *testing.T) {
+	f, err := FirmwareByName("rrf3-model")
+	require.NoError(t, err)
+	assert.Equal(t, Firmware3Model, f)
+	_, err = FirmwareByName("rrf4")
+	assert.EqualError(t, err,
+		"unknown firmware 'rrf4', should be one of legacy, rrf2, rrf3, rrf3-model")
+}
+
+func Test_Firmwares(t *testing.T) {
+	tests := []struct {
+		firmware  *Firmware
+		boardType string
+		config    bool
+		model     bool
+		// fanRPM is the raw JSON of the fan speeds in a type 1 status
+		fanRPM string
+	}{
+		{FirmwareLegacy, "", false, false, "0"},
+		{Firmware2, "mockrrf", true, false, "0"},
+		{Firmware3, "duet3mini5plus", true, false, "[-1,-1]"},
+		{Firmware3Model, "duet3mb6hc", true, true, "[-1,-1]"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.firmware.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			m := NewMockRRF(log.New(&buf, "", 0)).WithFirmware(tc.firmware)
+			ts := httptest.NewServer(m.Router())
+			defer ts.Close()
+			host := strings.Split(ts.URL, "://")[1]
+
+			ctx := context.Background()
+			c := netrrf.NewClient(host, "passw0rd").WithTimeout(time.Second)
+			require.NoError(t, c.Authenticate(ctx))
+			assert.Equal(t, tc.boardType, c.BoardType())
+
+			cr, err := c.Config(ctx)
+			if tc.config {
+				require.NoError(t, err)
+				assert.Equal(t, tc.firmware.FirmwareVersion, cr.FirmwareVersion)
+				assert.Equal(t, tc.firmware.FirmwareElectronics,
+					cr.FirmwareElectronics)
+			} else {
+				assert.Error(t, err)
+			}
+
+			var ifaces []struct {
+				MAC string `json:"mac"`
+			}
+			err = c.Model(ctx, "network.interfaces", "", &ifaces)
+			if tc.model {
+				require.NoError(t, err)
+				assert.Equal(t, "be:ef:de:ad:fe:ed", ifaces[0].MAC)
+				var status string
+				require.NoError(t, c.Model(ctx, "state.status", "", &status))
+				assert.Equal(t, "idle", status)
+				assert.Error(t, c.Model(ctx, "state.missing", "", &status))
+			} else {
+				assert.Error(t, err)
+			}
+
+			resp, err := http.Get(ts.URL + "/rr_status?type=1")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			var raw map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal(data, &raw))
+			if tc.firmware.Legacy {
+				assert.Equal(t, tc.fanRPM, string(raw["fanRPM"]))
+				assert.Equal(t, `[21,21]`, string(raw["heaters"]))
+				assert.Contains(t, raw, "resp")
+				assert.NotContains(t, raw, "coords")
+				return
+			}
+			var sensors map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal(raw["sensors"], &sensors))
+			assert.Equal(t, tc.fanRPM, string(sensors["fanRPM"]))
+
+			s, err := c.Status(ctx, 2)
+			require.NoError(t, err)
+			assert.Equal(t, tc.firmware.FirmwareName, s.FirmwareName)
+			if tc.firmware.Version3 {
+				assert.Equal(t, []float64{ambient, ambient}, s.Temps.Current)
+				assert.Equal(t, ambient, s.Temps.Bed.Current)
+			} else {
+				assert.Equal(t, []float64{ambient, ambient, 2000, 2000},
+					s.Temps.Current)
+			}
+
+			reply, err := c.SendGCode(ctx, "M115", time.Second)
+			require.NoError(t, err)
+			assert.Contains(t, reply,
+				"FIRMWARE_VERSION: "+tc.firmware.FirmwareVersion+" ")
+		})
+	}
+}
+
+func Test_LegacyStatus(t *testing.T) {
+	p, _ := newTestPrinter()
+	p.WithFirmware(FirmwareLegacy)
+	p.GCode("M104 S200\nM106 S0.5\nM114")
+	ls := newLegacyStatus(p.Status(1), p.Reply())
+	assert.Equal(t, &legacyStatus{
+		Status:     types.Idle,
+		Heaters:    []float64{ambient, ambient},
+		Active:     []float64{0, 200},
+		Standby:    []float64{0, 0},
+		HStat:      []types.TempState{types.Off, types.Active},
+		Pos:        []float64{0, 0, 0},
+		Machine:    []float64{0, 0, 0},
+		SFactor:    100,
+		EFactor:    []float64{100},
+		Tool:       0,
+		Probe:      "0",
+		FanPercent: []float64{50, 0},
+		Homed:      []types.RRFBool{false, false, false},
+		MsgBoxMode: -1,
+		Seq:        1,
+		Resp:       "X:0.000 Y:0.000 Z:0.000 E:0.000\n",
+	}, ls)
+}
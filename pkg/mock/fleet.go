@@ -0,0 +1,145 @@
+package mock
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// fleetMember is a template for the printers of a fleet: a machine and
+// the G-code that puts it in an interesting state.
+type fleetMember struct {
+	machine Machine
+	gcode   string
+}
+
+// fleetMembers are used in turn for the printers of a fleet.
+var fleetMembers = []fleetMember{
+	{
+		// printing the demo job
+		machine: Machine{
+			Name:      "delta",
+			Geometry:  GeometryDelta,
+			Tools:     1,
+			AxisMins:  [3]float64{-100, -100, 0},
+			AxisMaxes: [3]float64{100, 100, 200},
+		},
+		gcode: `M32 "demo.gcode"`,
+	},
+	{
+		// idle
+		machine: Machine{
+			Name:      "cartesian",
+			Geometry:  GeometryCartesian,
+			Tools:     2,
+			AxisMins:  [3]float64{0, 0, 0},
+			AxisMaxes: [3]float64{220, 220, 250},
+		},
+	},
+	{
+		// heating
+		machine: Machine{
+			Name:      "corexy",
+			Geometry:  GeometryCoreXY,
+			Tools:     4,
+			AxisMins:  [3]float64{0, 0, 0},
+			AxisMaxes: [3]float64{300, 300, 300},
+		},
+		gcode: "M140 S60\nM104 S210",
+	},
+	{
+		// milling the demo job
+		machine: Machine{
+			Name:      "cnc",
+			Geometry:  GeometryCartesian,
+			Tools:     1,
+			CNC:       true,
+			AxisMins:  [3]float64{0, 0, 0},
+			AxisMaxes: [3]float64{400, 300, 100},
+		},
+		gcode: `M32 "demo.gcode"`,
+	},
+	{
+		// paused before printing
+		machine: Machine{
+			Name:      "paused",
+			Geometry:  GeometryCartesian,
+			Tools:     1,
+			AxisMins:  [3]float64{0, 0, 0},
+			AxisMaxes: [3]float64{200, 200, 200},
+		},
+		gcode: "M32 \"demo.gcode\"\nM25",
+	},
+	{
+		// emergency stopped
+		machine: Machine{
+			Name:      "halted",
+			Geometry:  GeometryDelta,
+			Tools:     1,
+			AxisMins:  [3]float64{-150, -150, 0},
+			AxisMaxes: [3]float64{150, 150, 400},
+		},
+		gcode: "M112",
+	},
+}
+
+// Fleet is a group of mock printers with different names, machines and
+// states.
+type Fleet struct {
+	Printers []*MockRRF
+	// Names are the names of the printers
+	Names []string
+}
+
+// NewFleet returns a fleet of n printers.  The printers cycle through
+// a delta printing, an idle cartesian with two tools, a heating coreXY
+// with four tools, a CNC machine, a paused print and a halted printer.
+func NewFleet(logger *log.Logger, n int) *Fleet {
+	f := &Fleet{}
+	for i := 0; i < n; i++ {
+		member := fleetMembers[i%len(fleetMembers)]
+		machine := member.machine
+		machine.Name = fmt.Sprintf("%s-%d", machine.Name, i+1)
+		m := NewMockRRF(log.New(logger.Writer(),
+			logger.Prefix()+machine.Name+": ", logger.Flags())).
+			WithMachine(&machine)
+		f.Printers = append(f.Printers, m)
+		f.Names = append(f.Names, machine.Name)
+	}
+	return f
+}
+
+// Start executes the G-code that puts each printer in its initial
+// state.  It is called after any clock has been set.
+func (f *Fleet) Start() {
+	for i, m := range f.Printers {
+		if gcode := fleetMembers[i%len(fleetMembers)].gcode; gcode != "" {
+			m.Printer().GCode(gcode)
+		}
+	}
+}
+
+// Router returns a handler that routes requests to the printers by
+// host name.  The first label of the host name, for example delta-1 in
+// delta-1.example.com:8888, is the name of the printer.
+func (f *Fleet) Router() http.Handler {
+	routers := map[string]http.Handler{}
+	for i, m := range f.Printers {
+		routers[f.Names[i]] = m.Router()
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		name := strings.SplitN(host, ".", 2)[0]
+		router, ok := routers[name]
+		if !ok {
+			http.Error(w, "Unknown printer "+name, http.StatusNotFound)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,80 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_Fleet(t *testing.T) {
+	var buf bytes.Buffer
+	clock := &testClock{now: time.Now()}
+	f := NewFleet(log.New(&buf, "", 0), 7)
+	for _, m := range f.Printers {
+		m.WithClock(clock.Now)
+	}
+	f.Start()
+	clock.advance(time.Second)
+	assert.Equal(t, []string{"delta-1", "cartesian-2", "corexy-3", "cnc-4",
+		"paused-5", "halted-6", "delta-7"}, f.Names)
+
+	tests := []struct {
+		geometry string
+		tools    int
+		status   types.Status
+	}{
+		{"delta", 1, types.Printing},
+		{"cartesian", 2, types.Idle},
+		{"coreXY", 4, types.Idle},
+		{"cartesian", 1, types.Printing},
+		{"cartesian", 1, types.Stopped},
+		{"delta", 1, types.Halted},
+		{"delta", 1, types.Printing},
+	}
+	for i, tc := range tests {
+		s := f.Printers[i].Printer().Status(2)
+		assert.Equal(t, f.Names[i], s.Name)
+		assert.Equal(t, tc.geometry, s.Geometry, f.Names[i])
+		assert.Equal(t, tc.tools, len(s.Tools), f.Names[i])
+		assert.Equal(t, tc.status, s.Status, f.Names[i])
+	}
+	assert.Equal(t, types.Active,
+		f.Printers[2].Printer().Status(1).Temps.State[heaterBed])
+	assert.Equal(t, 1, len(f.Printers[3].Printer().Status(1).Spindles))
+
+	ts := httptest.NewServer(f.Router())
+	defer ts.Close()
+	get := func(host, path string) (int, []byte) {
+		req, err := http.NewRequest("GET", ts.URL+path, nil)
+		require.NoError(t, err)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, body
+	}
+	code, _ := get("corexy-3.example.com:8888", "/rr_connect?password=reprap")
+	assert.Equal(t, http.StatusOK, code)
+	code, body := get("corexy-3.example.com:8888", "/rr_status?type=2")
+	assert.Equal(t, http.StatusOK, code)
+	var s types.StatusResponse
+	require.NoError(t, json.Unmarshal(body, &s))
+	assert.Equal(t, "corexy-3", s.Name)
+	code, _ = get("cnc-4", "/rr_status?type=2")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, body = get("missing", "/rr_status?type=2")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "Unknown printer missing\n", string(body))
+}
@@ -0,0 +1,678 @@
+package mock
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// command is a parsed line of G-code.
+type command struct {
+	letter byte
+	code   int
+	params map[byte]float64
+	// arg is the rest of the line for commands that take a file name
+	// or message
+	arg string
+}
+
+func (c *command) String() string {
+	return fmt.Sprintf("%c%d", c.letter, c.code)
+}
+
+// stringCommands are the M codes that take a file name or message
+// rather than parameters.
+var stringCommands = map[int]bool{23: true, 32: true, 117: true}
+
+// parseGCode parses a line of G-code.  It returns nil for lines with
+// only a comment.  Line numbers are ignored but checksums are checked.
+func parseGCode(line string) (*command, error) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if i := strings.LastIndexByte(line, '*'); i >= 0 {
+		sum, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+		if err != nil || sum != checksum(line[:i]) {
+			return nil, fmt.Errorf("checksum error: %s", line)
+		}
+		line = strings.TrimSpace(line[:i])
+	}
+	if len(line) > 0 && upper(line[0]) == 'N' {
+		i := 1
+		for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+			i++
+		}
+		line = strings.TrimSpace(line[i:])
+	}
+	if line == "" {
+		return nil, nil
+	}
+	c := &command{letter: upper(line[0]), params: map[byte]float64{}}
+	i := 1
+	if c.letter == 'T' && i < len(line) && line[i] == '-' {
+		i++
+	}
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	code, err := strconv.Atoi(line[1:i])
+	if c.letter == 'T' && i == 1 {
+		// T on its own reports the current tool
+		code, err = toolQuery, nil
+	}
+	if err != nil || (c.letter != 'G' && c.letter != 'M' && c.letter != 'T') {
+		return nil, fmt.Errorf("bad command: %s", line)
+	}
+	c.code = code
+	rest := line[i:]
+	if c.letter == 'M' && stringCommands[code] {
+		c.arg = strings.Trim(strings.TrimSpace(rest), `"`)
+		return c, nil
+	}
+	for j := 0; j < len(rest); {
+		if rest[j] == ' ' || rest[j] == '\t' {
+			j++
+			continue
+		}
+		letter := upper(rest[j])
+		j++
+		k := j
+		for k < len(rest) && strings.IndexByte("+-.0123456789", rest[k]) >= 0 {
+			k++
+		}
+		v := 0.0
+		if k > j {
+			v, err = strconv.ParseFloat(rest[j:k], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad parameter %c%s: %s", letter,
+					rest[j:k], line)
+			}
+		}
+		c.params[letter] = v
+		j = k
+	}
+	return c, nil
+}
+
+// checksum returns the checksum of a line of G-code.
+func checksum(line string) int {
+	sum := 0
+	for i := 0; i < len(line); i++ {
+		sum ^= int(line[i])
+	}
+	return sum
+}
+
+func upper(b byte) byte {
+	if b >= 'a' && b <= 'z' {
+		return b - 'a' + 'A'
+	}
+	return b
+}
+
+// GCode executes one or more lines of G-code and returns the reply.
+// Lines received while an earlier command is waiting are executed once
+// it completes and their reply is only available from Reply.
+func (p *Printer) GCode(gcode string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sync()
+	var reply strings.Builder
+	for _, line := range strings.Split(gcode, "\n") {
+		if p.wait != nil {
+			p.pending = append(p.pending, line)
+			continue
+		}
+		reply.WriteString(p.execReply(line))
+	}
+	p.addReply(reply.String())
+	return reply.String()
+}
+
+// Reply returns the reply to the last G-code that produced one.
+func (p *Printer) Reply() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reply
+}
+
+func (p *Printer) addReply(reply string) {
+	if reply != "" {
+		p.reply = reply
+		p.seq++
+	}
+}
+
+// runPending executes the commands received while waiting.
+func (p *Printer) runPending() {
+	var reply strings.Builder
+	for len(p.pending) > 0 && p.wait == nil {
+		line := p.pending[0]
+		p.pending = p.pending[1:]
+		reply.WriteString(p.execReply(line))
+	}
+	p.addReply(reply.String())
+}
+
+// execReply executes a line of G-code received on rr_gcode and returns
+// the reply including any error.  In Marlin emulation every command is
+// acknowledged with "ok".
+func (p *Printer) execReply(line string) string {
+	r, err := p.exec(line, false)
+	if err != nil {
+		r = "Error: " + err.Error() + "\n"
+	}
+	if p.marlin && strings.TrimSpace(line) != "" {
+		r += "ok\n"
+	}
+	return r
+}
+
+// exec executes a line of G-code from the job, if fromJob is true, or
+// received on rr_gcode.
+func (p *Printer) exec(line string, fromJob bool) (string, error) {
+	c, err := parseGCode(line)
+	if err != nil || c == nil {
+		return "", err
+	}
+	if p.halted && !(c.letter == 'M' && (c.code == 112 || c.code == 999)) {
+		return "", fmt.Errorf("%s: Printer is halted, send M999 to reset", c)
+	}
+	switch c.letter {
+	case 'G':
+		return p.execG(c, fromJob)
+	case 'M':
+		return p.execM(c)
+	}
+	return p.selectTool(c)
+}
+
+func (p *Printer) execG(c *command, fromJob bool) (string, error) {
+	switch c.code {
+	case 0, 1:
+		return p.linearMove(c, fromJob)
+	case 4:
+		until := p.uptime + time.Duration(
+			(c.params['S']+c.params['P']/1000)*float64(time.Second))
+		p.wait = func() bool {
+			return len(p.moves) == 0 && p.uptime >= until
+		}
+	case 10:
+		return "", p.setToolTemperatures(c)
+	case 21:
+		// millimetres are the only units
+	case 28:
+		p.queue(&move{
+			to:    p.homePosition(),
+			speed: homingFeed,
+			home:  true,
+		})
+	case 90:
+		p.relative, p.relativeE = false, false
+	case 91:
+		p.relative, p.relativeE = true, true
+	case 92:
+		p.setPosition(c)
+	default:
+		return "", fmt.Errorf("%s: Command is not supported", c)
+	}
+	return "", nil
+}
+
+func (p *Printer) execM(c *command) (string, error) {
+	switch c.code {
+	case 0:
+		return "", p.cancel(c)
+	case 3, 4, 5:
+		return "", p.setSpindle(c)
+	case 18, 84:
+		// idle the motors so the positions are lost
+		p.homed = [3]bool{}
+		p.plannedHomed = [3]bool{}
+	case 23:
+		return p.selectFile(c.arg)
+	case 24:
+		return "", p.resume()
+	case 25:
+		return "", p.pause()
+	case 32:
+		return "", p.startFile(c.arg)
+	case 82:
+		p.relativeE = false
+	case 83:
+		p.relativeE = true
+	case 104, 109:
+		tool := p.tool
+		if v, ok := c.params['T']; ok {
+			tool = int(v)
+		}
+		h := p.toolHeater(tool)
+		if h == nil {
+			return "", fmt.Errorf("%s: Invalid tool number", c)
+		}
+		p.setTemperature(h, c, c.code == 109)
+	case 105:
+		return p.temperatures(), nil
+	case 106:
+		return "", p.setFan(c)
+	case 107:
+		p.fans[0] = 0
+	case 112:
+		p.halt()
+	case 114:
+		return fmt.Sprintf("X:%.3f Y:%.3f Z:%.3f E:%.3f\n",
+			p.pos[axisX], p.pos[axisY], p.pos[axisZ], p.pos[axisE]), nil
+	case 115:
+		return fmt.Sprintf("FIRMWARE_NAME: %s FIRMWARE_VERSION: %s ELECTRONICS: %s FIRMWARE_DATE: %s\n",
+			p.firmware.FirmwareName, p.firmware.FirmwareVersion,
+			p.firmware.FirmwareElectronics, p.firmware.FirmwareDate), nil
+	case 117:
+		// messages are not displayed
+	case 140, 190:
+		if p.bed() == nil {
+			return "", fmt.Errorf("%s: No bed heater", c)
+		}
+		p.setTemperature(p.bed(), c, c.code == 190)
+	case 220:
+		return p.setFactor(c, &p.speedFactor, "Speed factor override")
+	case 221:
+		return p.setFactor(c, &p.extrusionFactor, "Extrusion factor override")
+	case 400:
+		p.wait = func() bool { return len(p.moves) == 0 }
+	case 555:
+		return p.setEmulation(c)
+	case 562:
+		return "", p.resetFault(c)
+	case 999:
+		p.reset()
+	default:
+		return "", fmt.Errorf("%s: Command is not supported", c)
+	}
+	return "", nil
+}
+
+// toolQuery is the code of a T command without a tool number.
+const toolQuery = math.MinInt32
+
+// temperatures returns the M105 reply.  A single tool is reported as
+// T and multiple tools as T0, T1 and so on.
+func (p *Printer) temperatures() string {
+	var b strings.Builder
+	for t := 0; t < p.machine.Tools; t++ {
+		h := p.toolHeater(t)
+		if h == nil {
+			continue
+		}
+		name := "T"
+		if p.machine.Tools > 1 {
+			name += strconv.Itoa(t)
+		}
+		fmt.Fprintf(&b, "%s:%.1f /%.1f ", name, h.current, h.active)
+	}
+	if bed := p.bed(); bed != nil {
+		fmt.Fprintf(&b, "B:%.1f /%.1f ", bed.current, bed.active)
+	}
+	return strings.TrimSpace(b.String()) + "\n"
+}
+
+// selectTool selects a tool or, for T-1, deselects the current tool.
+// The heater of the old tool is put on standby and that of the new
+// tool made active.  Like the firmware, the tool is changed after the
+// queued moves complete.
+func (p *Printer) selectTool(c *command) (string, error) {
+	switch {
+	case c.code == toolQuery:
+		if p.tool < 0 {
+			return "No tool is selected\n", nil
+		}
+		return fmt.Sprintf("Tool %d is selected\n", p.tool), nil
+	case c.code < -1 || c.code >= p.machine.Tools:
+		return "", fmt.Errorf("%s: Invalid tool number", c)
+	case c.code == p.tool:
+		return "", nil
+	case len(p.moves) > 0:
+		p.wait = func() bool { return len(p.moves) == 0 }
+		p.pending = append([]string{c.String()}, p.pending...)
+		return "", nil
+	}
+	if h := p.toolHeater(p.tool); h != nil && h.state == types.Active {
+		h.state = types.Standby
+	}
+	if h := p.toolHeater(c.code); h != nil && h.state == types.Standby {
+		h.state = types.Active
+	}
+	if p.tool >= 0 && p.tool < len(p.drives) {
+		p.drives[p.tool] = p.pos[axisE]
+	}
+	if c.code >= 0 && c.code < len(p.drives) {
+		p.pos[axisE] = p.drives[c.code]
+		p.planned[axisE] = p.pos[axisE]
+		p.extruder = p.pos[axisE]
+	}
+	p.tool = c.code
+	return "", nil
+}
+
+// setSpindle starts, with M3 or, in reverse, M4, or stops, with M5, the
+// spindle of the current tool of a CNC machine.
+func (p *Printer) setSpindle(c *command) error {
+	if !p.machine.CNC {
+		return fmt.Errorf("%s: Command is not supported", c)
+	}
+	if p.tool < 0 {
+		return fmt.Errorf("%s: No tool selected", c)
+	}
+	rpm := c.params['S']
+	switch c.code {
+	case 4:
+		rpm = -rpm
+	case 5:
+		rpm = 0
+	}
+	p.spindles[p.tool] = rpm
+	return nil
+}
+
+// homePosition is the position after homing.  All the axes are homed
+// together.
+func (p *Printer) homePosition() [4]float64 {
+	home := p.machine.home()
+	return [4]float64{home[axisX], home[axisY], home[axisZ],
+		p.planned[axisE]}
+}
+
+func (p *Printer) linearMove(c *command, fromJob bool) (string, error) {
+	to := p.planned
+	moved := false
+	for i, l := range axisLetters[:axisE] {
+		v, ok := c.params[l]
+		if !ok {
+			continue
+		}
+		moved = true
+		if p.relative {
+			v += p.planned[i]
+		}
+		to[i] = math.Max(p.machine.AxisMins[i],
+			math.Min(p.machine.AxisMaxes[i], v))
+	}
+	if moved && p.plannedHomed != [3]bool{true, true, true} {
+		return "", fmt.Errorf("G0/G1: insufficient axes homed")
+	}
+	extruder := p.extruder
+	h := p.toolHeater(p.tool)
+	// without a tool with an extruder the E parameter is ignored
+	if v, ok := c.params['E']; ok && h != nil {
+		if !p.relativeE {
+			v, p.extruder = v-p.extruder, v
+		} else {
+			p.extruder += v
+		}
+		to[axisE] += v * p.extrusionFactor / 100
+	}
+	if f, ok := c.params['F']; ok && f > 0 {
+		p.feed = f / 60
+	}
+	reply := ""
+	if to[axisE] != p.planned[axisE] && h.current < coldExtrudeTemperature {
+		to[axisE] = p.planned[axisE]
+		p.extruder = extruder
+		reply = fmt.Sprintf("Warning: Tool %d was not driven because its heater temperatures were not high enough\n", p.tool)
+	}
+	if fromJob && p.job != nil {
+		p.job.moved(to[axisZ], to[axisE]-p.planned[axisE], p.uptime)
+	}
+	if to != p.planned {
+		speed := math.Min(p.feed*p.speedFactor/100,
+			maxFeed)
+		p.queue(&move{to: to, speed: speed})
+	}
+	return reply, nil
+}
+
+// setPosition sets the position of the axes, without moving, and marks
+// them as homed.  The queued moves are adjusted so that they still move
+// the same distance.
+func (p *Printer) setPosition(c *command) {
+	for i, l := range axisLetters {
+		v, ok := c.params[l]
+		if !ok {
+			continue
+		}
+		if i == axisE {
+			p.extruder = v
+			continue
+		}
+		d := v - p.planned[i]
+		p.planned[i] = v
+		p.pos[i] += d
+		for _, m := range p.moves {
+			m.to[i] += d
+		}
+		p.homed[i] = true
+		p.plannedHomed[i] = true
+	}
+}
+
+// setTemperature sets the temperature of the heater from the S
+// parameter and, if wait is true, blocks further commands until the
+// temperature is reached.
+func (p *Printer) setTemperature(h *heater, c *command, wait bool) {
+	if s, ok := c.params['S']; ok {
+		h.set(s)
+	} else if r, ok := c.params['R']; ok {
+		h.set(r)
+	}
+	if wait && !h.reached() {
+		p.wait = h.reached
+	}
+}
+
+// setToolTemperatures sets the active and standby temperatures of a
+// tool.  Offsets, set with the L parameter, are not supported.
+func (p *Printer) setToolTemperatures(c *command) error {
+	if _, ok := c.params['L']; ok {
+		return fmt.Errorf("%s: Tool offsets are not supported", c)
+	}
+	tool := p.tool
+	if v, ok := c.params['P']; ok {
+		tool = int(v)
+	}
+	h := p.toolHeater(tool)
+	if h == nil {
+		return fmt.Errorf("%s: Invalid tool number", c)
+	}
+	if s, ok := c.params['S']; ok {
+		h.active = s
+		if p.tool == tool && s > 0 && h.state != types.Fault {
+			h.state = types.Active
+		}
+	}
+	if r, ok := c.params['R']; ok {
+		h.standby = r
+		if p.tool != tool && r > 0 && h.state != types.Fault {
+			h.state = types.Standby
+		}
+	}
+	return nil
+}
+
+// resetFault clears the fault of the heater given by the P parameter
+// or of all heaters.
+func (p *Printer) resetFault(c *command) error {
+	heaters := p.heaters
+	if v, ok := c.params['P']; ok {
+		i := int(v)
+		if i < 0 || i >= len(p.heaters) {
+			return fmt.Errorf("%s: Invalid heater number %d", c, i)
+		}
+		heaters = p.heaters[i : i+1]
+	}
+	for _, h := range heaters {
+		if h.state == types.Fault {
+			h.state = types.Off
+			h.active = 0
+		}
+	}
+	return nil
+}
+
+// setFan sets the fan given by the P parameter, or the print fan, to S
+// which is either a fraction or in the range 0 to 255.
+func (p *Printer) setFan(c *command) error {
+	fan := int(c.params['P'])
+	if fan < 0 || fan >= len(p.fans) {
+		return fmt.Errorf("%s: Fan number %d not found", c, fan)
+	}
+	s, ok := c.params['S']
+	if !ok {
+		s = 1
+	}
+	if s > 1 {
+		s /= 255
+	}
+	p.fans[fan] = math.Round(math.Max(0, math.Min(1, s))*1000) / 10
+	return nil
+}
+
+// setFactor sets a speed or extrusion factor, in percent, from the S
+// parameter or reports it if there is no S parameter.
+func (p *Printer) setFactor(c *command, factor *float64, name string) (string, error) {
+	s, ok := c.params['S']
+	if !ok {
+		return fmt.Sprintf("%s: %.0f%%\n", name, *factor), nil
+	}
+	if s <= 0 {
+		return "", fmt.Errorf("%s: Invalid factor %.0f%%", c, s)
+	}
+	*factor = s
+	return "", nil
+}
+
+// setEmulation selects RepRapFirmware (P1) or Marlin (P2) emulation or
+// reports the current emulation.
+func (p *Printer) setEmulation(c *command) (string, error) {
+	v, ok := c.params['P']
+	switch {
+	case !ok && p.marlin:
+		return "Emulating Marlin\n", nil
+	case !ok:
+		return "Emulating RepRap Firmware\n", nil
+	case v == 0 || v == 1:
+		p.marlin = false
+	case v == 2:
+		p.marlin = true
+	default:
+		return "", fmt.Errorf("%s: Unsupported emulation type %.0f", c, v)
+	}
+	return "", nil
+}
+
+// halt is an emergency stop.  The heaters are turned off, moves and the
+// job are abandoned and the printer is halted until it is reset.
+func (p *Printer) halt() {
+	for _, h := range p.heaters {
+		h.set(0)
+	}
+	for i := range p.spindles {
+		p.spindles[i] = 0
+	}
+	p.moves = nil
+	p.planned = p.pos
+	p.homed = [3]bool{}
+	p.plannedHomed = [3]bool{}
+	p.wait = nil
+	p.pending = nil
+	p.job = nil
+	p.state = ""
+	p.halted = true
+}
+
+func (p *Printer) selectFile(name string) (string, error) {
+	name = gcodeFile(name)
+	if _, _, err := p.sd.ReadFile(name); err != nil {
+		return "", fmt.Errorf("M23: GCode file \"%s\" not found", name)
+	}
+	p.selected = name
+	return fmt.Sprintf("File %s selected for printing\n", name), nil
+}
+
+func (p *Printer) startFile(name string) error {
+	if p.job != nil {
+		return fmt.Errorf("M32: Cannot set file to print, because a file is already being printed")
+	}
+	name = gcodeFile(name)
+	if _, _, err := p.sd.ReadFile(name); err != nil {
+		return fmt.Errorf("M32: GCode file \"%s\" not found", name)
+	}
+	p.selected = name
+	p.start()
+	return nil
+}
+
+// start prints the selected file.  The file may have been deleted
+// since it was selected in which case the print is empty.
+func (p *Printer) start() {
+	data, _, _ := p.sd.ReadFile(p.selected)
+	p.job = newJob(p.selected, data, p.uptime)
+	p.state = types.Printing
+}
+
+// resume starts printing the selected file or resumes a paused print.
+func (p *Printer) resume() error {
+	if p.job == nil {
+		if p.selected == "" {
+			return fmt.Errorf("M24: Cannot print, because no file is selected!")
+		}
+		p.start()
+		return nil
+	}
+	if p.state != types.Stopped {
+		return nil
+	}
+	p.state = types.Resuming
+	to := p.pausePos
+	to[axisE] = p.planned[axisE]
+	if to != p.planned {
+		p.queue(&move{to: to, speed: p.feed})
+	}
+	return nil
+}
+
+// pause stops reading the job.  The print is paused once the queued
+// moves have completed.
+func (p *Printer) pause() error {
+	if p.job == nil {
+		return fmt.Errorf("M25: Cannot pause print, because no file is being printed!")
+	}
+	if p.state == types.Printing || p.state == types.Resuming {
+		p.state = types.Pausing
+	}
+	return nil
+}
+
+// cancel cancels a paused print and turns the heaters off unless the H1
+// parameter is given.
+func (p *Printer) cancel(c *command) error {
+	if p.job != nil && p.state != types.Stopped {
+		return fmt.Errorf("M0: Pause the print before attempting to cancel it")
+	}
+	p.job = nil
+	p.state = ""
+	p.wait = nil
+	p.pending = nil
+	if c.params['H'] == 0 {
+		for _, h := range p.heaters {
+			h.set(0)
+		}
+	}
+	for i := range p.spindles {
+		p.spindles[i] = 0
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package mock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_ParseGCode(t *testing.T) {
+	tests := []struct {
+		line string
+		want *command
+		err  string
+	}{
+		{line: "", want: nil},
+		{line: "  ; just a comment", want: nil},
+		{
+			line: "G1 X10.5 y-2 E.25 F1800 ; move",
+			want: &command{letter: 'G', code: 1, params: map[byte]float64{
+				'X': 10.5, 'Y': -2, 'E': 0.25, 'F': 1800}},
+		},
+		{
+			line: "G1X1Y2",
+			want: &command{letter: 'G', code: 1, params: map[byte]float64{
+				'X': 1, 'Y': 2}},
+		},
+		{
+			line: "G28 X\r",
+			want: &command{letter: 'G', code: 28, params: map[byte]float64{
+				'X': 0}},
+		},
+		{
+			line: `M32 "my print.gcode"`,
+			want: &command{letter: 'M', code: 32, params: map[byte]float64{},
+				arg: "my print.gcode"},
+		},
+		{
+			line: "M117 Hello World",
+			want: &command{letter: 'M', code: 117, params: map[byte]float64{},
+				arg: "Hello World"},
+		},
+		{
+			line: "N10 G1 X5*84",
+			want: &command{letter: 'G', code: 1, params: map[byte]float64{
+				'X': 5}},
+		},
+		{
+			line: "T-1",
+			want: &command{letter: 'T', code: -1, params: map[byte]float64{}},
+		},
+		{
+			line: "T",
+			want: &command{letter: 'T', code: toolQuery,
+				params: map[byte]float64{}},
+		},
+		{line: "N10 G1 X5*85", err: "checksum error: N10 G1 X5*85"},
+		{line: "X10", err: "bad command: X10"},
+		{line: "G1 X1.2.3", err: "bad parameter X1.2.3: G1 X1.2.3"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.line, func(t *testing.T) {
+			c, err := parseGCode(tc.line)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, c)
+		})
+	}
+}
+
+func Test_GCodeReplies(t *testing.T) {
+	p, _ := newTestPrinter()
+	tests := []struct {
+		gcode string
+		reply string
+	}{
+		{"G21", ""},
+		{"M115", "FIRMWARE_NAME: RepRapFirmware for Duet 2 WiFi/Ethernet FIRMWARE_VERSION: 2.05.1 ELECTRONICS: Duet WiFi 1.0 or 1.01 FIRMWARE_DATE: 2020-02-09b1\n"},
+		{"M9999", "Error: M9999: Command is not supported\n"},
+		{"G29 S1", "Error: G29: Command is not supported\n"},
+		{"M220", "Speed factor override: 100%\n"},
+		{"M220 S150", ""},
+		{"M220", "Speed factor override: 150%\n"},
+		{"M221 S0", "Error: M221: Invalid factor 0%\n"},
+		{"M106 P5 S1", "Error: M106: Fan number 5 not found\n"},
+		{"T", "Tool 0 is selected\n"},
+		{"T1", "Error: T1: Invalid tool number\n"},
+		{"T-1\nT", "No tool is selected\n"},
+		{"G10 P1 S200", "Error: G10: Invalid tool number\n"},
+		{"G10 L2 P1 X1", "Error: G10: Tool offsets are not supported\n"},
+		{"M105", "T:21.0 /0.0 B:21.0 /0.0\n"},
+		{"M114", "X:0.000 Y:0.000 Z:0.000 E:0.000\n"},
+		{"M555", "Emulating RepRap Firmware\n"},
+		{"M555 P2", "ok\n"},
+		{"G21", "ok\n"},
+		{"M555", "Emulating Marlin\nok\n"},
+		{"M9999", "Error: M9999: Command is not supported\nok\n"},
+		{"M555 P1", ""},
+		{"M555 P3", "Error: M555: Unsupported emulation type 3\n"},
+		{"M112", ""},
+		{"G28", "Error: G28: Printer is halted, send M999 to reset\n"},
+		{"M999", ""},
+		{"G28", ""},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.reply, p.GCode(tc.gcode), tc.gcode)
+	}
+}
+
+func Test_GCodeSettings(t *testing.T) {
+	p, clock := newTestPrinter()
+	p.GCode("M106 S128\nM106 P1 S0.5\nM220 S200\nM221 S90")
+	s := p.Status(2)
+	assert.Equal(t, []float64{50.2, 50}, s.Params.FanPercent)
+	assert.Equal(t, 200.0, s.Params.SpeedFactor)
+	assert.Equal(t, []float64{90}, s.Params.ExtruderFactors)
+	p.GCode("M107")
+	assert.Equal(t, []float64{0, 50}, p.Status(2).Params.FanPercent)
+
+	p.GCode("G10 P0 S210 R150")
+	s = p.Status(2)
+	assert.Equal(t, [][]float64{{210}}, s.Temps.Tools.Active)
+	assert.Equal(t, [][]float64{{150}}, s.Temps.Tools.Standby)
+	assert.Equal(t, types.Active, s.Temps.State[heaterHotend])
+	p.GCode("T-1")
+	s = p.Status(2)
+	assert.Equal(t, -1, s.CurrentTool)
+	assert.Equal(t, types.Standby, s.Temps.State[heaterHotend])
+	p.GCode("T0")
+	s = p.Status(2)
+	assert.Equal(t, 0, s.CurrentTool)
+	assert.Equal(t, types.Active, s.Temps.State[heaterHotend])
+
+	clock.advance(time.Minute)
+	p.GCode("M112")
+	s = p.Status(2)
+	assert.Equal(t, types.Halted, s.Status)
+	assert.Equal(t, types.Off, s.Temps.State[heaterHotend])
+	p.GCode("M999")
+	clock.advance(time.Second)
+	s = p.Status(2)
+	assert.Equal(t, types.Idle, s.Status)
+	assert.Equal(t, types.Time(1), s.UpTime)
+	assert.Equal(t, 100.0, s.Params.SpeedFactor)
+}
+
+func Test_GCodeMotion(t *testing.T) {
+	p, clock := newTestPrinter()
+	p.GCode("M109 S200\nG28\nG1 X0 Y0 Z100 F6000")
+	clock.advance(time.Minute)
+	assert.Equal(t, types.Idle, p.Status(1).Status)
+
+	// relative moves
+	p.GCode("G91\nG1 X10\nG1 X10 E2\nG90")
+	clock.advance(time.Second)
+	s := p.Status(1)
+	assert.Equal(t, []float64{20, 0, 100}, s.Coordinates.XYZ)
+	assert.Equal(t, []float64{2}, s.Coordinates.Extruder)
+
+	// setting the position
+	p.GCode("G92 X0 E0\nG1 X10 E1")
+	clock.advance(time.Second)
+	s = p.Status(1)
+	assert.Equal(t, []float64{10, 0, 100}, s.Coordinates.XYZ)
+	assert.Equal(t, []float64{3}, s.Coordinates.Extruder)
+
+	// relative extrusion with an extrusion factor
+	p.GCode("M83\nM221 S50\nG1 E4\nG1 E4")
+	clock.advance(time.Second)
+	assert.Equal(t, []float64{7}, p.Status(1).Coordinates.Extruder)
+
+	// the speed factor changes the speed of moves
+	p.GCode("M220 S200\nG1 X-50 F600")
+	s = p.Status(1)
+	assert.Equal(t, 20.0, s.Speeds.Requested)
+
+	// motors off loses the position
+	clock.advance(10 * time.Second)
+	p.GCode("M84")
+	assert.Equal(t, "Error: G0/G1: insufficient axes homed\n",
+		p.GCode("G1 X0"))
+}
+
+func Test_GCodeWaits(t *testing.T) {
+	p, clock := newTestPrinter()
+	assert.Equal(t, "", p.GCode("G4 S1\nM105"))
+	assert.Equal(t, types.Busy, p.Status(1).Status)
+	assert.Equal(t, 0, p.Status(1).Seq)
+	clock.advance(time.Second)
+	s := p.Status(1)
+	assert.Equal(t, types.Idle, s.Status)
+	assert.Equal(t, 1, s.Seq)
+	assert.Equal(t, "T:21.0 /0.0 B:21.0 /0.0\n", p.Reply())
+
+	p.GCode("G28\nM400\nM114")
+	clock.advance(3 * time.Second)
+	assert.Equal(t, 1, p.Status(1).Seq)
+	clock.advance(2 * time.Second)
+	assert.Equal(t, 2, p.Status(1).Seq)
+	assert.Equal(t, "X:0.000 Y:0.000 Z:200.000 E:0.000\n", p.Reply())
+}
+
+func Test_GCodeTools(t *testing.T) {
+	p, clock := newTestPrinter()
+	p.WithMachine(&Machine{
+		Name:      "two",
+		Geometry:  GeometryCartesian,
+		Tools:     2,
+		AxisMins:  [3]float64{0, 0, 0},
+		AxisMaxes: [3]float64{200, 200, 200},
+	})
+	assert.Equal(t, "", p.GCode("G10 P1 S210 R180\nM104 T0 S200\nG28"))
+	assert.Equal(t, "Error: T2: Invalid tool number\n", p.GCode("T2"))
+	s := p.Status(2)
+	assert.Equal(t, []types.TempState{types.Off, types.Active,
+		types.Standby, types.Off}, s.Temps.State)
+	assert.Equal(t, [][]float64{{200}, {210}}, s.Temps.Tools.Active)
+	assert.Equal(t, [][]float64{{0}, {180}}, s.Temps.Tools.Standby)
+	assert.Equal(t, "cartesian", s.Geometry)
+	assert.Equal(t, 2, len(s.Tools))
+	assert.Equal(t, []int{2}, s.Tools[1].Heaters)
+	assert.Equal(t, []int{1}, s.Tools[1].Drives)
+	assert.Equal(t, "T0:21.0 /200.0 T1:21.0 /210.0 B:21.0 /0.0\n",
+		p.GCode("M105"))
+
+	// homing to the minimum of the axes
+	clock.advance(10 * time.Second)
+	assert.Equal(t, []float64{0, 0, 0}, p.Status(1).Coordinates.XYZ)
+
+	// extrude with tool 0 then change to tool 1 after the moves
+	clock.advance(5 * time.Minute)
+	p.GCode("G1 X10 E5 F600\nT1\nG1 E2")
+	assert.Equal(t, 0, p.Status(1).CurrentTool)
+	clock.advance(5 * time.Second)
+	s = p.Status(2)
+	assert.Equal(t, 1, s.CurrentTool)
+	assert.Equal(t, []float64{5, 2}, s.Coordinates.Extruder)
+	assert.Equal(t, []float64{100, 100}, s.Params.ExtruderFactors)
+	assert.Equal(t, []types.TempState{types.Off, types.Standby,
+		types.Active, types.Off}, s.Temps.State)
+}
+
+func Test_GCodeCNC(t *testing.T) {
+	p, clock := newTestPrinter()
+	p.WithMachine(&Machine{
+		Name:      "cnc",
+		Geometry:  GeometryCartesian,
+		Tools:     1,
+		CNC:       true,
+		AxisMins:  [3]float64{0, 0, 0},
+		AxisMaxes: [3]float64{400, 300, 100},
+	})
+	assert.Equal(t, "Error: M140: No bed heater\n", p.GCode("M140 S60"))
+	assert.Equal(t, "Error: M104: Invalid tool number\n", p.GCode("M104 S200"))
+	assert.Equal(t, "\n", p.GCode("M105"))
+	p.GCode("G28\nM3 S12000")
+	clock.advance(10 * time.Second)
+	s := p.Status(2)
+	assert.Equal(t, []float64{0, 0, 100}, s.Coordinates.XYZ)
+	assert.Nil(t, s.Coordinates.Extruder)
+	assert.Equal(t, []types.Spindle{{Current: 12000, Active: 12000}},
+		s.Spindles)
+	assert.Nil(t, s.Tools[0].Heaters)
+	p.GCode("M4 S500")
+	assert.Equal(t, -500.0, p.Status(1).Spindles[0].Active)
+	p.GCode("M5")
+	assert.Equal(t, 0.0, p.Status(1).Spindles[0].Active)
+
+	p, _ = newTestPrinter()
+	assert.Equal(t, "Error: M3: Command is not supported\n", p.GCode("M3 S100"))
+}
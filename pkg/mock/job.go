@@ -0,0 +1,259 @@
+package mock
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// layerEpsilon is the smallest increase in height that starts a new
+// layer.
+const layerEpsilon = 0.001
+
+// jobInfo is the information about a G-code file found by scanning it.
+type jobInfo struct {
+	layers           int
+	firstLayerHeight float64
+	layerHeight      float64
+	height           float64
+	filament         float64
+}
+
+// scanJob finds the number of layers and the filament used by a G-code
+// file.  Like RepRapFirmware, a layer starts with the first extruding
+// move at a greater height.
+func scanJob(data []byte) *jobInfo {
+	info := &jobInfo{}
+	var z, e float64
+	relative, relativeE := false, false
+	for _, line := range strings.Split(string(data), "\n") {
+		c, err := parseGCode(line)
+		if err != nil || c == nil {
+			continue
+		}
+		switch c.String() {
+		case "G90":
+			relative, relativeE = false, false
+			continue
+		case "G91":
+			relative, relativeE = true, true
+			continue
+		case "M82":
+			relativeE = false
+			continue
+		case "M83":
+			relativeE = true
+			continue
+		case "G92":
+			if v, ok := c.params['Z']; ok {
+				z = v
+			}
+			if v, ok := c.params['E']; ok {
+				e = v
+			}
+			continue
+		case "G0", "G1":
+		default:
+			continue
+		}
+		if v, ok := c.params['Z']; ok {
+			if relative {
+				v += z
+			}
+			z = v
+		}
+		v, ok := c.params['E']
+		if !ok {
+			continue
+		}
+		de := v
+		if !relativeE {
+			de = v - e
+		}
+		e += de
+		if de <= 0 {
+			continue
+		}
+		info.filament += de
+		if info.layers == 0 || z > info.height+layerEpsilon {
+			info.layers++
+			switch info.layers {
+			case 1:
+				info.firstLayerHeight = z
+			case 2:
+				info.layerHeight = z - info.firstLayerHeight
+			}
+			info.height = z
+		}
+	}
+	return info
+}
+
+// job is a file being printed.
+type job struct {
+	name  string
+	info  *jobInfo
+	lines []string
+	size  int
+	// line is the index of the next line and pos its file position
+	line int
+	pos  int
+
+	start time.Duration
+	// warmUp is the time from the start to the first extruding move or
+	// -1 before then
+	warmUp             time.Duration
+	layer              int
+	layerZ             float64
+	layerStart         time.Duration
+	firstLayerDuration time.Duration
+	extruded           float64
+}
+
+func newJob(name string, data []byte, now time.Duration) *job {
+	return &job{
+		name:   name,
+		info:   scanJob(data),
+		lines:  strings.Split(string(data), "\n"),
+		size:   len(data),
+		start:  now,
+		warmUp: -1,
+	}
+}
+
+// moved updates the layer and filament used when a move from the job
+// is queued.
+func (j *job) moved(z, extruded float64, now time.Duration) {
+	if extruded <= 0 {
+		return
+	}
+	j.extruded += extruded
+	if j.warmUp < 0 {
+		j.warmUp = now - j.start
+	}
+	if j.layer == 0 || z > j.layerZ+layerEpsilon {
+		if j.layer == 1 {
+			j.firstLayerDuration = now - j.layerStart
+		}
+		j.layer++
+		j.layerZ = z
+		j.layerStart = now
+	}
+}
+
+// status adds the type 3 status properties of the job to s.
+func (j *job) status(s *types.StatusResponse, now time.Duration) {
+	elapsed := now - j.start
+	s.PrintDuration = seconds(elapsed)
+	s.FilePosition = j.pos
+	s.ExtrRaw = []float64{round(j.extruded)}
+	s.FirstLayerHeight = j.info.firstLayerHeight
+	f := 0.0
+	if j.size > 0 {
+		f = float64(j.pos) / float64(j.size)
+	}
+	s.FractionPrinted = math.Round(f*1000) / 10
+	if j.warmUp < 0 {
+		s.WarmUpDuration = seconds(elapsed)
+		return
+	}
+	s.WarmUpDuration = seconds(j.warmUp)
+	s.CurrentLayer = j.layer
+	s.CurrentLayerTime = seconds(now - j.layerStart)
+	s.FirstLayerDuration = seconds(j.firstLayerDuration)
+	if j.layer == 1 {
+		s.FirstLayerDuration = s.CurrentLayerTime
+	}
+
+	printing := (elapsed - j.warmUp).Seconds()
+	if f > 0 {
+		s.TimesLeft.File = types.Time(round(printing * (1 - f) / f))
+	}
+	if j.extruded > 0 && j.info.filament > j.extruded {
+		s.TimesLeft.Filament = types.Time(round(
+			printing * (j.info.filament - j.extruded) / j.extruded))
+	}
+	if j.layer > 1 && j.info.layers >= j.layer {
+		perLayer := (j.layerStart - j.start - j.warmUp).Seconds() /
+			float64(j.layer-1)
+		left := perLayer*float64(j.info.layers-j.layer+1) -
+			(now - j.layerStart).Seconds()
+		s.TimesLeft.Layer = types.Time(round(math.Max(0, left)))
+	}
+}
+
+func seconds(d time.Duration) types.Time {
+	return types.Time(round(d.Seconds()))
+}
+
+// gcodeFile returns the full name of a G-code file.  Names without a
+// volume are relative to 0:/gcodes.
+func gcodeFile(name string) string {
+	switch {
+	case strings.Contains(name, ":"):
+		return name
+	case strings.HasPrefix(name, "/"):
+		return "0:" + name
+	}
+	return "0:/gcodes/" + name
+}
+
+// readJob executes lines of the job until a move is queued, a command
+// waits or the job ends.  It returns true if a move was queued.
+func (p *Printer) readJob() bool {
+	j := p.job
+	if j == nil || p.state != types.Printing || p.wait != nil {
+		return false
+	}
+	for j.line < len(j.lines) {
+		line := j.lines[j.line]
+		j.line++
+		j.pos += len(line) + 1
+		if j.pos > j.size {
+			j.pos = j.size
+		}
+		// like the firmware, errors in files are reported but do not
+		// stop the print
+		_, _ = p.exec(line, true)
+		if len(p.moves) > 0 {
+			return true
+		}
+		if p.wait != nil || p.job != j || p.state != types.Printing {
+			return false
+		}
+	}
+	p.job = nil
+	p.state = ""
+	return false
+}
+
+// DemoJob returns a G-code file that heats the printer, homes and then
+// prints a cylinder of the given number of 0.2mm layers.
+func DemoJob(layers int) []byte {
+	return demoJob(layers, 0, 0)
+}
+
+// demoJob returns the demo job printing around the point x, y.
+func demoJob(layers int, x, y float64) []byte {
+	var b bytes.Buffer
+	b.WriteString("; generated by MockRRF\n")
+	b.WriteString("M140 S60\nM104 S200\nG28\nM190 S60\nM109 S200\n")
+	e := 0.0
+	for l := 1; l <= layers; l++ {
+		fmt.Fprintf(&b, ";LAYER:%d\n", l-1)
+		fmt.Fprintf(&b, "G1 X%.3f Y%.3f Z%.1f F6000\n", x+50, y,
+			float64(l)*0.2)
+		for a := 10; a <= 360; a += 10 {
+			rad := float64(a) * math.Pi / 180
+			e += 0.3
+			fmt.Fprintf(&b, "G1 X%.3f Y%.3f E%.2f F1800\n",
+				x+50*math.Cos(rad), y+50*math.Sin(rad), e)
+		}
+	}
+	b.WriteString("M104 S0\nM140 S0\nG28\n")
+	return b.Bytes()
+}
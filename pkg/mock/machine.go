@@ -0,0 +1,110 @@
+package mock
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// Geometries of machines.  The names are those reported in the type 2
+// status response.
+const (
+	GeometryDelta     = "delta"
+	GeometryCartesian = "cartesian"
+	GeometryCoreXY    = "coreXY"
+)
+
+// Machine describes the hardware of a simulated printer.
+type Machine struct {
+	// Name is the name of the machine reported in the status
+	Name     string
+	Geometry string
+	// Tools is the number of tools.  Each tool has its own extruder
+	// drive and heater except on CNC machines.
+	Tools int
+	// CNC machines have a spindle for each tool and no heaters
+	CNC       bool
+	AxisMins  [3]float64
+	AxisMaxes [3]float64
+}
+
+// DefaultMachine is the delta printer simulated by default.
+var DefaultMachine = &Machine{
+	Name:      "MockRRF",
+	Geometry:  GeometryDelta,
+	Tools:     1,
+	AxisMins:  [3]float64{-d, -d, 0},
+	AxisMaxes: [3]float64{d, d, 2 * d},
+}
+
+// configResponse returns the rr_config response for the machine.
+func (m *Machine) configResponse(f *Firmware) *types.ConfigResponse {
+	cr := f.configResponse()
+	cr.AxisMins = m.AxisMins[:]
+	cr.AxisMaxes = m.AxisMaxes[:]
+	return cr
+}
+
+// home is the position of the axes after homing.  A delta homes with
+// the effector at the top, a CNC machine homes the spindle up and
+// printers home to the minimum of each axis.
+func (m *Machine) home() [3]float64 {
+	switch {
+	case m.Geometry == GeometryDelta:
+		return [3]float64{0, 0, m.AxisMaxes[axisZ]}
+	case m.CNC:
+		return [3]float64{m.AxisMins[axisX], m.AxisMins[axisY],
+			m.AxisMaxes[axisZ]}
+	}
+	return m.AxisMins
+}
+
+// center is the center of the bed.
+func (m *Machine) center() (float64, float64) {
+	return (m.AxisMins[axisX] + m.AxisMaxes[axisX]) / 2,
+		(m.AxisMins[axisY] + m.AxisMaxes[axisY]) / 2
+}
+
+// tools returns the tools of the machine for the type 2 status.
+func (m *Machine) tools() []types.Tool {
+	tools := []types.Tool{}
+	for t := 0; t < m.Tools; t++ {
+		tool := types.Tool{
+			Number:  t,
+			AxisMap: [][]int{{0}, {1}},
+			Fans:    1,
+			Offsets: []float64{0, 0, 0},
+		}
+		if !m.CNC {
+			tool.Heaters = []int{t + 1}
+			tool.Drives = []int{t}
+		}
+		tools = append(tools, tool)
+	}
+	return tools
+}
+
+// demoJob returns the demo job for the machine, a cylinder printed, or
+// for a CNC machine milled, around the center of the bed.
+func (m *Machine) demoJob(layers int) []byte {
+	x, y := m.center()
+	if !m.CNC {
+		return demoJob(layers, x, y)
+	}
+	var b bytes.Buffer
+	b.WriteString("; generated by MockRRF\n")
+	b.WriteString("G28\nM3 S10000\n")
+	for l := 1; l <= layers; l++ {
+		fmt.Fprintf(&b, "G1 X%.3f Y%.3f Z%.1f F6000\n", x+50, y,
+			m.AxisMaxes[axisZ]-float64(l))
+		for a := 10; a <= 360; a += 10 {
+			rad := float64(a) * math.Pi / 180
+			fmt.Fprintf(&b, "G1 X%.3f Y%.3f F600\n",
+				x+50*math.Cos(rad), y+50*math.Sin(rad))
+		}
+	}
+	b.WriteString("M5\nG28\n")
+	return b.Bytes()
+}
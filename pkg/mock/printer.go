@@ -0,0 +1,585 @@
+package mock
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// Simulation constants.  The axis limits and feedrates match the
+// ConfigResponse.
+const (
+	// tick is the longest step of the simulation
+	tick = 100 * time.Millisecond
+	// ambient is the room temperature
+	ambient = 21.0
+	// heaterGain is the proportional gain of the heater controllers
+	heaterGain = 0.5
+	// temperatureTolerance is how close a heater must be to its target
+	// for M109 and M190 to stop waiting
+	temperatureTolerance = 1.0
+	// defaultFeed is the speed, in mm/s, of moves before any F
+	// parameter is given
+	defaultFeed = 50.0
+	// homingFeed is the speed, in mm/s, of homing moves
+	homingFeed = 50.0
+	// maxFeed is the fastest speed, in mm/s, of moves
+	maxFeed = 300.0
+	// coldExtrudeTemperature is the lowest hotend temperature at which
+	// the extruder is allowed to move
+	coldExtrudeTemperature = 160.0
+	// temperatureLimit is the temperature at which a heater faults
+	temperatureLimit = 290.0
+)
+
+// Axis indexes into positions.
+const (
+	axisX = iota
+	axisY
+	axisZ
+	axisE
+)
+
+// axisLetters are the G-code parameters for each axis.
+var axisLetters = [4]byte{'X', 'Y', 'Z', 'E'}
+
+// Heater indexes.  The heater of each tool follows the bed so
+// heaterHotend is the heater of tool 0.
+const (
+	heaterBed = iota
+	heaterHotend
+)
+
+// heater is a first order thermal model with a controller that drives
+// the temperature to the target with a little feed forward.
+type heater struct {
+	name    string
+	current float64
+	active  float64
+	standby float64
+	state   types.TempState
+	// rate is the heating rate in degrees per second at full power
+	rate float64
+	// tau is the time constant, in seconds, of cooling to ambient
+	tau float64
+	// runaway is set when the heater is stuck at full power
+	runaway bool
+}
+
+func newHeater(name string, rate, tau float64) *heater {
+	return &heater{name: name, current: ambient, rate: rate, tau: tau}
+}
+
+// target returns the temperature the heater is controlling to and
+// false if the heater is off.
+func (h *heater) target() (float64, bool) {
+	switch h.state {
+	case types.Active:
+		return h.active, true
+	case types.Standby:
+		return h.standby, true
+	}
+	return 0, false
+}
+
+// set sets the active temperature of the heater turning it off for
+// temperatures at or below zero.  A faulty heater stays off.
+func (h *heater) set(temp float64) {
+	if h.state == types.Fault {
+		return
+	}
+	h.active = temp
+	h.state = types.Active
+	if temp <= 0 {
+		h.active = 0
+		h.state = types.Off
+	}
+}
+
+// reached returns true if the heater is off or at its target.
+func (h *heater) reached() bool {
+	t, ok := h.target()
+	return !ok || math.Abs(h.current-t) <= temperatureTolerance
+}
+
+// fault turns the heater off until the fault is reset.
+func (h *heater) fault() {
+	h.state = types.Fault
+	h.runaway = false
+}
+
+func (h *heater) step(dt float64) {
+	power := 0.0
+	if t, ok := h.target(); ok {
+		power = (t-ambient)/(h.tau*h.rate) + heaterGain*(t-h.current)
+		power = math.Max(0, math.Min(1, power))
+	}
+	if h.runaway {
+		power = 1
+	}
+	h.current += (power*h.rate - (h.current-ambient)/h.tau) * dt
+	if h.current > temperatureLimit && h.state != types.Fault {
+		h.fault()
+	}
+}
+
+// move is a queued movement of the axes.
+type move struct {
+	to [4]float64
+	// speed in mm/s
+	speed float64
+	// home marks the axes as homed when the move completes
+	home bool
+}
+
+// Printer simulates a machine, by default a delta printer with a heated
+// bed, a single tool and a fan.  The simulation is advanced to the time
+// returned by the clock whenever the printer is accessed so the state
+// changes in real time unless another clock is given.  A Printer is
+// safe for concurrent use.
+type Printer struct {
+	mu       sync.Mutex
+	machine  *Machine
+	firmware *Firmware
+	clock    func() time.Time
+	last     time.Time
+	uptime   time.Duration
+
+	heaters []*heater
+	// spindles are the speeds of the spindles of a CNC machine
+	spindles []float64
+	fans     []float64
+	// tool is the selected tool or -1 if no tool is selected
+	tool            int
+	speedFactor     float64
+	extrusionFactor float64
+	// marlin is true when emulating Marlin
+	marlin bool
+	// halted is set by an emergency stop
+	halted bool
+
+	// pos is the machine position of the axes and extruder
+	pos   [4]float64
+	homed [3]bool
+	// planned is the position and homed state at the end of the
+	// queued moves
+	planned      [4]float64
+	plannedHomed [3]bool
+	// relative and relativeE are true when positions of the axes and
+	// the extruder are relative
+	relative  bool
+	relativeE bool
+	// extruder is the extruder position used by G-code before the
+	// extrusion factor is applied
+	extruder float64
+	// drives are the positions of the extruder drives of the tools that
+	// are not selected; the selected tool uses the E axis
+	drives []float64
+	// feed is the speed in mm/s of moves without an F parameter
+	feed  float64
+	moves []*move
+	// wait is set by commands that block further commands until a
+	// condition is met and pending holds the commands received while
+	// waiting
+	wait    func() bool
+	pending []string
+	// reply is the last reply and seq counts the replies
+	reply string
+	seq   int
+
+	sd       *SDCard
+	selected string
+	job      *job
+	// state is the job state: Printing, Pausing, Stopped or Resuming
+	state    types.Status
+	pausePos [4]float64
+}
+
+// NewPrinter returns an idle, unhomed printer at room temperature.
+func NewPrinter() *Printer {
+	p := &Printer{
+		machine:  DefaultMachine,
+		firmware: Firmware2,
+		clock:    time.Now,
+		last:     time.Now(),
+		sd:       NewSDCard(),
+	}
+	p.reset()
+	p.addDemo()
+	return p
+}
+
+// reset returns the printer to the state after it is turned on.  The
+// SD card is kept.
+func (p *Printer) reset() {
+	p.uptime = 0
+	p.heaters = nil
+	p.spindles = nil
+	if p.machine.CNC {
+		p.spindles = make([]float64, p.machine.Tools)
+	} else {
+		p.heaters = []*heater{newHeater("bed", 1, 400)}
+		for t := 0; t < p.machine.Tools; t++ {
+			p.heaters = append(p.heaters, newHeater("", 5, 80))
+		}
+	}
+	p.fans = []float64{0, 0}
+	p.tool = 0
+	if p.machine.Tools == 0 {
+		p.tool = -1
+	}
+	p.drives = nil
+	if !p.machine.CNC {
+		p.drives = make([]float64, p.machine.Tools)
+	}
+	p.speedFactor = 100
+	p.extrusionFactor = 100
+	p.marlin = false
+	p.halted = false
+	p.pos = [4]float64{}
+	p.homed = [3]bool{}
+	p.planned = p.pos
+	p.plannedHomed = p.homed
+	p.relative = false
+	p.relativeE = false
+	p.extruder = 0
+	p.feed = defaultFeed
+	p.moves = nil
+	p.wait = nil
+	p.pending = nil
+	p.selected = ""
+	p.job = nil
+	p.state = ""
+}
+
+// WithClock sets the clock used to advance the simulation.  Time starts
+// from the current time of the clock.
+func (p *Printer) WithClock(clock func() time.Time) *Printer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clock = clock
+	p.last = clock()
+	return p
+}
+
+// WithMachine sets the machine to simulate and resets the printer.  The
+// demo job is replaced by one suitable for the machine.
+func (p *Printer) WithMachine(m *Machine) *Printer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.machine = m
+	p.reset()
+	p.addDemo()
+	return p
+}
+
+// addDemo adds the demo job for the machine to the SD card.
+func (p *Printer) addDemo() {
+	_ = p.sd.WriteFile(gcodeFile("demo.gcode"), p.machine.demoJob(50),
+		time.Now())
+}
+
+// printingFile returns the name of the file being printed or the empty
+// string if there is none.
+func (p *Printer) printingFile() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sync()
+	if p.job == nil {
+		return ""
+	}
+	return p.job.name
+}
+
+// SD returns the SD card of the printer.
+func (p *Printer) SD() *SDCard {
+	return p.sd
+}
+
+// WithFirmware sets the firmware profile that determines the shape of
+// the status responses and the firmware details reported by M115.
+func (p *Printer) WithFirmware(f *Firmware) *Printer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.firmware = f
+	return p
+}
+
+// ScaledClock returns a clock that runs speed times faster than real
+// time.
+func ScaledClock(speed float64) func() time.Time {
+	start := time.Now()
+	return func() time.Time {
+		return start.Add(time.Duration(float64(time.Since(start)) * speed))
+	}
+}
+
+// AddFile adds a G-code file that can be printed to the SD card.
+// Names without a volume are relative to 0:/gcodes.  It does nothing if
+// the name is a directory.
+func (p *Printer) AddFile(name string, data []byte) {
+	_ = p.sd.WriteFile(gcodeFile(name), data, time.Now())
+}
+
+// sync advances the simulation to the current time of the clock.
+func (p *Printer) sync() {
+	now := p.clock()
+	d := now.Sub(p.last)
+	if d <= 0 {
+		return
+	}
+	p.last = now
+	for d > 0 {
+		dt := d
+		if dt > tick {
+			dt = tick
+		}
+		p.step(dt)
+		d -= dt
+	}
+}
+
+func (p *Printer) step(d time.Duration) {
+	p.uptime += d
+	dt := d.Seconds()
+	for _, h := range p.heaters {
+		faulted := h.state == types.Fault
+		h.step(dt)
+		if !faulted && h.state == types.Fault {
+			p.heaterFault()
+		}
+	}
+	if p.wait != nil && p.wait() {
+		p.wait = nil
+		p.runPending()
+	}
+	for dt > 0 {
+		if len(p.moves) == 0 && !p.readJob() {
+			break
+		}
+		if len(p.moves) == 0 {
+			continue
+		}
+		m := p.moves[0]
+		dist := distance(p.pos, m.to)
+		need := dist / m.speed
+		if need > dt {
+			f := dt / need
+			for i := range p.pos {
+				p.pos[i] += (m.to[i] - p.pos[i]) * f
+			}
+			break
+		}
+		dt -= need
+		p.pos = m.to
+		if m.home {
+			p.homed = [3]bool{true, true, true}
+		}
+		p.moves = p.moves[1:]
+	}
+	if len(p.moves) > 0 {
+		return
+	}
+	switch p.state {
+	case types.Pausing:
+		p.state = types.Stopped
+		p.pausePos = p.pos
+	case types.Resuming:
+		p.state = types.Printing
+	}
+}
+
+// heaterFault pauses the print, like the firmware, when a heater
+// faults.
+func (p *Printer) heaterFault() {
+	if p.job != nil && (p.state == types.Printing || p.state == types.Resuming) {
+		p.state = types.Pausing
+	}
+	p.wait = nil
+	p.pending = nil
+}
+
+// toolHeater returns the heater of tool t or nil if the tool does not
+// exist or has no heater.
+func (p *Printer) toolHeater(t int) *heater {
+	if p.machine.CNC || t < 0 || t >= p.machine.Tools {
+		return nil
+	}
+	return p.heaters[heaterHotend+t]
+}
+
+// bed returns the bed heater or nil if there is no bed heater.
+func (p *Printer) bed() *heater {
+	if len(p.heaters) == 0 {
+		return nil
+	}
+	return p.heaters[heaterBed]
+}
+
+// do advances the simulation and calls f with the printer locked.
+func (p *Printer) do(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sync()
+	f()
+}
+
+// distance returns the length of the move between a and b, or the
+// extruder movement for extruder only moves.
+func distance(a, b [4]float64) float64 {
+	dx, dy, dz := b[axisX]-a[axisX], b[axisY]-a[axisY], b[axisZ]-a[axisZ]
+	d := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	if d == 0 {
+		d = math.Abs(b[axisE] - a[axisE])
+	}
+	return d
+}
+
+// queue adds a move to the end of the queue.
+func (p *Printer) queue(m *move) {
+	p.moves = append(p.moves, m)
+	p.planned = m.to
+	if m.home {
+		p.plannedHomed = [3]bool{true, true, true}
+	}
+}
+
+// status returns the status code of the printer.
+func (p *Printer) status() types.Status {
+	if p.halted {
+		return types.Halted
+	}
+	if p.job != nil {
+		return p.state
+	}
+	if len(p.moves) > 0 || p.wait != nil {
+		return types.Busy
+	}
+	return types.Idle
+}
+
+// Config returns the rr_config response for the machine and firmware.
+func (p *Printer) Config() *types.ConfigResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.machine.configResponse(p.firmware)
+}
+
+// Status returns a status response of the given type, 1, 2 or 3.
+func (p *Printer) Status(kind int) *types.StatusResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sync()
+	return p.statusResponse(kind)
+}
+
+// FullStatus returns a type 2 status response with the type 3
+// properties added in the same way as netrrf.Client.FullStatus.
+func (p *Printer) FullStatus() *types.StatusResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sync()
+	return mergeStatus(p.statusResponse(2), p.statusResponse(3))
+}
+
+func (p *Printer) statusResponse(kind int) *types.StatusResponse {
+	s := staticStatus(kind)
+	s.Status = p.status()
+	s.Seq = p.seq
+	s.UpTime = types.Time(round(p.uptime.Seconds()))
+
+	xyz := []float64{round(p.pos[axisX]), round(p.pos[axisY]),
+		round(p.pos[axisZ])}
+	s.Coordinates.XYZ = xyz
+	s.Coordinates.Machine = xyz
+	s.Coordinates.Extruder = nil
+	for t, e := range p.drives {
+		if t == p.tool {
+			e = p.pos[axisE]
+		}
+		s.Coordinates.Extruder = append(s.Coordinates.Extruder, round(e))
+	}
+	s.Coordinates.AxesHomed = []types.RRFBool{
+		types.RRFBool(p.homed[axisX]),
+		types.RRFBool(p.homed[axisY]),
+		types.RRFBool(p.homed[axisZ]),
+	}
+	if len(p.moves) > 0 {
+		s.Speeds.Requested = round(p.moves[0].speed)
+		s.Speeds.Top = round(p.moves[0].speed)
+	} else {
+		s.Speeds = types.Speeds{}
+	}
+	s.CurrentTool = p.tool
+	s.Params.FanPercent = append([]float64{}, p.fans...)
+	s.Params.SpeedFactor = p.speedFactor
+	s.Params.ExtruderFactors = nil
+	for range p.drives {
+		s.Params.ExtruderFactors = append(s.Params.ExtruderFactors,
+			p.extrusionFactor)
+	}
+
+	// absent heaters are reported as off at 2000C
+	n := len(p.heaters)
+	if n < 4 {
+		n = 4
+	}
+	s.Temps.Current = make([]float64, n)
+	s.Temps.State = make([]types.TempState, n)
+	s.Temps.Names = make([]string, n)
+	for i := range s.Temps.Current {
+		s.Temps.Current[i] = 2000
+	}
+	for i, h := range p.heaters {
+		s.Temps.Current[i] = math.Round(h.current*10) / 10
+		s.Temps.State[i] = h.state
+		s.Temps.Names[i] = h.name
+	}
+	s.Temps.Tools = types.ToolTemps{}
+	for t := 0; t < p.machine.Tools; t++ {
+		if h := p.toolHeater(t); h != nil {
+			s.Temps.Tools.Active = append(s.Temps.Tools.Active,
+				[]float64{h.active})
+			s.Temps.Tools.Standby = append(s.Temps.Tools.Standby,
+				[]float64{h.standby})
+		}
+	}
+	for t, rpm := range p.spindles {
+		s.Spindles = append(s.Spindles, types.Spindle{
+			Current: rpm, Active: rpm, Tool: t})
+	}
+	// fans without a tachometer read 0 before RepRapFirmware 3 and -1
+	// after
+	s.Sensors.FanRPM = types.FanRPMs{0}
+	if p.firmware.Version3 {
+		if bed := p.bed(); bed != nil {
+			s.Temps.Bed = types.Temp{
+				Current: s.Temps.Current[heaterBed],
+				Active:  bed.active,
+				Standby: bed.standby,
+				State:   bed.state,
+			}
+		}
+		n := len(p.heaters)
+		s.Temps.Current = s.Temps.Current[:n]
+		s.Temps.State = s.Temps.State[:n]
+		s.Temps.Names = s.Temps.Names[:n]
+		s.Sensors.FanRPM = types.FanRPMs{}
+		for range p.fans {
+			s.Sensors.FanRPM = append(s.Sensors.FanRPM, -1)
+		}
+	}
+	if kind == 2 {
+		s.FirmwareName = p.firmware.FirmwareName
+		s.Name = p.machine.Name
+		s.Geometry = p.machine.Geometry
+		s.Tools = p.machine.tools()
+	}
+
+	if kind == 3 && p.job != nil {
+		p.job.status(s, p.uptime)
+	}
+	return s
+}
@@ -0,0 +1,268 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestPrinter() (*Printer, *testClock) {
+	clock := &testClock{now: time.Now()}
+	return NewPrinter().WithClock(clock.Now), clock
+}
+
+func Test_PrinterHeating(t *testing.T) {
+	p, clock := newTestPrinter()
+	s := p.Status(1)
+	assert.Equal(t, []float64{ambient, ambient, 2000, 2000}, s.Temps.Current)
+	assert.Equal(t, types.Idle, s.Status)
+
+	assert.Equal(t, "", p.GCode("M140 S60\nM104 S200"))
+	clock.advance(10 * time.Second)
+	s = p.Status(1)
+	assert.Equal(t, []types.TempState{
+		types.Active, types.Active, types.Off, types.Off}, s.Temps.State)
+	assert.Greater(t, s.Temps.Current[heaterBed], 25.0)
+	assert.Less(t, s.Temps.Current[heaterBed], 60.0)
+	assert.Greater(t, s.Temps.Current[heaterHotend], 60.0)
+	assert.Less(t, s.Temps.Current[heaterHotend], 200.0)
+	assert.Equal(t, [][]float64{{200}}, s.Temps.Tools.Active)
+
+	clock.advance(5 * time.Minute)
+	s = p.Status(1)
+	assert.InDelta(t, 60, s.Temps.Current[heaterBed], 0.5)
+	assert.InDelta(t, 200, s.Temps.Current[heaterHotend], 0.5)
+
+	p.GCode("M104 S0")
+	clock.advance(time.Minute)
+	s = p.Status(1)
+	assert.Equal(t, types.Off, s.Temps.State[heaterHotend])
+	assert.Less(t, s.Temps.Current[heaterHotend], 150.0)
+
+	// M190 waits until the bed reaches the temperature
+	p.GCode("M190 S80")
+	assert.Equal(t, types.Busy, p.Status(1).Status)
+	clock.advance(5 * time.Minute)
+	assert.Equal(t, types.Idle, p.Status(1).Status)
+}
+
+func Test_PrinterMotion(t *testing.T) {
+	p, clock := newTestPrinter()
+	assert.Equal(t, "Error: G0/G1: insufficient axes homed\n",
+		p.GCode("G1 X10"))
+
+	p.GCode("G28")
+	clock.advance(2 * time.Second)
+	s := p.Status(1)
+	assert.Equal(t, types.Busy, s.Status)
+	assert.Equal(t, []float64{0, 0, 100}, s.Coordinates.XYZ)
+	assert.Equal(t, []types.RRFBool{false, false, false},
+		s.Coordinates.AxesHomed)
+	assert.Equal(t, float64(homingFeed), s.Speeds.Requested)
+
+	// moves queue behind the homing move
+	assert.Equal(t, "", p.GCode("G1 X10 Z190 F600"))
+	clock.advance(2 * time.Second)
+	s = p.Status(1)
+	assert.Equal(t, []types.RRFBool{true, true, true},
+		s.Coordinates.AxesHomed)
+	assert.Equal(t, types.Busy, s.Status)
+	clock.advance(2 * time.Second)
+	s = p.Status(1)
+	assert.Equal(t, types.Idle, s.Status)
+	assert.Equal(t, []float64{10, 0, 190}, s.Coordinates.XYZ)
+
+	// moves are limited to the axis limits
+	p.GCode("G1 X500 F30000")
+	clock.advance(time.Second)
+	assert.Equal(t, []float64{100, 0, 190}, p.Status(1).Coordinates.XYZ)
+
+	// the extruder does not move until the hotend is hot
+	assert.Equal(t, "Warning: Tool 0 was not driven because its heater temperatures were not high enough\n",
+		p.GCode("G1 E10"))
+	p.GCode("M109 S200\nG1 E10 F300")
+	clock.advance(5 * time.Minute)
+	assert.Equal(t, []float64{10}, p.Status(1).Coordinates.Extruder)
+}
+
+// testJob prints three layers of a 10mm line.
+const testJob = `; test job
+M104 S200
+G28
+M109 S200
+G1 X0 Y0 Z0.3 F6000
+G1 X10 E1 F600
+G1 Z0.5
+G1 X0 E2
+G1 Z0.7
+G1 X10 E3
+G1 Z10
+`
+
+func Test_ScanJob(t *testing.T) {
+	assert.Equal(t, &jobInfo{
+		layers:           3,
+		firstLayerHeight: 0.3,
+		layerHeight:      0.2,
+		height:           0.7,
+		filament:         3,
+	}, scanJob([]byte(testJob)))
+	info := scanJob(DemoJob(5))
+	assert.Equal(t, 5, info.layers)
+	assert.InDelta(t, 0.2, info.layerHeight, 0.0001)
+	assert.InDelta(t, 54, info.filament, 0.0001)
+}
+
+func Test_PrinterJob(t *testing.T) {
+	p, clock := newTestPrinter()
+	assert.Equal(t, "Error: M32: GCode file \"0:/gcodes/test.gcode\" not found\n",
+		p.GCode(`M32 "test.gcode"`))
+	assert.Equal(t, "Error: M24: Cannot print, because no file is selected!\n",
+		p.GCode("M24"))
+	assert.Equal(t, "Error: M25: Cannot pause print, because no file is being printed!\n",
+		p.GCode("M25"))
+
+	p.AddFile("test.gcode", []byte(testJob))
+	assert.Equal(t, "", p.GCode(`M32 "test.gcode"`))
+	s := p.Status(3)
+	assert.Equal(t, types.Printing, s.Status)
+	assert.Equal(t, 0, s.CurrentLayer)
+	assert.Equal(t, "Error: M32: Cannot set file to print, because a file is already being printed\n",
+		p.GCode(`M32 "test.gcode"`))
+
+	// heating and homing
+	clock.advance(30 * time.Second)
+	s = p.Status(3)
+	assert.Equal(t, types.Printing, s.Status)
+	assert.Equal(t, 0, s.CurrentLayer)
+	assert.Equal(t, types.Time(30), s.WarmUpDuration)
+	assert.Equal(t, types.Time(30), s.PrintDuration)
+
+	s = advanceUntil(t, p, clock, func(s *types.StatusResponse) bool {
+		return s.CurrentLayer == 1
+	})
+	assert.Equal(t, types.Printing, s.Status)
+	assert.Equal(t, 0.3, s.FirstLayerHeight)
+	assert.Greater(t, float64(s.WarmUpDuration), 30.0)
+
+	// the first layer takes one second
+	clock.advance(1500 * time.Millisecond)
+	s = p.Status(3)
+	assert.Equal(t, 2, s.CurrentLayer)
+	assert.Greater(t, float64(s.TimesLeft.File), 0.0)
+	assert.Greater(t, float64(s.TimesLeft.Layer), 0.0)
+	assert.Greater(t, float64(s.TimesLeft.Filament), 0.0)
+	assert.InDelta(t, 1, float64(s.FirstLayerDuration), 0.11)
+
+	assert.Equal(t, "Error: M0: Pause the print before attempting to cancel it\n",
+		p.GCode("M0"))
+	p.GCode("M25")
+	assert.Equal(t, types.Pausing, p.Status(1).Status)
+	clock.advance(time.Second)
+	s = p.Status(3)
+	assert.Equal(t, types.Stopped, s.Status)
+	p.GCode("G1 X50 F6000")
+	clock.advance(time.Minute)
+	s = p.Status(3)
+	assert.Equal(t, types.Stopped, s.Status)
+	assert.Equal(t, 2, s.CurrentLayer)
+
+	p.GCode("M24")
+	assert.Equal(t, types.Resuming, p.Status(1).Status)
+	clock.advance(10 * time.Millisecond)
+	assert.Equal(t, types.Resuming, p.Status(1).Status)
+	s = advanceUntil(t, p, clock, func(s *types.StatusResponse) bool {
+		return s.Status != types.Resuming
+	})
+	assert.Equal(t, types.Printing, s.Status)
+
+	clock.advance(time.Minute)
+	s = p.Status(3)
+	assert.Equal(t, types.Idle, s.Status)
+	assert.Equal(t, 0, s.CurrentLayer)
+	assert.Equal(t, []float64{10, 0, 10}, s.Coordinates.XYZ)
+	assert.Equal(t, []float64{3}, s.Coordinates.Extruder)
+}
+
+// advanceUntil advances the clock in small steps until the status
+// satisfies cond.
+func advanceUntil(t *testing.T, p *Printer, clock *testClock, cond func(*types.StatusResponse) bool) *types.StatusResponse {
+	for i := 0; i < 10000; i++ {
+		s := p.Status(3)
+		if cond(s) {
+			return s
+		}
+		clock.advance(tick)
+	}
+	t.Fatal("condition not met")
+	return nil
+}
+
+func Test_PrinterCancel(t *testing.T) {
+	p, clock := newTestPrinter()
+	p.AddFile("0:/gcodes/test.gcode", []byte(testJob))
+	assert.Equal(t, "File 0:/gcodes/test.gcode selected for printing\n",
+		p.GCode("M23 /gcodes/test.gcode"))
+	p.GCode("M24")
+	advanceUntil(t, p, clock, func(s *types.StatusResponse) bool {
+		return s.CurrentLayer == 1
+	})
+	p.GCode("M25")
+	clock.advance(time.Second)
+	assert.Equal(t, types.Stopped, p.Status(1).Status)
+	assert.Equal(t, "", p.GCode("M0"))
+	clock.advance(time.Second)
+	s := p.Status(3)
+	assert.Equal(t, types.Idle, s.Status)
+	assert.Equal(t, types.Off, s.Temps.State[heaterHotend])
+	assert.Equal(t, 0, s.CurrentLayer)
+}
+
+func Test_MockRRFGCode(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(m.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	ctx := context.Background()
+	c := netrrf.NewClient(host, "passw0rd")
+	reply, err := c.SendGCode(ctx, "G1 X10", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "Error: G0/G1: insufficient axes homed\n", reply)
+
+	reply, err = c.SendGCode(ctx, `M32 "demo.gcode"`, 100*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "", reply)
+	s, err := c.Status(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, types.Printing, s.Status)
+}
@@ -0,0 +1,149 @@
+package mock
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+)
+
+// ReplayMode is how recorded responses are matched to requests.
+type ReplayMode string
+
+const (
+	// ReplayOrder serves the recorded responses in the order they were
+	// recorded and rejects requests that differ from the next one
+	ReplayOrder ReplayMode = "order"
+	// ReplayURL serves the responses recorded for the URL of each
+	// request in turn, repeating the last one
+	ReplayURL ReplayMode = "url"
+)
+
+// ReplayModeByName returns the replay mode with the given name.
+func ReplayModeByName(name string) (ReplayMode, error) {
+	switch m := ReplayMode(name); m {
+	case ReplayOrder, ReplayURL:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown replay mode '%s', should be one of %s, %s",
+		name, ReplayOrder, ReplayURL)
+}
+
+// Replay serves responses recorded from a real device by a
+// netrrf.Recorder.
+type Replay struct {
+	logger    *log.Logger
+	mode      ReplayMode
+	exchanges []*netrrf.Exchange
+	// next is the index of the next exchange in order mode or the
+	// index of the next exchange of each URL in URL mode
+	next    int
+	nextURL map[string]int
+	byURL   map[string][]*netrrf.Exchange
+	latency bool
+	mu      sync.Mutex
+}
+
+// NewReplay returns a replay of the exchanges.
+func NewReplay(logger *log.Logger, exchanges []*netrrf.Exchange, mode ReplayMode) *Replay {
+	r := &Replay{
+		logger:    logger,
+		mode:      mode,
+		exchanges: exchanges,
+		nextURL:   map[string]int{},
+		byURL:     map[string][]*netrrf.Exchange{},
+	}
+	for _, e := range exchanges {
+		key := e.Method + " " + e.URL
+		r.byURL[key] = append(r.byURL[key], e)
+	}
+	return r
+}
+
+// ReadReplay returns a replay of the recording in the file.
+func ReadReplay(logger *log.Logger, path string, mode ReplayMode) (*Replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+	defer f.Close()
+	exchanges, err := netrrf.ReadExchanges(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse recording %s: %w", path, err)
+	}
+	return NewReplay(logger, exchanges, mode), nil
+}
+
+// WithLatency makes responses take as long as they did when they were
+// recorded.
+func (r *Replay) WithLatency(latency bool) *Replay {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latency = latency
+	return r
+}
+
+// exchange returns the recorded exchange for a request or an error
+// describing why there is none.
+func (r *Replay) exchange(req *http.Request) (*netrrf.Exchange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := req.Method + " " + netrrf.RedactURL(req.URL)
+	if r.mode == ReplayOrder {
+		if r.next >= len(r.exchanges) {
+			return nil, fmt.Errorf("replay finished")
+		}
+		e := r.exchanges[r.next]
+		if e.Method+" "+e.URL != key {
+			return nil, fmt.Errorf("unexpected request %s, expected %s %s",
+				key, e.Method, e.URL)
+		}
+		r.next++
+		return e, nil
+	}
+	recorded := r.byURL[key]
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("no recording of %s", key)
+	}
+	i := r.nextURL[key]
+	if i < len(recorded)-1 {
+		r.nextURL[key] = i + 1
+	}
+	return recorded[i], nil
+}
+
+// ServeHTTP serves the recorded response for the request.  Requests
+// that failed when recorded fail by closing the connection.
+func (r *Replay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.logger.Print("Request: ", req.URL)
+	e, err := r.exchange(req)
+	if err != nil {
+		r.logger.Print(err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	r.mu.Lock()
+	latency := r.latency
+	r.mu.Unlock()
+	if latency {
+		select {
+		case <-time.After(e.Duration):
+		case <-req.Context().Done():
+			return
+		}
+	}
+	if e.Error != "" {
+		panic(http.ErrAbortHandler)
+	}
+	if e.ContentType != "" {
+		w.Header().Set("Content-Type", e.ContentType)
+	}
+	w.WriteHeader(e.Status)
+	if _, err := w.Write([]byte(e.Body)); err != nil {
+		r.logger.Printf("failed to write response to %s: %v\n", e.URL, err)
+	}
+}
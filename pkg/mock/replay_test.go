@@ -0,0 +1,132 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// record returns the exchanges of a session with a mock printing the
+// demo job.
+func record(t *testing.T) []*netrrf.Exchange {
+	var logBuf, buf bytes.Buffer
+	m := NewMockRRF(log.New(&logBuf, "", 0))
+	m.Printer().GCode(`M32 "demo.gcode"`)
+	ts := httptest.NewServer(m.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	c := netrrf.NewClient(host, "reprap").
+		WithHTTPClient(netrrf.NewRecorder(http.DefaultClient, &buf))
+	ctx := context.Background()
+	_, err := c.Config(ctx)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = c.Status(ctx, 1)
+		require.NoError(t, err)
+		_, err = c.Status(ctx, 3)
+		require.NoError(t, err)
+	}
+	exchanges, err := netrrf.ReadExchanges(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 6, len(exchanges))
+	return exchanges
+}
+
+func Test_ReplayModeByName(t *testing.T) {
+	mode, err := ReplayModeByName("url")
+	require.NoError(t, err)
+	assert.Equal(t, ReplayURL, mode)
+	_, err = ReplayModeByName("random")
+	assert.EqualError(t, err,
+		"unknown replay mode 'random', should be one of order, url")
+}
+
+func Test_Replay(t *testing.T) {
+	exchanges := record(t)
+
+	tests := []struct {
+		name  string
+		mode  ReplayMode
+		calls func(*testing.T, *netrrf.Client)
+	}{
+		{
+			name: "order",
+			mode: ReplayOrder,
+			calls: func(t *testing.T, c *netrrf.Client) {
+				ctx := context.Background()
+				_, err := c.Config(ctx)
+				require.NoError(t, err)
+				s, err := c.Status(ctx, 1)
+				require.NoError(t, err)
+				assert.Equal(t, types.Printing, s.Status)
+				_, err = c.Status(ctx, 1)
+				assert.Error(t, err, "expected type 3")
+				s, err = c.Status(ctx, 3)
+				require.NoError(t, err)
+				assert.NotZero(t, s.FilePosition)
+			},
+		},
+		{
+			name: "url",
+			mode: ReplayURL,
+			calls: func(t *testing.T, c *netrrf.Client) {
+				ctx := context.Background()
+				var last types.Time
+				for i := 0; i < 4; i++ {
+					s, err := c.Status(ctx, 1)
+					require.NoError(t, err)
+					assert.GreaterOrEqual(t, s.UpTime, last)
+					last = s.UpTime
+				}
+				_, err := c.Status(ctx, 2)
+				assert.Error(t, err, "not recorded")
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			r := NewReplay(log.New(&buf, "", 0), exchanges, tc.mode)
+			ts := httptest.NewServer(r)
+			defer ts.Close()
+			host := strings.Split(ts.URL, "://")[1]
+			c := netrrf.NewClient(host, "reprap").WithTimeout(time.Second)
+			tc.calls(t, c)
+		})
+	}
+}
+
+func Test_ReplayFailures(t *testing.T) {
+	exchanges := []*netrrf.Exchange{
+		{Method: "GET", URL: "/rr_connect?password=********",
+			Status: 200, Body: `{"err":0}`},
+		{Method: "GET", URL: "/rr_status?type=1",
+			Duration: 50 * time.Millisecond, Error: "timeout"},
+	}
+	var buf bytes.Buffer
+	r := NewReplay(log.New(&buf, "", 0), exchanges, ReplayOrder).
+		WithLatency(true)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+	c := netrrf.NewClient(host, "any").WithTimeout(time.Second)
+	ctx := context.Background()
+	start := time.Now()
+	_, err := c.Status(ctx, 1)
+	assert.Error(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	_, err = c.Status(ctx, 1)
+	assert.Error(t, err, "replay finished")
+}
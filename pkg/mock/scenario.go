@@ -0,0 +1,368 @@
+package mock
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// Action is a scenario event.
+type Action string
+
+// Scenario actions.  The printer actions happen once at the time of the
+// event.  The network actions affect requests received during the
+// duration of the event or, for a zero duration, all later requests.
+const (
+	// ActionHeaterFault faults a heater, turning it off and pausing any
+	// print, until it is reset with M562
+	ActionHeaterFault Action = "heater-fault"
+	// ActionThermalRunaway leaves a heater stuck at full power until it
+	// faults at the temperature limit
+	ActionThermalRunaway Action = "thermal-runaway"
+	// ActionEmergencyStop halts the printer as if M112 was sent
+	ActionEmergencyStop Action = "emergency-stop"
+	// ActionReboot restarts the board, clearing the printer state and
+	// the session.  Requests are dropped for the duration of the event.
+	ActionReboot Action = "reboot"
+	// ActionLatency delays responses by the latency of the event
+	ActionLatency Action = "latency"
+	// ActionTimeout never responds to requests
+	ActionTimeout Action = "timeout"
+	// ActionTruncate sends only the first half of responses
+	ActionTruncate Action = "truncate"
+	// ActionBusy responds with 503 Service Unavailable
+	ActionBusy Action = "busy"
+	// ActionDisconnect closes connections without responding
+	ActionDisconnect Action = "disconnect"
+)
+
+// network returns true for actions that affect requests for the
+// duration of the event.
+func (a Action) network() bool {
+	switch a {
+	case ActionLatency, ActionTimeout, ActionTruncate, ActionBusy,
+		ActionDisconnect:
+		return true
+	}
+	return false
+}
+
+// timeoutHold is the longest time a request is held by a timeout event
+// if the client does not give up first.
+var timeoutHold = time.Minute
+
+// Event is a scheduled change to the behaviour of the mock.
+type Event struct {
+	// At is the time of the event from the start of the scenario
+	At       time.Duration `yaml:"at"`
+	Action   Action        `yaml:"action"`
+	Duration time.Duration `yaml:"duration"`
+	// Heater is the heater affected by heater-fault and thermal-runaway
+	Heater int `yaml:"heater"`
+	// Latency is the delay added to responses by latency
+	Latency time.Duration `yaml:"latency"`
+	// Path limits network actions to requests for the path, such as
+	// /rr_status, if it is not empty
+	Path string `yaml:"path"`
+}
+
+// Scenario is a list of events that inject faults into the mock.  A
+// scenario can be read from a YAML file:
+//
+//	events:
+//	  - at: 10s
+//	    action: busy
+//	    duration: 5s
+//	  - at: 30s
+//	    action: heater-fault
+//	    heater: 1
+//
+// or built in Go:
+//
+//	NewScenario().Busy(10*time.Second, 5*time.Second).HeaterFault(30*time.Second, 1)
+type Scenario struct {
+	Events []*Event `yaml:"events"`
+}
+
+// NewScenario returns an empty scenario.
+func NewScenario() *Scenario {
+	return &Scenario{}
+}
+
+// ReadScenario reads a scenario from a YAML file.
+func ReadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scenario file: %w", err)
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var s Scenario
+	err = dec.Decode(&s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse scenario file %s: %w", path, err)
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario file %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// Validate checks the events of the scenario.
+func (s *Scenario) Validate() error {
+	for i, e := range s.Events {
+		switch e.Action {
+		case ActionHeaterFault, ActionThermalRunaway:
+			if e.Heater < 0 {
+				return fmt.Errorf("event %d: invalid heater %d", i+1, e.Heater)
+			}
+		case ActionLatency:
+			if e.Latency <= 0 {
+				return fmt.Errorf("event %d: latency must be positive", i+1)
+			}
+		case ActionEmergencyStop, ActionReboot, ActionTimeout,
+			ActionTruncate, ActionBusy, ActionDisconnect:
+		default:
+			return fmt.Errorf("event %d: unknown action %q", i+1, e.Action)
+		}
+		if e.At < 0 || e.Duration < 0 {
+			return fmt.Errorf("event %d: times must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+func (s *Scenario) add(e *Event) *Scenario {
+	s.Events = append(s.Events, e)
+	return s
+}
+
+// HeaterFault adds a fault of the heater at the given time.
+func (s *Scenario) HeaterFault(at time.Duration, heater int) *Scenario {
+	return s.add(&Event{At: at, Action: ActionHeaterFault, Heater: heater})
+}
+
+// ThermalRunaway adds a thermal runaway of the heater at the given time.
+func (s *Scenario) ThermalRunaway(at time.Duration, heater int) *Scenario {
+	return s.add(&Event{At: at, Action: ActionThermalRunaway, Heater: heater})
+}
+
+// EmergencyStop adds an emergency stop at the given time.
+func (s *Scenario) EmergencyStop(at time.Duration) *Scenario {
+	return s.add(&Event{At: at, Action: ActionEmergencyStop})
+}
+
+// Reboot adds a reboot at the given time.  The board does not respond
+// while it is down.
+func (s *Scenario) Reboot(at, down time.Duration) *Scenario {
+	return s.add(&Event{At: at, Action: ActionReboot, Duration: down})
+}
+
+// Latency adds a delay to responses.
+func (s *Scenario) Latency(at, duration, latency time.Duration) *Scenario {
+	return s.add(&Event{At: at, Action: ActionLatency, Duration: duration,
+		Latency: latency})
+}
+
+// Timeout adds a period when requests are not answered.
+func (s *Scenario) Timeout(at, duration time.Duration) *Scenario {
+	return s.add(&Event{At: at, Action: ActionTimeout, Duration: duration})
+}
+
+// Truncate adds a period when responses are cut short.
+func (s *Scenario) Truncate(at, duration time.Duration) *Scenario {
+	return s.add(&Event{At: at, Action: ActionTruncate, Duration: duration})
+}
+
+// Busy adds a period when requests get 503 responses.
+func (s *Scenario) Busy(at, duration time.Duration) *Scenario {
+	return s.add(&Event{At: at, Action: ActionBusy, Duration: duration})
+}
+
+// Disconnect adds a period when connections are closed without a
+// response.
+func (s *Scenario) Disconnect(at, duration time.Duration) *Scenario {
+	return s.add(&Event{At: at, Action: ActionDisconnect, Duration: duration})
+}
+
+// OnPath limits the last event added to requests for the given path.
+func (s *Scenario) OnPath(path string) *Scenario {
+	if len(s.Events) > 0 {
+		s.Events[len(s.Events)-1].Path = path
+	}
+	return s
+}
+
+// scenarioRun is a scenario being played by the mock.
+type scenarioRun struct {
+	events []*Event
+	start  time.Time
+	// fired is the number of events whose start has been handled
+	fired int
+}
+
+func newScenarioRun(s *Scenario, start time.Time) *scenarioRun {
+	events := append([]*Event{}, s.Events...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].At < events[j].At
+	})
+	return &scenarioRun{events: events, start: start}
+}
+
+// due returns the events that have started since the last call.
+func (run *scenarioRun) due(now time.Time) []*Event {
+	elapsed := now.Sub(run.start)
+	i := run.fired
+	for run.fired < len(run.events) && run.events[run.fired].At <= elapsed {
+		run.fired++
+	}
+	return run.events[i:run.fired]
+}
+
+// active returns the started events that are still in effect for a
+// request for the path.
+func (run *scenarioRun) active(now time.Time, path string) []*Event {
+	elapsed := now.Sub(run.start)
+	var res []*Event
+	for _, e := range run.events[:run.fired] {
+		switch {
+		case e.Path != "" && e.Path != path:
+		case e.Action == ActionReboot:
+			if elapsed < e.At+e.Duration {
+				res = append(res, e)
+			}
+		case e.Action.network():
+			if e.Duration == 0 || elapsed < e.At+e.Duration {
+				res = append(res, e)
+			}
+		}
+	}
+	return res
+}
+
+// WithScenario plays the scenario from the current time of the clock.
+func (m *MockRRF) WithScenario(s *Scenario) *MockRRF {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scenario = newScenarioRun(s, m.clock())
+	return m
+}
+
+// scenarioEffects applies the printer events that are due and returns
+// the network events in effect for the request.
+func (m *MockRRF) scenarioEffects(r *http.Request) []*Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.scenario == nil {
+		return nil
+	}
+	now := m.clock()
+	for _, e := range m.scenario.due(now) {
+		m.logger.Printf("Scenario: %s at %v", e.Action, e.At)
+		switch e.Action {
+		case ActionHeaterFault:
+			m.printer.HeaterFault(e.Heater)
+		case ActionThermalRunaway:
+			m.printer.ThermalRunaway(e.Heater)
+		case ActionEmergencyStop:
+			m.printer.EmergencyStop()
+		case ActionReboot:
+			m.endSessions()
+			m.printer.Reboot()
+		}
+	}
+	return m.scenario.active(now, r.URL.Path)
+}
+
+// scenarioMiddleware applies the network events of the scenario to
+// requests.
+func (m *MockRRF) scenarioMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		truncate := false
+		for _, e := range m.scenarioEffects(r) {
+			switch e.Action {
+			case ActionReboot, ActionDisconnect:
+				// the server closes the connection without logging
+				panic(http.ErrAbortHandler)
+			case ActionBusy:
+				http.Error(w, "Service Unavailable",
+					http.StatusServiceUnavailable)
+				return
+			case ActionTimeout:
+				select {
+				case <-r.Context().Done():
+				case <-time.After(timeoutHold):
+				}
+				panic(http.ErrAbortHandler)
+			case ActionLatency:
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(e.Latency):
+				}
+			case ActionTruncate:
+				truncate = true
+			}
+		}
+		if !truncate {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tw := &truncatedWriter{ResponseWriter: w}
+		next.ServeHTTP(tw, r)
+		body := tw.body.Bytes()
+		_, _ = w.Write(body[:len(body)/2])
+	})
+}
+
+// truncatedWriter collects the body of a response so that part of it
+// can be sent.
+type truncatedWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *truncatedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// HeaterFault faults the heater, turning it off and pausing any print,
+// until the fault is reset with M562.
+func (p *Printer) HeaterFault(heater int) {
+	p.do(func() {
+		if heater < 0 || heater >= len(p.heaters) {
+			return
+		}
+		if p.heaters[heater].state != types.Fault {
+			p.heaters[heater].fault()
+			p.heaterFault()
+		}
+	})
+}
+
+// ThermalRunaway leaves the heater stuck at full power.  The heater
+// faults when it passes the temperature limit.
+func (p *Printer) ThermalRunaway(heater int) {
+	p.do(func() {
+		if heater >= 0 && heater < len(p.heaters) {
+			p.heaters[heater].runaway = true
+		}
+	})
+}
+
+// EmergencyStop halts the printer as if M112 was sent.
+func (p *Printer) EmergencyStop() {
+	p.do(p.halt)
+}
+
+// Reboot restarts the printer as if M999 was sent.
+func (p *Printer) Reboot() {
+	p.do(p.reset)
+}
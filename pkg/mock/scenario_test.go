@@ -0,0 +1,254 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func Test_ReadScenario(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want *Scenario
+		err  string
+	}{
+		{
+			name: "all actions",
+			yaml: `events:
+  - at: 1s
+    action: heater-fault
+    heater: 1
+  - at: 2s
+    action: thermal-runaway
+  - at: 3s
+    action: emergency-stop
+  - at: 4s
+    action: reboot
+    duration: 5s
+  - at: 10s
+    action: latency
+    duration: 1m
+    latency: 500ms
+  - at: 20s
+    action: timeout
+    duration: 5s
+    path: /rr_status
+  - at: 30s
+    action: truncate
+    duration: 5s
+  - at: 40s
+    action: busy
+    duration: 5s
+  - at: 50s
+    action: disconnect
+`,
+			want: NewScenario().
+				HeaterFault(time.Second, 1).
+				ThermalRunaway(2*time.Second, 0).
+				EmergencyStop(3*time.Second).
+				Reboot(4*time.Second, 5*time.Second).
+				Latency(10*time.Second, time.Minute, 500*time.Millisecond).
+				Timeout(20*time.Second, 5*time.Second).OnPath("/rr_status").
+				Truncate(30*time.Second, 5*time.Second).
+				Busy(40*time.Second, 5*time.Second).
+				Disconnect(50*time.Second, 0),
+		},
+		{
+			name: "unknown action",
+			yaml: "events:\n  - action: explode\n",
+			err:  `event 1: unknown action "explode"`,
+		},
+		{
+			name: "invalid heater",
+			yaml: "events:\n  - action: heater-fault\n    heater: -1\n",
+			err:  "event 1: invalid heater -1",
+		},
+		{
+			name: "no latency",
+			yaml: "events:\n  - action: latency\n",
+			err:  "event 1: latency must be positive",
+		},
+		{
+			name: "negative time",
+			yaml: "events:\n  - action: busy\n    at: -1s\n",
+			err:  "event 1: times must not be negative",
+		},
+		{
+			name: "unknown field",
+			yaml: "events:\n  - action: busy\n    when: 1s\n",
+			err:  "field when not found",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "scenario.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tc.yaml), 0600))
+			s, err := ReadScenario(path)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, s)
+		})
+	}
+}
+
+func Test_PrinterHeaterFault(t *testing.T) {
+	p, clock := newTestPrinter()
+	p.AddFile("test.gcode", []byte(testJob))
+	p.GCode(`M32 "test.gcode"`)
+	advanceUntil(t, p, clock, func(s *types.StatusResponse) bool {
+		return s.CurrentLayer == 1
+	})
+	p.HeaterFault(heaterHotend)
+	clock.advance(time.Second)
+	s := p.Status(3)
+	assert.Equal(t, types.Stopped, s.Status)
+	assert.Equal(t, types.Fault, s.Temps.State[heaterHotend])
+
+	// the heater stays off until the fault is reset
+	p.GCode("M104 S200")
+	clock.advance(time.Minute)
+	s = p.Status(3)
+	assert.Equal(t, types.Fault, s.Temps.State[heaterHotend])
+	assert.Less(t, s.Temps.Current[heaterHotend], 150.0)
+	assert.Equal(t, "Error: M562: Invalid heater number 4\n",
+		p.GCode("M562 P4"))
+	p.GCode("M562 P1\nM104 S200")
+	assert.Equal(t, types.Active, p.Status(1).Temps.State[heaterHotend])
+}
+
+func Test_PrinterThermalRunaway(t *testing.T) {
+	p, clock := newTestPrinter()
+	p.GCode("M140 S60")
+	p.ThermalRunaway(heaterBed)
+	s := advanceUntil(t, p, clock, func(s *types.StatusResponse) bool {
+		return s.Temps.State[heaterBed] == types.Fault
+	})
+	assert.GreaterOrEqual(t, s.Temps.Current[heaterBed], temperatureLimit)
+	clock.advance(time.Minute)
+	assert.Less(t, p.Status(1).Temps.Current[heaterBed], temperatureLimit)
+}
+
+func Test_ScenarioPrinterEvents(t *testing.T) {
+	var buf bytes.Buffer
+	clock := &testClock{now: time.Now()}
+	m := NewMockRRF(log.New(&buf, "", 0)).WithClock(clock.Now).
+		WithScenario(NewScenario().
+			EmergencyStop(10*time.Second).
+			Reboot(20*time.Second, 5*time.Second))
+	ts := httptest.NewServer(m.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+
+	ctx := context.Background()
+	c := netrrf.NewClient(host, "passw0rd")
+	s, err := c.Status(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, types.Idle, s.Status)
+
+	clock.advance(10 * time.Second)
+	s, err = c.Status(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, types.Halted, s.Status)
+
+	// the board does not respond while rebooting and loses the session
+	clock.advance(10 * time.Second)
+	_, err = c.Status(ctx, 1)
+	require.Error(t, err)
+	clock.advance(5 * time.Second)
+	_, err = c.Status(ctx, 1)
+	require.Error(t, err)
+	c.ResetAuthentication()
+	s, err = c.Status(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, types.Idle, s.Status)
+	assert.Equal(t, types.Time(5), s.UpTime)
+	assert.Contains(t, buf.String(), "Scenario: reboot at 20s")
+}
+
+func Test_ScenarioNetworkEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		scenario *Scenario
+		err      string
+	}{
+		{
+			name:     "busy",
+			scenario: NewScenario().Busy(time.Second, time.Second),
+			err:      "rrf response unmarshal failed",
+		},
+		{
+			name:     "truncate",
+			scenario: NewScenario().Truncate(time.Second, time.Second),
+			err:      "unexpected end of JSON input",
+		},
+		{
+			name:     "disconnect",
+			scenario: NewScenario().Disconnect(time.Second, time.Second),
+			err:      "EOF",
+		},
+		{
+			name:     "timeout",
+			scenario: NewScenario().Timeout(time.Second, time.Second),
+			err:      "context canceled",
+		},
+		{
+			name: "latency",
+			scenario: NewScenario().Latency(time.Second, time.Second,
+				time.Second),
+			err: "context canceled",
+		},
+		{
+			name: "other path",
+			scenario: NewScenario().Busy(time.Second, time.Second).
+				OnPath("/rr_config"),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			clock := &testClock{now: time.Now()}
+			m := NewMockRRF(log.New(&buf, "", 0)).WithClock(clock.Now).
+				WithScenario(tc.scenario)
+			ts := httptest.NewServer(m.Router())
+			defer ts.Close()
+			host := strings.Split(ts.URL, "://")[1]
+
+			ctx := context.Background()
+			c := netrrf.NewClient(host, "passw0rd").
+				WithTimeout(200 * time.Millisecond)
+			_, err := c.Status(ctx, 1)
+			require.NoError(t, err)
+
+			clock.advance(time.Second)
+			_, err = c.Status(ctx, 1)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			// the event is over
+			clock.advance(time.Second)
+			_, err = c.Status(ctx, 1)
+			require.NoError(t, err)
+		})
+	}
+}
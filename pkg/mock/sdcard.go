@@ -0,0 +1,282 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// sdDateFormat is the format of the dates of files.
+const sdDateFormat = "2006-01-02T15:04:05"
+
+// sdDirs are the directories of a new SD card.
+var sdDirs = []string{"0:/gcodes", "0:/sys", "0:/macros"}
+
+// sdConfig is the configuration file of a new SD card.
+const sdConfig = `; Configuration file for MockRRF
+M550 P"MockRRF"
+M555 P2
+`
+
+// errNotMounted is returned for names on volumes other than 0.
+var errNotMounted = errors.New("volume not mounted")
+
+// sdEntry is a file or directory on the SD card.
+type sdEntry struct {
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+// SDCard is an in-memory SD card.  Only volume 0 is mounted.  Names
+// are full paths, such as 0:/gcodes/demo.gcode, and a missing volume
+// means volume 0.
+type SDCard struct {
+	entries map[string]*sdEntry
+	mu      sync.Mutex
+}
+
+// NewSDCard returns an SD card with the gcodes, sys and macros
+// directories and a configuration file.
+func NewSDCard() *SDCard {
+	now := time.Now()
+	sd := &SDCard{
+		entries: map[string]*sdEntry{"0:/": {dir: true, modTime: now}},
+	}
+	for _, dir := range sdDirs {
+		sd.entries[dir] = &sdEntry{dir: true, modTime: now}
+	}
+	sd.entries["0:/sys/config.g"] = &sdEntry{
+		data: []byte(sdConfig), modTime: now,
+	}
+	return sd
+}
+
+// sdPath returns the canonical form of a name.  The second result is
+// false if the name is not on volume 0.
+func sdPath(name string) (string, bool) {
+	vol := "0"
+	if i := strings.Index(name, ":"); i >= 0 {
+		vol, name = name[:i], name[i+1:]
+	}
+	return "0:" + path.Clean("/"+name), vol == "0"
+}
+
+// lookup returns the canonical form of the name and its entry, which
+// is nil if it does not exist.  It is called with sd.mu held.
+func (sd *SDCard) lookup(name string) (string, *sdEntry, error) {
+	p, ok := sdPath(name)
+	if !ok {
+		return "", nil, fmt.Errorf("%s: %w", name, errNotMounted)
+	}
+	return p, sd.entries[p], nil
+}
+
+// mkdirAll creates the directory and its parents.  It is called with
+// sd.mu held.
+func (sd *SDCard) mkdirAll(dir string, modTime time.Time) error {
+	if e, ok := sd.entries[dir]; ok {
+		if !e.dir {
+			return fmt.Errorf("%s: not a directory: %w", dir, os.ErrExist)
+		}
+		return nil
+	}
+	if err := sd.mkdirAll(parentDir(dir), modTime); err != nil {
+		return err
+	}
+	sd.entries[dir] = &sdEntry{dir: true, modTime: modTime}
+	return nil
+}
+
+// parentDir returns the directory containing the canonical name.
+func parentDir(name string) string {
+	return "0:" + path.Dir(strings.TrimPrefix(name, "0:"))
+}
+
+// WriteFile creates or replaces a file, creating any missing
+// directories as the firmware does for uploads.
+func (sd *SDCard) WriteFile(name string, data []byte, modTime time.Time) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	p, e, err := sd.lookup(name)
+	if err != nil {
+		return err
+	}
+	if e != nil && e.dir {
+		return fmt.Errorf("%s: is a directory: %w", name, os.ErrExist)
+	}
+	if err := sd.mkdirAll(parentDir(p), modTime); err != nil {
+		return err
+	}
+	sd.entries[p] = &sdEntry{data: data, modTime: modTime}
+	return nil
+}
+
+// ReadFile returns the contents and modification time of a file.
+func (sd *SDCard) ReadFile(name string) ([]byte, time.Time, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	_, e, err := sd.lookup(name)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if e == nil || e.dir {
+		return nil, time.Time{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return e.data, e.modTime, nil
+}
+
+// List returns the entries of a directory sorted by name.
+func (sd *SDCard) List(dir string) ([]types.FileEntry, error) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	p, e, err := sd.lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || !e.dir {
+		return nil, fmt.Errorf("%s: %w", dir, os.ErrNotExist)
+	}
+	entries := []types.FileEntry{}
+	for name, e := range sd.entries {
+		if name == p || parentDir(name) != p {
+			continue
+		}
+		fe := types.FileEntry{
+			Type: types.File,
+			Name: path.Base(name),
+			Size: int64(len(e.data)),
+			Date: types.Date(e.modTime.Format(sdDateFormat)),
+		}
+		if e.dir {
+			fe.Type = types.Directory
+		}
+		entries = append(entries, fe)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// Remove deletes a file or an empty directory.
+func (sd *SDCard) Remove(name string) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	p, e, err := sd.lookup(name)
+	if err != nil {
+		return err
+	}
+	if e == nil || p == "0:/" {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	if e.dir {
+		for other := range sd.entries {
+			if parentDir(other) == p && other != p {
+				return fmt.Errorf("%s: directory not empty", name)
+			}
+		}
+	}
+	delete(sd.entries, p)
+	return nil
+}
+
+// Rename moves a file or directory.  An existing file with the new
+// name is only replaced if overwrite is true.
+func (sd *SDCard) Rename(oldName, newName string, overwrite bool) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	oldPath, e, err := sd.lookup(oldName)
+	if err != nil {
+		return err
+	}
+	if e == nil || oldPath == "0:/" {
+		return fmt.Errorf("%s: %w", oldName, os.ErrNotExist)
+	}
+	newPath, existing, err := sd.lookup(newName)
+	if err != nil {
+		return err
+	}
+	if newPath == oldPath {
+		return nil
+	}
+	if existing != nil && (existing.dir || !overwrite) {
+		return fmt.Errorf("%s: %w", newName, os.ErrExist)
+	}
+	if strings.HasPrefix(newPath, oldPath+"/") {
+		return fmt.Errorf("%s: cannot move a directory into itself", newName)
+	}
+	if parent, ok := sd.entries[parentDir(newPath)]; !ok || !parent.dir {
+		return fmt.Errorf("%s: %w", parentDir(newPath), os.ErrNotExist)
+	}
+	moved := map[string]*sdEntry{newPath: e}
+	for name, child := range sd.entries {
+		if strings.HasPrefix(name, oldPath+"/") {
+			moved[newPath+strings.TrimPrefix(name, oldPath)] = child
+			delete(sd.entries, name)
+		}
+	}
+	delete(sd.entries, oldPath)
+	for name, child := range moved {
+		sd.entries[name] = child
+	}
+	return nil
+}
+
+// Mkdir creates a directory.  The parent directory must exist.
+func (sd *SDCard) Mkdir(dir string) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	p, e, err := sd.lookup(dir)
+	if err != nil {
+		return err
+	}
+	if e != nil {
+		return fmt.Errorf("%s: %w", dir, os.ErrExist)
+	}
+	if parent, ok := sd.entries[parentDir(p)]; !ok || !parent.dir {
+		return fmt.Errorf("%s: %w", parentDir(p), os.ErrNotExist)
+	}
+	sd.entries[p] = &sdEntry{dir: true, modTime: time.Now()}
+	return nil
+}
+
+// LoadDir copies the files and directories below dir on to the SD
+// card so that, for example, dir/gcodes/part.gcode becomes
+// 0:/gcodes/part.gcode.
+func (sd *SDCard) LoadDir(dir string) error {
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name := "0:/" + filepath.ToSlash(rel)
+		if d.IsDir() {
+			sd.mu.Lock()
+			defer sd.mu.Unlock()
+			p, _ := sdPath(name)
+			return sd.mkdirAll(p, info.ModTime())
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		return sd.WriteFile(name, data, info.ModTime())
+	})
+}
@@ -0,0 +1,172 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+func names(entries []types.FileEntry) []string {
+	res := []string{}
+	for _, e := range entries {
+		res = append(res, string(e.Type)+":"+e.Name)
+	}
+	return res
+}
+
+func Test_SDCard(t *testing.T) {
+	sd := NewSDCard()
+	files, err := sd.List("0:/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d:gcodes", "d:macros", "d:sys"}, names(files))
+	data, _, err := sd.ReadFile("/sys/config.g")
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "M550")
+
+	modTime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.Local)
+	require.NoError(t, sd.WriteFile("0:/gcodes/parts/a.gcode",
+		[]byte("G28\n"), modTime))
+	files, err = sd.List("0:/gcodes/parts")
+	require.NoError(t, err)
+	assert.Equal(t, []types.FileEntry{
+		{Type: types.File, Name: "a.gcode", Size: 4,
+			Date: "2021-01-02T03:04:05"},
+	}, files)
+
+	assert.Error(t, sd.WriteFile("0:/gcodes/parts", nil, modTime),
+		"is a directory")
+	assert.Error(t, sd.Mkdir("0:/gcodes/parts"), "exists")
+	assert.Error(t, sd.Mkdir("0:/missing/dir"), "no parent")
+	require.NoError(t, sd.Mkdir("0:/gcodes/old"))
+	assert.Error(t, sd.Remove("0:/gcodes/parts"), "not empty")
+	assert.Error(t, sd.Remove("0:/gcodes/missing.gcode"))
+	assert.Error(t, sd.Remove("0:/"))
+
+	require.NoError(t, sd.WriteFile("0:/gcodes/b.gcode", []byte("M0"), modTime))
+	assert.Error(t, sd.Rename("0:/gcodes/b.gcode", "0:/gcodes/parts/a.gcode",
+		false), "exists")
+	require.NoError(t, sd.Rename("0:/gcodes/b.gcode", "0:/gcodes/parts/a.gcode",
+		true))
+	assert.Error(t, sd.Rename("0:/gcodes/parts", "0:/gcodes/parts/sub", false),
+		"into itself")
+	require.NoError(t, sd.Rename("0:/gcodes/parts", "0:/gcodes/old/parts",
+		false))
+	data, _, err = sd.ReadFile("0:/gcodes/old/parts/a.gcode")
+	require.NoError(t, err)
+	assert.Equal(t, "M0", string(data))
+	_, err = sd.List("0:/gcodes/parts")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	require.NoError(t, sd.Remove("0:/gcodes/old/parts/a.gcode"))
+	require.NoError(t, sd.Remove("0:/gcodes/old/parts"))
+	_, err = sd.List("1:/")
+	assert.ErrorIs(t, err, errNotMounted)
+}
+
+func Test_SDCardLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "gcodes", "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "gcodes", "sub", "x.gcode"),
+		[]byte("G28\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "filaments"), 0755))
+
+	sd := NewSDCard()
+	require.NoError(t, sd.LoadDir(dir))
+	files, err := sd.List("0:/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"d:filaments", "d:gcodes", "d:macros", "d:sys"},
+		names(files))
+	data, _, err := sd.ReadFile("0:/gcodes/sub/x.gcode")
+	require.NoError(t, err)
+	assert.Equal(t, "G28\n", string(data))
+
+	assert.Error(t, sd.LoadDir(filepath.Join(dir, "missing")))
+}
+
+func Test_SDCardEndpoints(t *testing.T) {
+	var buf bytes.Buffer
+	m := NewMockRRF(log.New(&buf, "", 0))
+	ts := httptest.NewServer(m.Router())
+	defer ts.Close()
+	host := strings.Split(ts.URL, "://")[1]
+	c := netrrf.NewClient(host, "reprap").WithTimeout(time.Second)
+	ctx := context.Background()
+
+	for i := 0; i < 45; i++ {
+		m.Printer().AddFile(fmt.Sprintf("part%02d.gcode", i), []byte("G28\n"))
+	}
+	res, err := c.FileList(ctx, "0:/gcodes", 0)
+	require.NoError(t, err)
+	assert.Equal(t, fileListPage, len(res.Files))
+	assert.Equal(t, fileListPage, res.Next)
+	res, err = c.FileList(ctx, "0:/gcodes", 40)
+	require.NoError(t, err)
+	assert.Equal(t, 6, len(res.Files))
+	assert.Equal(t, 0, res.Next)
+	files, err := c.Files(ctx, "0:/gcodes")
+	require.NoError(t, err)
+	assert.Equal(t, 46, len(files))
+	assert.Equal(t, "demo.gcode", files[0].Name)
+	_, err = c.FileList(ctx, "0:/missing", 0)
+	assert.Equal(t, netrrf.FileError{Op: "filelist", Name: "0:/missing", ErrorCode: 2}, err)
+	_, err = c.FileList(ctx, "1:/", 0)
+	assert.Equal(t, netrrf.FileError{Op: "filelist", Name: "1:/", ErrorCode: 1}, err)
+
+	info, err := c.FileInfo(ctx, "0:/gcodes/demo.gcode")
+	require.NoError(t, err)
+	assert.Equal(t, "MockRRF", info.GeneratedBy)
+	assert.Equal(t, 10.0, info.Height)
+	assert.Equal(t, 0.2, info.LayerHeight)
+	_, err = c.FileInfo(ctx, "0:/gcodes/missing.gcode")
+	assert.Equal(t, netrrf.FileError{Op: "fileinfo", Name: "0:/gcodes/missing.gcode", ErrorCode: 1},
+		err)
+	_, err = c.FileInfo(ctx, "")
+	assert.Error(t, err, "not printing")
+
+	job := "; generated by test\nM109 S200\nG1 Z0.2\nG1 X1 E1\n"
+	modTime := time.Date(2021, 1, 2, 3, 4, 5, 0, time.Local)
+	require.NoError(t, c.Mkdir(ctx, "0:/gcodes/new"))
+	assert.Error(t, c.Mkdir(ctx, "0:/gcodes/new"))
+	require.NoError(t, c.Upload(ctx, "0:/gcodes/new/job.gcode",
+		strings.NewReader(job), int64(len(job)), modTime))
+	var down bytes.Buffer
+	n, err := c.Download(ctx, "0:/gcodes/new/job.gcode", &down)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(job)), n)
+	assert.Equal(t, job, down.String())
+	files, err = c.Files(ctx, "0:/gcodes/new")
+	require.NoError(t, err)
+	assert.Equal(t, []types.FileEntry{{Type: types.File, Name: "job.gcode",
+		Size: int64(len(job)), Date: "2021-01-02T03:04:05"}}, files)
+
+	require.NoError(t, c.Move(ctx, "0:/gcodes/new/job.gcode",
+		"0:/gcodes/job.gcode", false))
+	assert.Error(t, c.Move(ctx, "0:/gcodes/job.gcode",
+		"0:/gcodes/demo.gcode", false))
+	_, err = c.GCode(ctx, `M23 "job.gcode"`)
+	require.NoError(t, err)
+	_, err = c.GCode(ctx, "M24")
+	require.NoError(t, err)
+	info, err = c.FileInfo(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, "0:/gcodes/job.gcode", info.FileName)
+	assert.Equal(t, "test", info.GeneratedBy)
+
+	require.NoError(t, c.Delete(ctx, "0:/gcodes/job.gcode"))
+	assert.Error(t, c.Delete(ctx, "0:/gcodes/job.gcode"))
+	_, err = c.Download(ctx, "0:/gcodes/job.gcode", &down)
+	assert.Error(t, err)
+}
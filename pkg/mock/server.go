@@ -2,6 +2,8 @@ package mock
 
 import (
 	"encoding/json"
+	"errors"
+	"io"
 	"log"
 	"math"
 	"net/http"
@@ -9,6 +11,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/beanz/rrf-go/pkg/types"
 
@@ -16,15 +19,22 @@ import (
 )
 
 type MockRRF struct {
-	Auth     *types.AuthResponse
-	logger   *log.Logger
-	auth     bool
-	count    float64
-	requests int
-	failSet  map[int]bool
-	reply    string
-	d        float64
-	mu       sync.Mutex
+	Auth           *types.AuthResponse
+	logger         *log.Logger
+	passwords      map[string]bool
+	sessions       []*session
+	sessionTimeout time.Duration
+	maxSessions    int
+	sessionClock   func() time.Time
+	requests       int
+	failSet        map[int]bool
+	printer        *Printer
+	firmware       *Firmware
+	clock          func() time.Time
+	scenario       *scenarioRun
+	// mu guards the fields above as handlers run concurrently; the
+	// printer has its own lock
+	mu sync.Mutex
 }
 
 const toRad = float64(0.0174533)
@@ -37,29 +47,80 @@ func NewMockRRF(log *log.Logger) *MockRRF {
 			SessionTimeout: types.Time(8000),
 			BoardType:      "mockrrf",
 		},
-		logger:   log,
-		auth:     false,
-		count:    0,
-		requests: 0,
-		failSet:  map[int]bool{},
-		d:        d,
+		logger:         log,
+		passwords:      map[string]bool{"passw0rd": true, "reprap": true},
+		sessionTimeout: DefaultSessionTimeout,
+		sessionClock:   time.Now,
+		requests:       0,
+		failSet:        map[int]bool{},
+		printer:        NewPrinter(),
+		firmware:       Firmware2,
+		clock:          time.Now,
 	}
 	return m
 }
 
 func (m *MockRRF) WithFailSet(f map[int]bool) *MockRRF {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.failSet = f
 	return m
 }
 
-func round(f float64) float64 {
-	return math.Round(f*1000) / 1000
+// failRequest counts a request and returns true if it is in the fail
+// set.
+func (m *MockRRF) failRequest() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rn := m.requests
+	m.requests++
+	return m.failSet[rn]
 }
 
-func (m *MockRRF) Update() {
+// WithClock sets the clock used by the printer simulation and to play
+// scenarios.
+func (m *MockRRF) WithClock(clock func() time.Time) *MockRRF {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.count++
+	m.clock = clock
+	m.mu.Unlock()
+	m.printer.WithClock(clock)
+	return m
+}
+
+// WithFirmware sets the generation of firmware to emulate.  It must be
+// called before Router as the endpoints depend on the firmware.
+func (m *MockRRF) WithFirmware(f *Firmware) *MockRRF {
+	m.mu.Lock()
+	m.firmware = f
+	m.Auth.BoardType = f.BoardType
+	m.mu.Unlock()
+	m.printer.WithFirmware(f)
+	return m
+}
+
+// WithMachine sets the machine to simulate.
+func (m *MockRRF) WithMachine(mc *Machine) *MockRRF {
+	m.printer.WithMachine(mc)
+	return m
+}
+
+// Printer returns the simulated printer.
+func (m *MockRRF) Printer() *Printer {
+	return m.printer
+}
+
+// Update advances the simulation of the printer to the current time.
+//
+// Deprecated: the printer is advanced whenever it is accessed so
+// calling Update is no longer necessary.
+func (m *MockRRF) Update() {
+	m.printer.mu.Lock()
+	defer m.printer.mu.Unlock()
+	m.printer.sync()
+}
+
+func round(f float64) float64 {
+	return math.Round(f*1000) / 1000
 }
 
 func (m *MockRRF) Router() http.Handler {
@@ -67,24 +128,33 @@ func (m *MockRRF) Router() http.Handler {
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			m.logger.Print("Request: ", r.URL)
-			rn := m.requests
-			m.requests++
-			if m.failSet[rn] {
+			if m.failRequest() {
 				w.WriteHeader(http.StatusUnauthorized)
 				return
 			}
 			next.ServeHTTP(w, r)
 		})
 	})
+	router.Use(m.scenarioMiddleware)
 
 	router.Get("/rr_connect", m.connectHandler())
-	router.Get("/rr_config", m.configHandler())
+	router.Get("/rr_disconnect", m.disconnectHandler())
+	if !m.firmware.Legacy {
+		router.Get("/rr_config", m.configHandler())
+		router.Get("/rr_reply", m.replyHandler())
+	}
+	if m.firmware.Model {
+		router.Get("/rr_model", m.modelHandler())
+	}
 	router.Get("/rr_status", m.statusHandler())
-	router.Get("/rr_reply", m.replyHandler())
 	router.Get("/rr_gcode", m.gcodeHandler())
 	router.Get("/rr_filelist", m.filelistHandler())
 	router.Get("/rr_fileinfo", m.fileinfoHandler())
 	router.Get("/rr_download", m.downloadHandler())
+	router.Post("/rr_upload", m.uploadHandler())
+	router.Get("/rr_delete", m.deleteHandler())
+	router.Get("/rr_move", m.moveHandler())
+	router.Get("/rr_mkdir", m.mkdirHandler())
 	root := "./static"
 	fs := http.FileServer(http.Dir(root))
 	router.Get("/*", func(w http.ResponseWriter, r *http.Request) {
@@ -125,13 +195,8 @@ func (m *MockRRF) Router() http.Handler {
 
 func (m *MockRRF) connectHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		pw := r.URL.Query().Get("password")
 		w.Header().Set("Content-Type", "application/json")
-		ar := &types.AuthResponse{ErrorCode: 1}
-		if pw == "passw0rd" || pw == "reprap" {
-			m.auth = true
-			ar = m.Auth
-		}
+		ar := m.connect(r)
 		err := json.NewEncoder(w).Encode(ar)
 		if err != nil {
 			m.logger.Printf("failed to encode %v: %v\n", ar, err)
@@ -139,15 +204,29 @@ func (m *MockRRF) connectHandler() func(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+func (m *MockRRF) disconnectHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		m.disconnect(r)
+		resp := map[string]interface{}{
+			"err": 0,
+		}
+		err := json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			m.logger.Printf("failed to encode %v: %v\n", resp, err)
+		}
+	}
+}
+
 func (m *MockRRF) configHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !m.auth {
+		if !m.authorised(r) {
 			m.logger.Printf("no authorised for %v\n", r)
 			http.Error(w, "Unauthorised", http.StatusUnauthorized)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		err := json.NewEncoder(w).Encode(ConfigResponse())
+		err := json.NewEncoder(w).Encode(m.printer.Config())
 		if err != nil {
 			m.logger.Printf("failed to encode config response: %v\n", err)
 		}
@@ -156,7 +235,7 @@ func (m *MockRRF) configHandler() func(w http.ResponseWriter, r *http.Request) {
 
 func (m *MockRRF) statusHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !m.auth {
+		if !m.authorised(r) {
 			m.logger.Printf("no authorised for %v\n", r)
 			http.Error(w, "Unauthorised", http.StatusUnauthorized)
 			return
@@ -166,9 +245,44 @@ func (m *MockRRF) statusHandler() func(w http.ResponseWriter, r *http.Request) {
 		if err != nil || (kind != 1 && kind != 2 && kind != 3) {
 			kind = 1
 		}
-		resp := StatusResponse(kind, m.count)
-		m.Update()
-		err = json.NewEncoder(w).Encode(resp)
+		var reply string
+		if m.firmware.Legacy {
+			reply = m.printer.Reply()
+		}
+		resp := m.printer.Status(kind)
+		data, err := m.firmware.encodeStatus(resp, reply)
+		if err != nil {
+			m.logger.Printf("failed to encode %v: %v\n", resp, err)
+			http.Error(w, "Internal Server Error",
+				http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(data)
+		if err != nil {
+			m.logger.Printf("failed to write status: %v\n", err)
+		}
+	}
+}
+
+func (m *MockRRF) modelHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !m.authorised(r) {
+			m.logger.Printf("no authorised for %v\n", r)
+			http.Error(w, "Unauthorised", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		key := r.URL.Query().Get("key")
+		flags := r.URL.Query().Get("flags")
+		resp := map[string]interface{}{
+			"key":   key,
+			"flags": flags,
+		}
+		model := m.firmware.model(m.printer.FullStatus())
+		if v, ok := lookup(model, key); ok {
+			resp["result"] = v
+		}
+		err := json.NewEncoder(w).Encode(resp)
 		if err != nil {
 			m.logger.Printf("failed to encode %v: %v\n", resp, err)
 		}
@@ -177,28 +291,29 @@ func (m *MockRRF) statusHandler() func(w http.ResponseWriter, r *http.Request) {
 
 func (m *MockRRF) replyHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !m.auth {
+		if !m.authorised(r) {
 			m.logger.Printf("no authorised for %v\n", r)
 			http.Error(w, "Unauthorised", http.StatusUnauthorized)
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain")
-		_, err := w.Write([]byte(m.reply))
+		reply := m.printer.Reply()
+		_, err := w.Write([]byte(reply))
 		if err != nil {
-			m.logger.Printf("failed to write reply %s: %v\n", m.reply, err)
+			m.logger.Printf("failed to write reply %s: %v\n", reply, err)
 		}
 	}
 }
 
 func (m *MockRRF) gcodeHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !m.auth {
+		if !m.authorised(r) {
 			m.logger.Printf("no authorised for %v\n", r)
 			http.Error(w, "Unauthorised", http.StatusUnauthorized)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		//gcode := r.URL.Query().Get("gcode")
+		m.printer.GCode(r.URL.Query().Get("gcode"))
 		resp := map[string]interface{}{
 			"buff": 250,
 		}
@@ -209,22 +324,39 @@ func (m *MockRRF) gcodeHandler() func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// fileListPage is the number of entries in each page of a directory
+// listing.
+const fileListPage = 20
+
 func (m *MockRRF) filelistHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !m.auth {
+		if !m.authorised(r) {
 			m.logger.Printf("no authorised for %v\n", r)
 			http.Error(w, "Unauthorised", http.StatusUnauthorized)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
 		dir := r.URL.Query().Get("dir")
-		resp := map[string]interface{}{
-			"dir":   dir,
-			"first": 0,
-			"files": []string{},
-			"next":  0,
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		resp := &types.FileListResponse{Dir: dir, First: first}
+		files, err := m.printer.SD().List(dir)
+		switch {
+		case errors.Is(err, errNotMounted):
+			resp = &types.FileListResponse{ErrorCode: 1}
+		case err != nil:
+			resp = &types.FileListResponse{ErrorCode: 2}
+		case first < 0 || first > len(files):
+			resp.Files = []types.FileEntry{}
+		default:
+			last := first + fileListPage
+			if last < len(files) {
+				resp.Next = last
+			} else {
+				last = len(files)
+			}
+			resp.Files = files[first:last]
 		}
-		err := json.NewEncoder(w).Encode(resp)
+		err = json.NewEncoder(w).Encode(resp)
 		if err != nil {
 			m.logger.Printf("failed to encode %v: %v\n", resp, err)
 		}
@@ -233,14 +365,24 @@ func (m *MockRRF) filelistHandler() func(w http.ResponseWriter, r *http.Request)
 
 func (m *MockRRF) fileinfoHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !m.auth {
+		if !m.authorised(r) {
 			m.logger.Printf("no authorised for %v\n", r)
 			http.Error(w, "Unauthorised", http.StatusUnauthorized)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		resp := map[string]interface{}{
-			"err": 1,
+		name := r.URL.Query().Get("name")
+		current := name == ""
+		if current {
+			// the file being printed
+			name = m.printer.printingFile()
+		}
+		resp := &types.FileInfoResponse{ErrorCode: 1}
+		if data, modTime, err := m.printer.SD().ReadFile(name); name != "" && err == nil {
+			resp = fileInfo(data, modTime)
+			if current {
+				resp.FileName = name
+			}
 		}
 		err := json.NewEncoder(w).Encode(resp)
 		if err != nil {
@@ -251,12 +393,81 @@ func (m *MockRRF) fileinfoHandler() func(w http.ResponseWriter, r *http.Request)
 
 func (m *MockRRF) downloadHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if !m.auth {
+		if !m.authorised(r) {
 			m.logger.Printf("no authorised for %v\n", r)
 			http.Error(w, "Unauthorised", http.StatusUnauthorized)
 			return
 		}
-		http.Error(w, "Not found", http.StatusNotFound)
+		data, _, err := m.printer.SD().ReadFile(r.URL.Query().Get("name"))
+		if err != nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err = w.Write(data)
+		if err != nil {
+			m.logger.Printf("failed to write download: %v\n", err)
+		}
+	}
+}
+
+func (m *MockRRF) uploadHandler() func(w http.ResponseWriter, r *http.Request) {
+	return m.fileOpHandler(func(r *http.Request) error {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		modTime := time.Now()
+		if t := r.URL.Query().Get("time"); t != "" {
+			modTime, err = time.ParseInLocation(sdDateFormat, t, time.Local)
+			if err != nil {
+				return err
+			}
+		}
+		return m.printer.SD().WriteFile(r.URL.Query().Get("name"), data,
+			modTime)
+	})
+}
+
+func (m *MockRRF) deleteHandler() func(w http.ResponseWriter, r *http.Request) {
+	return m.fileOpHandler(func(r *http.Request) error {
+		return m.printer.SD().Remove(r.URL.Query().Get("name"))
+	})
+}
+
+func (m *MockRRF) moveHandler() func(w http.ResponseWriter, r *http.Request) {
+	return m.fileOpHandler(func(r *http.Request) error {
+		q := r.URL.Query()
+		return m.printer.SD().Rename(q.Get("old"), q.Get("new"),
+			q.Get("deleteexisting") == "yes")
+	})
+}
+
+func (m *MockRRF) mkdirHandler() func(w http.ResponseWriter, r *http.Request) {
+	return m.fileOpHandler(func(r *http.Request) error {
+		return m.printer.SD().Mkdir(r.URL.Query().Get("dir"))
+	})
+}
+
+// fileOpHandler returns a handler that performs an operation on the SD
+// card and responds with error code 1 if it fails.
+func (m *MockRRF) fileOpHandler(op func(r *http.Request) error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !m.authorised(r) {
+			m.logger.Printf("no authorised for %v\n", r)
+			http.Error(w, "Unauthorised", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		resp := &types.ErrorResponse{}
+		if err := op(r); err != nil {
+			m.logger.Printf("%s failed: %v\n", r.URL.Path, err)
+			resp.ErrorCode = 1
+		}
+		err := json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			m.logger.Printf("failed to encode %v: %v\n", resp, err)
+		}
 	}
 }
 
@@ -279,9 +490,11 @@ func ConfigResponse() *types.ConfigResponse {
 	}
 }
 
-func StatusResponse(kind int, count float64) *types.StatusResponse {
+// staticStatus returns a status response with the properties of the
+// given type that do not change.
+func staticStatus(kind int) *types.StatusResponse {
 	s := &types.StatusResponse{
-		Status: types.Printing,
+		Status: types.Idle,
 		Coordinates: types.StatusCoords{
 			AxesHomed: []types.RRFBool{true, true, true},
 			Extruder:  []float64{0},
@@ -315,9 +528,8 @@ func StatusResponse(kind int, count float64) *types.StatusResponse {
 		UpTime: 500,
 	}
 
-	switch kind {
-	case 2:
-		s.ColdExtrudeTemperature = 160
+	if kind == 2 {
+		s.ColdExtrudeTemperature = coldExtrudeTemperature
 		s.ColdRetractTemperature = 90
 		s.Compensation = "None"
 		s.ControllableFans = 2
@@ -349,7 +561,18 @@ func StatusResponse(kind int, count float64) *types.StatusResponse {
 		}
 		s.MCUTemp = &types.MinCurMax{Min: 31, Cur: 38.4, Max: 38.6}
 		s.VIN = &types.MinCurMax{Min: 11.9, Cur: 12.1, Max: 12.2}
-	case 3:
+	}
+	return s
+}
+
+// StatusResponse returns a canned status response of a printer tracing
+// a circle.  The count is the number of seconds since the print started
+// and the print ends after 100.  It is used as a fixture in tests; the
+// mock server responds with the status of its Printer.
+func StatusResponse(kind int, count float64) *types.StatusResponse {
+	s := staticStatus(kind)
+	s.Status = types.Printing
+	if kind == 3 {
 		s.CurrentLayerTime = 20
 		s.ExtrRaw = []float64{0}
 		s.FirstLayerDuration = 10
@@ -397,10 +620,14 @@ func StatusResponse(kind int, count float64) *types.StatusResponse {
 	return s
 }
 
+// FullStatusResponse returns the canned status response with the type 3
+// properties added as by netrrf.Client.FullStatus.
 func FullStatusResponse(count float64) *types.StatusResponse {
-	res := StatusResponse(2, count)
-	s3 := StatusResponse(3, count+1)
+	return mergeStatus(StatusResponse(2, count), StatusResponse(3, count+1))
+}
 
+// mergeStatus adds the type 3 properties from s3 to res.
+func mergeStatus(res, s3 *types.StatusResponse) *types.StatusResponse {
 	res.CurrentLayer = s3.CurrentLayer
 	res.CurrentLayerTime = s3.CurrentLayerTime
 	res.ExtrRaw = s3.ExtrRaw
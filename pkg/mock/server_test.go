@@ -0,0 +1,107 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+)
+
+// syncBuffer is a log buffer that is safe for concurrent writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Test_ConcurrentClients runs many clients against one mock at once.
+// Run it with -race to check the mock state is goroutine-safe.
+func Test_ConcurrentClients(t *testing.T) {
+	const clients = 16
+	const iterations = 20
+	for _, f := range Firmwares {
+		if f.Legacy {
+			continue
+		}
+		t.Run(f.Name, func(t *testing.T) {
+			m := NewMockRRF(log.New(&syncBuffer{}, "", 0)).
+				WithFirmware(f).
+				WithClock(ScaledClock(100)).
+				WithScenario(NewScenario().
+					Latency(0, time.Second, time.Millisecond).
+					HeaterFault(50*time.Millisecond, 1))
+			ts := httptest.NewServer(m.Router())
+			defer ts.Close()
+			host := strings.Split(ts.URL, "://")[1]
+			m.Printer().GCode(`M32 "demo.gcode"`)
+
+			var wg sync.WaitGroup
+			errs := make(chan error, clients*iterations)
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					ctx := context.Background()
+					c := netrrf.NewClient(host, "reprap").
+						WithTimeout(10 * time.Second)
+					for j := 0; j < iterations; j++ {
+						var err error
+						switch (i + j) % 5 {
+						case 0:
+							_, err = c.Status(ctx, 1+j%3)
+						case 1:
+							_, err = c.Config(ctx)
+						case 2:
+							_, err = c.GCode(ctx,
+								fmt.Sprintf("M106 S%d\nM114", j%2))
+						case 3:
+							_, err = c.Reply(ctx)
+						case 4:
+							_, err = c.FullStatus(ctx)
+						}
+						if err != nil {
+							errs <- fmt.Errorf("client %d: %w", i, err)
+						}
+						if j%7 == 0 {
+							m.Sessions()
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				assert.NoError(t, err)
+			}
+			sessions := 1
+			if f.SessionKeys {
+				sessions = clients
+			}
+			require.Equal(t, sessions, m.Sessions())
+		})
+	}
+}
+
+func Test_Update(t *testing.T) {
+	var buf bytes.Buffer
+	clock := &testClock{now: time.Now()}
+	m := NewMockRRF(log.New(&buf, "", 0)).WithClock(clock.Now)
+	clock.advance(10 * time.Second)
+	m.Update()
+	assert.Equal(t, clock.Now(), m.Printer().last)
+}
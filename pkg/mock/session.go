@@ -0,0 +1,194 @@
+package mock
+
+import (
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// Error codes of rr_connect.
+const (
+	connectWrongPassword  = 1
+	connectNoFreeSessions = 2
+)
+
+// DefaultSessionTimeout is how long a session lasts without requests.
+const DefaultSessionTimeout = 8 * time.Second
+
+// sessionKeyHeader is the header used by clients to identify their
+// session when the firmware issues session keys.
+const sessionKeyHeader = "X-Session-Key"
+
+// session is a client that has connected.  Clients are identified by
+// their session key, if the firmware issues them, or by their address.
+// Sessions expire in real time, rather than by the clock of the
+// simulation, as they belong to the network interface not the printer.
+type session struct {
+	key  uint32
+	addr string
+	seen time.Time
+}
+
+// WithPassword sets the password.  The empty string means no password
+// is set so that any password is accepted on connect and clients may
+// make requests without connecting first.  By default both "reprap"
+// and "passw0rd" are accepted.
+func (m *MockRRF) WithPassword(pw string) *MockRRF {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.passwords = nil
+	if pw != "" {
+		m.passwords = map[string]bool{pw: true}
+	}
+	return m
+}
+
+// WithSessionTimeout sets how long sessions last without requests.
+func (m *MockRRF) WithSessionTimeout(timeout time.Duration) *MockRRF {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionTimeout = timeout
+	m.Auth.SessionTimeout = types.Time(timeout.Milliseconds())
+	return m
+}
+
+// WithMaxSessions limits the number of sessions.  Connecting when the
+// limit is reached fails with error code 2.  Zero means no limit.
+func (m *MockRRF) WithMaxSessions(n int) *MockRRF {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxSessions = n
+	return m
+}
+
+// Sessions returns the number of sessions that have not expired.
+func (m *MockRRF) Sessions() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expireSessions()
+	return len(m.sessions)
+}
+
+// clientAddr returns the address of the client without the port.
+func clientAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// requestKey returns the session key sent with the request or zero if
+// there is none.
+func requestKey(r *http.Request) uint32 {
+	key, err := strconv.ParseUint(r.Header.Get(sessionKeyHeader), 10, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(key)
+}
+
+// expireSessions removes sessions that have not made a request within
+// the session timeout.  It is called with m.mu held.
+func (m *MockRRF) expireSessions() {
+	now := m.sessionClock()
+	live := m.sessions[:0]
+	for _, s := range m.sessions {
+		if now.Sub(s.seen) < m.sessionTimeout {
+			live = append(live, s)
+		} else {
+			m.logger.Printf("Session for %s expired\n", s.addr)
+		}
+	}
+	m.sessions = live
+}
+
+// findSession returns the session of the client making the request
+// or nil if there is none.  It is called with m.mu held.
+func (m *MockRRF) findSession(r *http.Request) *session {
+	m.expireSessions()
+	if key := requestKey(r); key != 0 {
+		for _, s := range m.sessions {
+			if s.key == key {
+				return s
+			}
+		}
+		return nil
+	}
+	addr := clientAddr(r)
+	for _, s := range m.sessions {
+		if s.addr == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+// connect checks the password, creates a session for the client if
+// necessary and returns the rr_connect response.
+func (m *MockRRF) connect(r *http.Request) *types.AuthResponse {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.passwords != nil && !m.passwords[r.URL.Query().Get("password")] {
+		return &types.AuthResponse{ErrorCode: connectWrongPassword}
+	}
+	s := m.findSession(r)
+	if s != nil && m.firmware.SessionKeys && requestKey(r) == 0 {
+		// each connect without a key is a new session
+		s = nil
+	}
+	if s == nil {
+		if m.maxSessions > 0 && len(m.sessions) >= m.maxSessions {
+			return &types.AuthResponse{ErrorCode: connectNoFreeSessions}
+		}
+		s = &session{addr: clientAddr(r)}
+		if m.firmware.SessionKeys {
+			s.key = rand.Uint32() | 1
+		}
+		m.sessions = append(m.sessions, s)
+	}
+	s.seen = m.sessionClock()
+	if m.firmware.Legacy {
+		// no sessions or board type
+		return &types.AuthResponse{}
+	}
+	return &types.AuthResponse{
+		SessionTimeout: m.Auth.SessionTimeout,
+		SessionKey:     s.key,
+		BoardType:      m.Auth.BoardType,
+	}
+}
+
+// disconnect ends the session of the client.
+func (m *MockRRF) disconnect(r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.findSession(r)
+	for i, cur := range m.sessions {
+		if cur == s {
+			m.sessions = append(m.sessions[:i], m.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// authorised returns true if the client making the request has a
+// session, which is refreshed, or if there is no password.
+func (m *MockRRF) authorised(r *http.Request) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.findSession(r); s != nil {
+		s.seen = m.sessionClock()
+		return true
+	}
+	return m.passwords == nil
+}
+
+// endSessions removes all sessions as when the firmware restarts.  It
+// is called with m.mu held.
+func (m *MockRRF) endSessions() {
+	m.sessions = nil
+}
@@ -0,0 +1,142 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// sessionClient makes requests to a mock from a given address.
+type sessionClient struct {
+	t      *testing.T
+	router http.Handler
+	addr   string
+	key    uint32
+}
+
+func (c *sessionClient) get(uri string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", uri, nil)
+	req.RemoteAddr = c.addr + ":40000"
+	if c.key != 0 {
+		req.Header.Set(sessionKeyHeader, strconv.FormatUint(uint64(c.key), 10))
+	}
+	w := httptest.NewRecorder()
+	c.router.ServeHTTP(w, req)
+	return w
+}
+
+func (c *sessionClient) connect(pw string) *types.AuthResponse {
+	w := c.get("/rr_connect?password=" + pw)
+	require.Equal(c.t, http.StatusOK, w.Code)
+	var ar types.AuthResponse
+	require.NoError(c.t, json.Unmarshal(w.Body.Bytes(), &ar))
+	return &ar
+}
+
+func (c *sessionClient) status() int {
+	return c.get("/rr_status?type=1").Code
+}
+
+func newSessionMock(f *Firmware) (*MockRRF, *testClock) {
+	var buf bytes.Buffer
+	clock := &testClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewMockRRF(log.New(&buf, "", 0)).WithFirmware(f)
+	m.sessionClock = clock.Now
+	return m, clock
+}
+
+func Test_Sessions(t *testing.T) {
+	t.Run("password", func(t *testing.T) {
+		m, _ := newSessionMock(Firmware2)
+		m.WithPassword("secret")
+		c := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		assert.Equal(t, http.StatusUnauthorized, c.status())
+		assert.Equal(t, 1, c.connect("reprap").ErrorCode)
+		assert.Equal(t, http.StatusUnauthorized, c.status())
+		ar := c.connect("secret")
+		assert.Equal(t, 0, ar.ErrorCode)
+		assert.Equal(t, types.Time(8000), ar.SessionTimeout)
+		assert.Equal(t, "mockrrf", ar.BoardType)
+		assert.Equal(t, uint32(0), ar.SessionKey)
+		assert.Equal(t, http.StatusOK, c.status())
+		other := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.2"}
+		assert.Equal(t, http.StatusUnauthorized, other.status())
+		assert.Equal(t, 1, m.Sessions())
+	})
+
+	t.Run("no password", func(t *testing.T) {
+		m, _ := newSessionMock(Firmware2)
+		m.WithPassword("")
+		c := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		assert.Equal(t, http.StatusOK, c.status())
+		assert.Equal(t, 0, c.connect("anything").ErrorCode)
+		assert.Equal(t, 1, m.Sessions())
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		m, clock := newSessionMock(Firmware2)
+		m.WithSessionTimeout(2 * time.Second)
+		c := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		assert.Equal(t, types.Time(2000), c.connect("reprap").SessionTimeout)
+		clock.advance(1500 * time.Millisecond)
+		assert.Equal(t, http.StatusOK, c.status())
+		clock.advance(1500 * time.Millisecond)
+		assert.Equal(t, http.StatusOK, c.status(), "refreshed by request")
+		clock.advance(2 * time.Second)
+		assert.Equal(t, http.StatusUnauthorized, c.status())
+		assert.Equal(t, 0, m.Sessions())
+	})
+
+	t.Run("max sessions", func(t *testing.T) {
+		m, _ := newSessionMock(Firmware2)
+		m.WithMaxSessions(1)
+		c1 := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		c2 := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.2"}
+		assert.Equal(t, 0, c1.connect("reprap").ErrorCode)
+		assert.Equal(t, 0, c1.connect("reprap").ErrorCode, "reconnect")
+		assert.Equal(t, 2, c2.connect("reprap").ErrorCode)
+		assert.Equal(t, http.StatusOK, c1.get("/rr_disconnect").Code)
+		assert.Equal(t, http.StatusUnauthorized, c1.status())
+		assert.Equal(t, 0, c2.connect("reprap").ErrorCode)
+		assert.Equal(t, http.StatusOK, c2.status())
+	})
+
+	t.Run("session keys", func(t *testing.T) {
+		m, _ := newSessionMock(Firmware3Model)
+		m.WithMaxSessions(2)
+		c1 := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		c2 := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		c1.key = c1.connect("reprap").SessionKey
+		c2.key = c2.connect("reprap").SessionKey
+		assert.NotZero(t, c1.key)
+		assert.NotEqual(t, c1.key, c2.key)
+		assert.Equal(t, 2, m.Sessions())
+		fresh := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		assert.Equal(t, 2, fresh.connect("reprap").ErrorCode, "new session")
+		assert.Equal(t, 0, c1.connect("reprap").ErrorCode, "reconnect")
+		assert.Equal(t, http.StatusOK, c1.get("/rr_disconnect").Code)
+		assert.Equal(t, http.StatusUnauthorized, c1.status())
+		assert.Equal(t, http.StatusOK, c2.status())
+		assert.Equal(t, 0, fresh.connect("reprap").ErrorCode)
+	})
+
+	t.Run("reboot", func(t *testing.T) {
+		m, _ := newSessionMock(Firmware2)
+		c := &sessionClient{t: t, router: m.Router(), addr: "10.0.0.1"}
+		c.connect("reprap")
+		assert.Equal(t, http.StatusOK, c.status())
+		m.WithScenario(NewScenario().Reboot(0, 0))
+		assert.Equal(t, http.StatusUnauthorized, c.status())
+		assert.Equal(t, 0, m.Sessions())
+	})
+}
@@ -27,12 +27,18 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/beanz/rrf-go/pkg/types"
 )
 
+// replyPollInterval is how often the sequence number is checked whilst
+// waiting for a gcode reply
+var replyPollInterval = 250 * time.Millisecond
+
 type HttpClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
@@ -41,12 +47,14 @@ type Client struct {
 	host       string
 	password   string
 	authDone   bool
+	boardType  string
+	sessionKey uint32
 	timeout    time.Duration
 	httpClient HttpClient
 }
 
 func NewClient(host, password string) *Client {
-	return &Client{host, password, false, 30 * time.Second, http.DefaultClient}
+	return &Client{host, password, false, "", 0, 30 * time.Second, http.DefaultClient}
 }
 
 func (c *Client) WithTimeout(t time.Duration) *Client {
@@ -60,41 +68,69 @@ func (c *Client) WithHTTPClient(client HttpClient) *Client {
 }
 
 func (c *Client) Request(ctx context.Context, uri string, res interface{}) error {
-	ctx, cancel := context.WithCancel(ctx)
-	timer := time.AfterFunc(c.timeout, func() {
-		cancel()
-	})
-
-	req, err := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("http://%s/%s", c.host, uri), nil)
+	buf, err := c.RawRequest(ctx, uri)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(buf, res)
 	if err != nil {
 		return fmt.Errorf(
-			"rrf request creation failed for host %s: %w",
+			"rrf response unmarshal failed for host %s: %w",
 			c.host, err)
 	}
-	req = req.WithContext(ctx)
+	return nil
+}
 
-	resp, err := c.httpClient.Do(req)
+func (c *Client) RawRequest(ctx context.Context, uri string) ([]byte, error) {
+	return c.rawRequest(ctx, "GET", uri, nil, 0)
+}
+
+func (c *Client) rawRequest(ctx context.Context, method, uri string, body io.Reader, size int64) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	timer := time.AfterFunc(c.timeout, func() {
+		cancel()
+	})
+	defer timer.Stop()
+
+	resp, err := c.send(ctx, method, uri, body, size)
 	if err != nil {
-		return fmt.Errorf(
-			"rrf request failed for host %s: %w",
-			c.host, err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 	buf, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"rrf response read failed for host %s: %w",
 			c.host, err)
 	}
-	err = json.Unmarshal(buf, res)
+	return buf, nil
+}
+
+// send makes a request and returns the response without reading the
+// body so that file transfers can be streamed.
+func (c *Client) send(ctx context.Context, method, uri string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method,
+		fmt.Sprintf("http://%s/%s", c.host, uri), body)
 	if err != nil {
-		return fmt.Errorf(
-			"rrf response unmarshal failed for host %s: %w",
+		return nil, fmt.Errorf(
+			"rrf request creation failed for host %s: %w",
 			c.host, err)
 	}
-	timer.Stop()
-	return nil
+	if body != nil {
+		req.ContentLength = size
+	}
+	if c.sessionKey != 0 {
+		req.Header.Set("X-Session-Key", strconv.FormatUint(uint64(c.sessionKey), 10))
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"rrf request failed for host %s: %w",
+			c.host, err)
+	}
+	return resp, nil
 }
 
 type AuthenticationError types.AuthResponse
@@ -116,9 +152,24 @@ func (c *Client) Authenticate(ctx context.Context) error {
 		return AuthenticationError(resp)
 	}
 	c.authDone = true
+	c.boardType = resp.BoardType
+	c.sessionKey = resp.SessionKey
 	return nil
 }
 
+// BoardType returns the board type reported when authenticating or an
+// empty string if it is not known.
+func (c *Client) BoardType() string {
+	return c.boardType
+}
+
+// ResetAuthentication forces the next request to authenticate again
+// which is necessary if the device has restarted and lost the session.
+func (c *Client) ResetAuthentication() {
+	c.authDone = false
+	c.sessionKey = 0
+}
+
 func (c *Client) Config(ctx context.Context) (*types.ConfigResponse, error) {
 	if !c.authDone {
 		err := c.Authenticate(ctx)
@@ -134,6 +185,31 @@ func (c *Client) Config(ctx context.Context) (*types.ConfigResponse, error) {
 	return &resp, nil
 }
 
+// Model decodes the result for key from the object model, which is
+// only available from RepRapFirmware 3, into res.
+func (c *Client) Model(ctx context.Context, key, flags string, res interface{}) error {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	var resp types.ModelResponse
+	err := c.Request(ctx, "rr_model?key="+url.QueryEscape(key)+
+		"&flags="+url.QueryEscape(flags), &resp)
+	if err != nil {
+		return fmt.Errorf("rrf model %s failed %w", key, err)
+	}
+	if len(resp.Result) == 0 {
+		return fmt.Errorf("rrf model %s failed: no result", key)
+	}
+	err = json.Unmarshal(resp.Result, res)
+	if err != nil {
+		return fmt.Errorf("rrf model %s failed %w", key, err)
+	}
+	return nil
+}
+
 func (c *Client) Status(ctx context.Context, t int) (*types.StatusResponse, error) {
 	if !c.authDone {
 		err := c.Authenticate(ctx)
@@ -172,3 +248,66 @@ func (c *Client) FullStatus(ctx context.Context) (*types.StatusResponse, error)
 
 	return res, nil
 }
+
+func (c *Client) GCode(ctx context.Context, gcode string) (*types.GCodeResponse, error) {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var res types.GCodeResponse
+	err := c.Request(ctx, "rr_gcode?gcode="+url.QueryEscape(gcode), &res)
+	if err != nil {
+		return nil, fmt.Errorf("rrf gcode failed %w", err)
+	}
+	return &res, nil
+}
+
+func (c *Client) Reply(ctx context.Context) (string, error) {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return "", err
+		}
+	}
+	buf, err := c.RawRequest(ctx, "rr_reply")
+	if err != nil {
+		return "", fmt.Errorf("rrf reply failed %w", err)
+	}
+	return string(buf), nil
+}
+
+// SendGCode sends the gcode and waits up to wait for the reply to be
+// available.  The reply sequence number, from a type 1 status response,
+// is used to detect the reply so an empty string is returned for gcode
+// that does not produce a reply.
+func (c *Client) SendGCode(ctx context.Context, gcode string, wait time.Duration) (string, error) {
+	s, err := c.Status(ctx, 1)
+	if err != nil {
+		return "", err
+	}
+	seq := s.Seq
+	_, err = c.GCode(ctx, gcode)
+	if err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		s, err = c.Status(ctx, 1)
+		if err != nil {
+			return "", err
+		}
+		if s.Seq != seq {
+			return c.Reply(ctx)
+		}
+		if !time.Now().Before(deadline) {
+			return "", nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(replyPollInterval):
+		}
+	}
+}
@@ -124,6 +124,28 @@ func Test_Authenticate(t *testing.T) {
 	}
 }
 
+func Test_SessionKey(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			{
+				StatusCode: 200,
+				Body: io.NopCloser(strings.NewReader(
+					`{"err":0,"sessionTimeout":8000,"sessionKey":1234}`)),
+			},
+			{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(`{}`)),
+			},
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	_, err := rrf.Config(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(httpClient.requests))
+	assert.Equal(t, "", httpClient.requests[0].Header.Get("X-Session-Key"))
+	assert.Equal(t, "1234", httpClient.requests[1].Header.Get("X-Session-Key"))
+}
+
 func Test_Authenticate_HidePassowrd(t *testing.T) {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	port := ln.Addr().(*net.TCPAddr).Port
@@ -550,3 +572,172 @@ func Test_FullStatus(t *testing.T) {
 		})
 	}
 }
+
+func okResponse(body string) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Proto:      "HTTP/1.0",
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func Test_GCode(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse(`{"err":0,"sessionTimeout":8000,"boardType":"duetwifi10"}`),
+			okResponse(`{"buff":249}`),
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	res, err := rrf.GCode(context.Background(), "G1 X10 F3000")
+	assert.NoError(t, err)
+	assert.Equal(t, &types.GCodeResponse{BufferSpace: 249}, res)
+	assert.Equal(t, 2, len(httpClient.requests))
+	assert.Equal(t, "/rr_gcode", httpClient.requests[1].URL.Path)
+	assert.Equal(t, "G1 X10 F3000",
+		httpClient.requests[1].URL.Query().Get("gcode"))
+
+	httpClient = &httpClientMock{
+		responses: []*http.Response{okResponse(`{`)},
+	}
+	rrf = NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	rrf.authDone = true
+	_, err = rrf.GCode(context.Background(), "M115")
+	assert.Error(t, err)
+}
+
+func Test_Reply(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse(`{"err":0,"sessionTimeout":8000,"boardType":"duetwifi10"}`),
+			okResponse("ok\n"),
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	reply, err := rrf.Reply(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "ok\n", reply)
+	assert.Equal(t, "/rr_reply", httpClient.requests[1].URL.Path)
+
+	httpClient = &httpClientMock{errors: []error{fmt.Errorf("mock error")}}
+	rrf = NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	rrf.authDone = true
+	_, err = rrf.Reply(context.Background())
+	assert.Error(t, err)
+}
+
+func Test_SendGCode(t *testing.T) {
+	replyPollInterval = time.Millisecond
+	tests := []struct {
+		name      string
+		responses []*http.Response
+		wait      time.Duration
+		want      string
+		wantErr   bool
+	}{
+		{
+			name: "reply after sequence change",
+			wait: time.Second,
+			responses: []*http.Response{
+				okResponse(`{"status":"I","seq":3}`),
+				okResponse(`{"buff":249}`),
+				okResponse(`{"status":"I","seq":3}`),
+				okResponse(`{"status":"I","seq":4}`),
+				okResponse("FIRMWARE_NAME: RepRapFirmware\n"),
+			},
+			want: "FIRMWARE_NAME: RepRapFirmware\n",
+		},
+		{
+			name: "no reply",
+			responses: []*http.Response{
+				okResponse(`{"status":"I","seq":3}`),
+				okResponse(`{"buff":249}`),
+				okResponse(`{"status":"I","seq":3}`),
+			},
+			want: "",
+		},
+		{
+			name: "status error",
+			responses: []*http.Response{
+				okResponse(`{`),
+			},
+			wantErr: true,
+		},
+		{
+			name: "gcode error",
+			responses: []*http.Response{
+				okResponse(`{"status":"I","seq":3}`),
+				okResponse(`{`),
+			},
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			httpClient := &httpClientMock{responses: tc.responses}
+			rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+			rrf.authDone = true
+			reply, err := rrf.SendGCode(context.Background(), "M115", tc.wait)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, reply)
+		})
+	}
+}
+
+func Test_ResetAuthentication(t *testing.T) {
+	rrf := NewClient("localhost", "foo")
+	rrf.authDone = true
+	rrf.ResetAuthentication()
+	assert.False(t, rrf.authDone)
+
+	// the session key of the lost session is not sent when connecting
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse(`{"err":0,"sessionTimeout":8000,"sessionKey":1234}`),
+			okResponse(`{"err":0,"sessionTimeout":8000,"sessionKey":5678}`),
+			okResponse(`{}`),
+		},
+	}
+	rrf = NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	assert.NoError(t, rrf.Authenticate(context.Background()))
+	rrf.ResetAuthentication()
+	assert.Equal(t, uint32(0), rrf.sessionKey)
+	_, err := rrf.Config(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(httpClient.requests))
+	assert.Equal(t, "", httpClient.requests[1].Header.Get("X-Session-Key"))
+	assert.Equal(t, "5678", httpClient.requests[2].Header.Get("X-Session-Key"))
+}
+
+func Test_Model(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse(`{"err":0,"sessionTimeout":8000,"boardType":"duet3mb6hc"}`),
+			okResponse(`{"key":"network.interfaces","flags":"","result":[{"mac":"be:ef:de:ad:fe:ed"}]}`),
+			okResponse(`{"key":"missing","flags":""}`),
+			okResponse(`{"key":"network.interfaces","flags":"","result":{}}`),
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	var ifaces []struct {
+		MAC string `json:"mac"`
+	}
+	err := rrf.Model(context.Background(), "network.interfaces", "", &ifaces)
+	assert.NoError(t, err)
+	assert.Equal(t, "duet3mb6hc", rrf.BoardType())
+	assert.Equal(t, 1, len(ifaces))
+	assert.Equal(t, "be:ef:de:ad:fe:ed", ifaces[0].MAC)
+	assert.Equal(t, "/rr_model", httpClient.requests[1].URL.Path)
+	assert.Equal(t, "network.interfaces",
+		httpClient.requests[1].URL.Query().Get("key"))
+
+	err = rrf.Model(context.Background(), "missing", "", &ifaces)
+	assert.Error(t, err)
+	err = rrf.Model(context.Background(), "network.interfaces", "", &ifaces)
+	assert.Error(t, err)
+}
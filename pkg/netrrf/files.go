@@ -0,0 +1,231 @@
+/*
+Copyright (c) 2021 Mark Hindess
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package netrrf
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+)
+
+// FileError is returned when a file request is rejected by the device.
+type FileError struct {
+	Op        string
+	Name      string
+	ErrorCode int
+}
+
+func (err FileError) Error() string {
+	return fmt.Sprintf("rrf %s of %s failed with error code=%d",
+		err.Op, err.Name, err.ErrorCode)
+}
+
+// FileList returns a single page of the directory listing starting at
+// the entry first.  The Next field of the result is the first entry of
+// the next page or zero if there are no more entries.
+func (c *Client) FileList(ctx context.Context, dir string, first int) (*types.FileListResponse, error) {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var res types.FileListResponse
+	err := c.Request(ctx, fmt.Sprintf("rr_filelist?dir=%s&first=%d",
+		url.QueryEscape(dir), first), &res)
+	if err != nil {
+		return nil, fmt.Errorf("rrf filelist failed %w", err)
+	}
+	if res.ErrorCode != 0 {
+		return nil, FileError{"filelist", dir, res.ErrorCode}
+	}
+	return &res, nil
+}
+
+// Files returns all the entries in the directory fetching as many pages
+// as necessary.
+func (c *Client) Files(ctx context.Context, dir string) ([]types.FileEntry, error) {
+	files := []types.FileEntry{}
+	first := 0
+	for {
+		res, err := c.FileList(ctx, dir, first)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, res.Files...)
+		if res.Next == 0 || res.Next <= first {
+			return files, nil
+		}
+		first = res.Next
+	}
+}
+
+func (c *Client) FileInfo(ctx context.Context, name string) (*types.FileInfoResponse, error) {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var res types.FileInfoResponse
+	err := c.Request(ctx, "rr_fileinfo?name="+url.QueryEscape(name), &res)
+	if err != nil {
+		return nil, fmt.Errorf("rrf fileinfo failed %w", err)
+	}
+	if res.ErrorCode != 0 {
+		return nil, FileError{"fileinfo", name, res.ErrorCode}
+	}
+	return &res, nil
+}
+
+// Download writes the contents of the file to w.  The transfer is not
+// subject to the client timeout so ctx should be used to limit it.
+func (c *Client) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return 0, err
+		}
+	}
+	resp, err := c.send(ctx, "GET", "rr_download?name="+url.QueryEscape(name), nil, 0)
+	if err != nil {
+		return 0, fmt.Errorf("rrf download failed %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("rrf download of %s failed: %s", name, resp.Status)
+	}
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("rrf download of %s failed: %w", name, err)
+	}
+	return n, nil
+}
+
+// Upload writes size bytes from r to the named file setting its
+// modification time.  The transfer is not subject to the client timeout
+// so ctx should be used to limit it.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, size int64, modTime time.Time) error {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	uri := "rr_upload?name=" + url.QueryEscape(name)
+	if !modTime.IsZero() {
+		uri += "&time=" + url.QueryEscape(modTime.Format("2006-01-02T15:04:05"))
+	}
+	resp, err := c.send(ctx, "POST", uri, r, size)
+	if err != nil {
+		return fmt.Errorf("rrf upload failed %w", err)
+	}
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("rrf upload of %s failed: %w", name, err)
+	}
+	var res types.ErrorResponse
+	err = json.Unmarshal(buf, &res)
+	if err != nil {
+		return fmt.Errorf("rrf upload of %s failed: %w", name, err)
+	}
+	if res.ErrorCode != 0 {
+		return FileError{"upload", name, res.ErrorCode}
+	}
+	return nil
+}
+
+func (c *Client) Delete(ctx context.Context, name string) error {
+	return c.fileOp(ctx, "delete", name,
+		"rr_delete?name="+url.QueryEscape(name))
+}
+
+func (c *Client) Move(ctx context.Context, oldName, newName string, overwrite bool) error {
+	uri := "rr_move?old=" + url.QueryEscape(oldName) +
+		"&new=" + url.QueryEscape(newName)
+	if overwrite {
+		uri += "&deleteexisting=yes"
+	}
+	return c.fileOp(ctx, "move", oldName, uri)
+}
+
+func (c *Client) Mkdir(ctx context.Context, dir string) error {
+	return c.fileOp(ctx, "mkdir", dir, "rr_mkdir?dir="+url.QueryEscape(dir))
+}
+
+func (c *Client) fileOp(ctx context.Context, op, name, uri string) error {
+	if !c.authDone {
+		err := c.Authenticate(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	var res types.ErrorResponse
+	err := c.Request(ctx, uri, &res)
+	if err != nil {
+		return fmt.Errorf("rrf %s failed %w", op, err)
+	}
+	if res.ErrorCode != 0 {
+		return FileError{op, name, res.ErrorCode}
+	}
+	return nil
+}
+
+// Glob returns the paths of the files and directories matching the
+// pattern using path.Match syntax.  Only the final element of the
+// pattern may contain wildcards.  A pattern without wildcards is
+// returned unchanged without checking that it exists.
+func (c *Client) Glob(ctx context.Context, pattern string) ([]string, error) {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return []string{pattern}, nil
+	}
+	dir, base := path.Split(pattern)
+	if strings.ContainsAny(dir, "*?[") {
+		return nil, fmt.Errorf(
+			"wildcards are only supported in the final element of %s",
+			pattern)
+	}
+	files, err := c.Files(ctx, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return nil, err
+	}
+	matches := []string{}
+	for _, f := range files {
+		ok, err := path.Match(base, f.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		if ok {
+			matches = append(matches, dir+f.Name)
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,224 @@
+package netrrf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Files(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse(`{"err":0,"sessionTimeout":8000,"boardType":"duetwifi10"}`),
+			okResponse(`{"dir":"0:/gcodes","first":0,"files":[{"type":"f","name":"a.gcode","size":10,"date":"2021-11-19T12:00:00"}],"next":1}`),
+			okResponse(`{"dir":"0:/gcodes","first":1,"files":[{"type":"d","name":"old","size":0,"date":"2021-11-19T12:00:00"}],"next":0}`),
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	files, err := rrf.Files(context.Background(), "0:/gcodes")
+	require.NoError(t, err)
+	assert.Equal(t, []types.FileEntry{
+		{Type: types.File, Name: "a.gcode", Size: 10, Date: "2021-11-19T12:00:00"},
+		{Type: types.Directory, Name: "old", Date: "2021-11-19T12:00:00"},
+	}, files)
+	assert.Equal(t, "dir=0%3A%2Fgcodes&first=1", httpClient.requests[2].URL.RawQuery)
+
+	httpClient = &httpClientMock{
+		responses: []*http.Response{okResponse(`{"err":2}`)},
+	}
+	rrf = NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	rrf.authDone = true
+	_, err = rrf.Files(context.Background(), "0:/missing")
+	assert.Equal(t, FileError{"filelist", "0:/missing", 2}, err)
+	assert.Equal(t, "rrf filelist of 0:/missing failed with error code=2",
+		err.Error())
+}
+
+func Test_Glob(t *testing.T) {
+	listing := `{"dir":"0:/gcodes","first":0,"files":[` +
+		`{"type":"f","name":"a.gcode","size":10},` +
+		`{"type":"f","name":"b.g","size":10},` +
+		`{"type":"f","name":"c.gcode","size":10}],"next":0}`
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "no wildcards",
+			pattern: "0:/gcodes/a.gcode",
+			want:    []string{"0:/gcodes/a.gcode"},
+		},
+		{
+			name:    "star",
+			pattern: "0:/gcodes/*.gcode",
+			want:    []string{"0:/gcodes/a.gcode", "0:/gcodes/c.gcode"},
+		},
+		{
+			name:    "wildcard in directory",
+			pattern: "0:/*/a.gcode",
+			wantErr: true,
+		},
+		{
+			name:    "bad pattern",
+			pattern: "0:/gcodes/[",
+			wantErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			httpClient := &httpClientMock{
+				responses: []*http.Response{okResponse(listing)},
+			}
+			rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+			rrf.authDone = true
+			got, err := rrf.Glob(context.Background(), tc.pattern)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func Test_FileInfo(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse(`{"err":0,"size":436244,"lastModified":"2021-11-19T12:00:00","height":10.2,"firstLayerHeight":0.3,"layerHeight":0.2,"printTime":3600,"filament":[1234.5],"generatedBy":"PrusaSlicer 2.4.0"}`),
+			okResponse(`{"err":1}`),
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	rrf.authDone = true
+	info, err := rrf.FileInfo(context.Background(), "0:/gcodes/a.gcode")
+	require.NoError(t, err)
+	assert.Equal(t, &types.FileInfoResponse{
+		Size:             436244,
+		LastModified:     "2021-11-19T12:00:00",
+		Height:           10.2,
+		FirstLayerHeight: 0.3,
+		LayerHeight:      0.2,
+		PrintTime:        3600,
+		Filament:         []float64{1234.5},
+		GeneratedBy:      "PrusaSlicer 2.4.0",
+	}, info)
+	_, err = rrf.FileInfo(context.Background(), "0:/gcodes/b.gcode")
+	assert.Error(t, err)
+}
+
+func Test_Download(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse("G28\nG1 X10\n"),
+			{
+				Status:     "404 Not Found",
+				StatusCode: 404,
+				Body:       io.NopCloser(strings.NewReader("Not found")),
+			},
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	rrf.authDone = true
+	var buf bytes.Buffer
+	n, err := rrf.Download(context.Background(), "0:/gcodes/a.gcode", &buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, "G28\nG1 X10\n", buf.String())
+	assert.Equal(t, "/rr_download", httpClient.requests[0].URL.Path)
+
+	_, err = rrf.Download(context.Background(), "0:/gcodes/b.gcode", &buf)
+	assert.Error(t, err)
+}
+
+func Test_Upload(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			okResponse(`{"err":0}`),
+			okResponse(`{"err":1}`),
+			okResponse(`{`),
+		},
+	}
+	rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+	rrf.authDone = true
+	mod := time.Date(2021, 11, 19, 12, 0, 0, 0, time.UTC)
+	err := rrf.Upload(context.Background(), "0:/gcodes/a.gcode",
+		strings.NewReader("G28\n"), 4, mod)
+	require.NoError(t, err)
+	req := httpClient.requests[0]
+	assert.Equal(t, "POST", req.Method)
+	assert.Equal(t, int64(4), req.ContentLength)
+	assert.Equal(t, "0:/gcodes/a.gcode", req.URL.Query().Get("name"))
+	assert.Equal(t, "2021-11-19T12:00:00", req.URL.Query().Get("time"))
+
+	err = rrf.Upload(context.Background(), "0:/gcodes/a.gcode",
+		strings.NewReader("G28\n"), 4, time.Time{})
+	assert.Equal(t, FileError{"upload", "0:/gcodes/a.gcode", 1}, err)
+	err = rrf.Upload(context.Background(), "0:/gcodes/a.gcode",
+		strings.NewReader("G28\n"), 4, time.Time{})
+	assert.Error(t, err)
+}
+
+func Test_FileOps(t *testing.T) {
+	tests := []struct {
+		name  string
+		op    func(*Client) error
+		path  string
+		query string
+	}{
+		{
+			name: "delete",
+			op: func(c *Client) error {
+				return c.Delete(context.Background(), "0:/gcodes/a.gcode")
+			},
+			path:  "/rr_delete",
+			query: "name=0%3A%2Fgcodes%2Fa.gcode",
+		},
+		{
+			name: "move",
+			op: func(c *Client) error {
+				return c.Move(context.Background(),
+					"0:/gcodes/a.gcode", "0:/gcodes/b.gcode", true)
+			},
+			path:  "/rr_move",
+			query: "old=0%3A%2Fgcodes%2Fa.gcode&new=0%3A%2Fgcodes%2Fb.gcode&deleteexisting=yes",
+		},
+		{
+			name: "mkdir",
+			op: func(c *Client) error {
+				return c.Mkdir(context.Background(), "0:/gcodes/new")
+			},
+			path:  "/rr_mkdir",
+			query: "dir=0%3A%2Fgcodes%2Fnew",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			httpClient := &httpClientMock{
+				responses: []*http.Response{
+					okResponse(`{"err":0}`),
+					okResponse(`{"err":1}`),
+				},
+				errors: []error{nil, nil, fmt.Errorf("mock error")},
+			}
+			rrf := NewClient("localhost", "foo").WithHTTPClient(httpClient)
+			rrf.authDone = true
+			assert.NoError(t, tc.op(rrf))
+			assert.Equal(t, tc.path, httpClient.requests[0].URL.Path)
+			assert.Equal(t, tc.query, httpClient.requests[0].URL.RawQuery)
+			assert.Error(t, tc.op(rrf))
+			assert.Error(t, tc.op(rrf))
+		})
+	}
+}
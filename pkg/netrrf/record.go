@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2021 Mark Hindess
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package netrrf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Exchange is a request to a device and the response it gave.
+type Exchange struct {
+	// At is the time of the request since the recording started
+	At time.Duration `json:"at"`
+	// Duration is how long the device took to respond
+	Duration time.Duration `json:"duration"`
+	Method   string        `json:"method"`
+	// URL is the path and query of the request with any password
+	// redacted
+	URL         string `json:"url"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Body        string `json:"body,omitempty"`
+	// Error is set if the request failed without a response
+	Error string `json:"error,omitempty"`
+}
+
+var passwordRE = regexp.MustCompile(`(^|&)password=[^&]*`)
+
+// RedactURL returns the path and query of a request URL with the
+// password replaced so recordings can be shared.
+func RedactURL(u *url.URL) string {
+	s := u.Path
+	if u.RawQuery != "" {
+		s += "?" + passwordRE.ReplaceAllString(u.RawQuery,
+			"${1}password=********")
+	}
+	return s
+}
+
+// Recorder is a HttpClient that records the requests made with another
+// client, and the responses, to a writer as lines of JSON.
+type Recorder struct {
+	client HttpClient
+	enc    *json.Encoder
+	start  time.Time
+	mu     sync.Mutex
+}
+
+// NewRecorder returns a recorder that makes requests with client and
+// writes the exchanges to w.
+func NewRecorder(client HttpClient, w io.Writer) *Recorder {
+	return &Recorder{
+		client: client,
+		enc:    json.NewEncoder(w),
+		start:  time.Now(),
+	}
+}
+
+// Do makes the request and records it.  The response body is read
+// completely so that it can be recorded before it is returned.
+func (r *Recorder) Do(req *http.Request) (*http.Response, error) {
+	t := time.Now()
+	e := &Exchange{
+		At:     t.Sub(r.start),
+		Method: req.Method,
+		URL:    RedactURL(req.URL),
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		e.Duration = time.Since(t)
+		e.Error = err.Error()
+		if rerr := r.record(e); rerr != nil {
+			return nil, rerr
+		}
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	e.Duration = time.Since(t)
+	if err != nil {
+		e.Error = err.Error()
+		if rerr := r.record(e); rerr != nil {
+			return nil, rerr
+		}
+		return nil, err
+	}
+	e.Status = resp.StatusCode
+	e.ContentType = resp.Header.Get("Content-Type")
+	e.Body = string(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err := r.record(e); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *Recorder) record(e *Exchange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil {
+		return fmt.Errorf("recording of %s failed: %w", e.URL, err)
+	}
+	return nil
+}
+
+// ReadExchanges reads a recording written by a Recorder.
+func ReadExchanges(rd io.Reader) ([]*Exchange, error) {
+	dec := json.NewDecoder(rd)
+	exchanges := []*Exchange{}
+	for {
+		var e Exchange
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			return exchanges, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exchange %d: %w",
+				len(exchanges)+1, err)
+		}
+		exchanges = append(exchanges, &e)
+	}
+}
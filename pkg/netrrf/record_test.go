@@ -0,0 +1,85 @@
+package netrrf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_RedactURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://h/rr_connect?password=secret", "/rr_connect?password=********"},
+		{"http://h/rr_connect?password=secret&time=2021", "/rr_connect?password=********&time=2021"},
+		{"http://h/rr_status?type=3", "/rr_status?type=3"},
+		{"http://h/rr_config", "/rr_config"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.url, func(t *testing.T) {
+			u, err := url.Parse(tc.url)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, RedactURL(u))
+		})
+	}
+}
+
+func Test_Recorder(t *testing.T) {
+	httpClient := &httpClientMock{
+		responses: []*http.Response{
+			{
+				StatusCode: 200,
+				Header:     http.Header{"Content-Type": {"application/json"}},
+				Body: io.NopCloser(strings.NewReader(
+					`{"err":0,"sessionTimeout":8000}`)),
+			},
+			{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader(`{"status":"I"}`)),
+			},
+			{},
+		},
+		errors: []error{nil, nil, fmt.Errorf("mock error")},
+	}
+	var buf bytes.Buffer
+	rrf := NewClient("localhost", "secret").
+		WithHTTPClient(NewRecorder(httpClient, &buf))
+	ctx := context.Background()
+	s, err := rrf.Status(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "I", string(s.Status))
+	_, err = rrf.Status(ctx, 2)
+	assert.Error(t, err)
+
+	exchanges, err := ReadExchanges(&buf)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(exchanges))
+	assert.Equal(t, "GET", exchanges[0].Method)
+	assert.Equal(t, "/rr_connect?password=********", exchanges[0].URL)
+	assert.Equal(t, 200, exchanges[0].Status)
+	assert.Equal(t, "application/json", exchanges[0].ContentType)
+	assert.Equal(t, `{"err":0,"sessionTimeout":8000}`, exchanges[0].Body)
+	assert.Equal(t, "/rr_status?type=1", exchanges[1].URL)
+	assert.Equal(t, `{"status":"I"}`, exchanges[1].Body)
+	assert.LessOrEqual(t, exchanges[0].At, exchanges[1].At)
+	assert.Equal(t, "/rr_status?type=2", exchanges[2].URL)
+	assert.Equal(t, "mock error", exchanges[2].Error)
+	assert.Equal(t, 0, exchanges[2].Status)
+}
+
+func Test_ReadExchanges(t *testing.T) {
+	exchanges, err := ReadExchanges(strings.NewReader(""))
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(exchanges))
+	_, err = ReadExchanges(strings.NewReader("{\"url\":\"/rr_config\"}\n{"))
+	assert.EqualError(t, err, "failed to read exchange 2: unexpected EOF")
+}
@@ -32,6 +32,7 @@ import (
 type AuthResponse struct {
 	ErrorCode      int    `json:"err"`
 	SessionTimeout Time   `json:"sessionTimeout,omitempty"`
+	SessionKey     uint32 `json:"sessionKey,omitempty"`
 	BoardType      string `json:"boardType,omitempty"`
 }
 
@@ -100,6 +101,60 @@ type ConfigResponse struct {
 	MaxFeedRates        []float64 `json:"maxFeedrates,omitempty"`
 }
 
+// ModelResponse is returned by rr_model requests for the object model
+// in RepRapFirmware 3.  The type of the result depends on the key.
+type ModelResponse struct {
+	Key    string          `json:"key"`
+	Flags  string          `json:"flags"`
+	Result json.RawMessage `json:"result"`
+}
+
+// ErrorResponse is returned by requests, such as rr_delete, that only
+// report success or failure
+type ErrorResponse struct {
+	ErrorCode int `json:"err"`
+}
+
+type FileType string
+
+const (
+	File      FileType = "f"
+	Directory FileType = "d"
+)
+
+type FileEntry struct {
+	Type FileType `json:"type"`
+	Name string   `json:"name"`
+	Size int64    `json:"size"`
+	Date Date     `json:"date,omitempty"`
+}
+
+type FileListResponse struct {
+	ErrorCode int         `json:"err,omitempty"`
+	Dir       string      `json:"dir,omitempty"`
+	First     int         `json:"first"`
+	Files     []FileEntry `json:"files"`
+	Next      int         `json:"next"`
+}
+
+type FileInfoResponse struct {
+	ErrorCode        int       `json:"err"`
+	Size             int64     `json:"size,omitempty"`
+	LastModified     Date      `json:"lastModified,omitempty"`
+	Height           float64   `json:"height,omitempty"`
+	FirstLayerHeight float64   `json:"firstLayerHeight,omitempty"`
+	LayerHeight      float64   `json:"layerHeight,omitempty"`
+	PrintTime        Time      `json:"printTime,omitempty"`
+	SimulatedTime    Time      `json:"simulatedTime,omitempty"`
+	Filament         []float64 `json:"filament,omitempty"`
+	GeneratedBy      string    `json:"generatedBy,omitempty"`
+	FileName         string    `json:"fileName,omitempty"`
+}
+
+type GCodeResponse struct {
+	BufferSpace int `json:"buff"`
+}
+
 type RRFBool bool
 
 func (b *RRFBool) UnmarshalJSON(data []byte) error {
@@ -360,3 +415,33 @@ type TimesLeft struct {
 }
 
 type Date string // TODO unmarshal to time
+
+// HeaterSetpoint returns the active setpoint of heater h.  Tool heaters
+// are found via the tools heater mapping, otherwise heater 0 is assumed
+// to be the bed (the RepRapFirmware default).
+func (s *StatusResponse) HeaterSetpoint(h int) (float64, bool) {
+	for t, tool := range s.Tools {
+		for i, th := range tool.Heaters {
+			if th != h {
+				continue
+			}
+			if t < len(s.Temps.Tools.Active) &&
+				i < len(s.Temps.Tools.Active[t]) {
+				return s.Temps.Tools.Active[t][i], true
+			}
+		}
+	}
+	if h == 0 {
+		return s.Temps.Bed.Active, true
+	}
+	return 0, false
+}
+
+// HeaterName returns the configured name of heater h or a generated one
+// if the heater has not been named.
+func (s *StatusResponse) HeaterName(h int) string {
+	if h < len(s.Temps.Names) && s.Temps.Names[h] != "" {
+		return s.Temps.Names[h]
+	}
+	return fmt.Sprintf("h%d", h)
+}
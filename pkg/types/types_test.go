@@ -479,3 +479,27 @@ func Test_RRFBool_Marshal(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("0"), b)
 }
+
+func Test_HeaterSetpoint(t *testing.T) {
+	s := &StatusResponse{
+		Temps: Temps{
+			Bed:     Temp{Active: 60},
+			Current: []float64{58, 201, 2000},
+			Names:   []string{"bed", "", ""},
+			Tools: ToolTemps{
+				Active: [][]float64{{210}},
+			},
+		},
+		Tools: []Tool{{Number: 0, Heaters: []int{1}}},
+	}
+	sp, ok := s.HeaterSetpoint(0)
+	assert.True(t, ok)
+	assert.Equal(t, 60.0, sp)
+	sp, ok = s.HeaterSetpoint(1)
+	assert.True(t, ok)
+	assert.Equal(t, 210.0, sp)
+	_, ok = s.HeaterSetpoint(2)
+	assert.False(t, ok)
+	assert.Equal(t, "bed", s.HeaterName(0))
+	assert.Equal(t, "h1", s.HeaterName(1))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+// exit codes for the print command
+const (
+	printExitFailed    = 1 // upload or start failed
+	printExitHalted    = 2
+	printExitCancelled = 3
+	printExitLost      = 4
+
+	printExitInterrupted = 130
+)
+
+// printStartPoll is the interval between status requests until the print
+// is seen to start so that even a short job is not missed.
+const printStartPoll = 250 * time.Millisecond
+
+func printCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:  "print",
+		Usage: "upload a gcode file, start printing it and follow progress until it finishes",
+		Description: fmt.Sprintf("Exits with status 0 when the print completes, "+
+			"%d if the upload or start fails, %d if the printer halts, "+
+			"%d if the print is cancelled, %d if contact with the printer "+
+			"is lost and %d if interrupted.",
+			printExitFailed, printExitHalted, printExitCancelled,
+			printExitLost, printExitInterrupted),
+		ArgsUsage: "host file",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "dir",
+				Usage: "remote directory to upload to",
+				Value: defaultRemoteDir,
+			},
+			&cli.BoolFlag{
+				Name:  "no-follow",
+				Usage: "exit once the print has started",
+			},
+			&cli.DurationFlag{
+				Name:    "interval",
+				Aliases: []string{"i"},
+				Usage:   "interval between progress updates",
+				Value:   5 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:  "start-timeout",
+				Usage: "maximum time to wait for the print to start",
+				Value: time.Minute,
+			},
+			&cli.IntFlag{
+				Name:  "max-errors",
+				Usage: "number of consecutive failed status requests before giving up",
+				Value: 6,
+			},
+		},
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 2 {
+				return fmt.Errorf("host and file arguments are required")
+			}
+			host, local := c.Args().Get(0), c.Args().Get(1)
+			if c.Duration("interval") <= 0 {
+				return fmt.Errorf("interval must be positive")
+			}
+			if c.Int("max-errors") < 1 {
+				return fmt.Errorf("max errors must be at least 1")
+			}
+			ctx, cancel := signal.NotifyContext(context.Background(),
+				os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			rrf := netrrf.NewClient(host, c.String("password"))
+			remote := path.Join(c.String("dir"), filepath.Base(local))
+			err := uploadFile(ctx, rrf, c.App.ErrWriter, local, remote)
+			if err != nil {
+				return cli.Exit(err, printExitFailed)
+			}
+			// remember the duration of the previous print so that a
+			// job that finishes between polls can be recognised
+			var lastDuration types.Time
+			if s, err := rrf.FullStatus(ctx); err == nil {
+				lastDuration = s.PrintDuration
+			}
+			reply, err := rrf.SendGCode(ctx, `M32 "`+remote+`"`, time.Second)
+			if err != nil {
+				return cli.Exit(err, printExitFailed)
+			}
+			if reply = strings.TrimSpace(reply); reply != "" {
+				// M32 only replies when the file could not be started
+				return cli.Exit(fmt.Sprintf("failed to start %s: %s",
+					remote, reply), printExitFailed)
+			}
+			fmt.Fprintf(stdout, "started %s on %s\n", remote, host)
+			if c.Bool("no-follow") {
+				return nil
+			}
+			return followPrint(ctx, rrf, stdout, &followConfig{
+				interval:     c.Duration("interval"),
+				startTimeout: c.Duration("start-timeout"),
+				maxErrors:    c.Int("max-errors"),
+				lastDuration: lastDuration,
+			})
+		},
+	}
+}
+
+type followConfig struct {
+	interval     time.Duration
+	startTimeout time.Duration
+	maxErrors    int
+	// lastDuration is the print duration reported before the print
+	// was started
+	lastDuration types.Time
+}
+
+// followPrint reports progress until the print ends and returns an error
+// with the exit code reflecting the outcome.
+func followPrint(ctx context.Context, rrf *netrrf.Client, w io.Writer, cfg *followConfig) error {
+	start := time.Now()
+	started := false
+	failures := 0
+	var last *types.StatusResponse
+	for {
+		s, err := rrf.FullStatus(ctx)
+		if err != nil && ctx.Err() == nil {
+			// the session may have expired so authenticate again
+			rrf.ResetAuthentication()
+			s, err = rrf.FullStatus(ctx)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return cli.Exit("interrupted", printExitInterrupted)
+			}
+			failures++
+			fmt.Fprintf(w, "status request failed: %s\n", err)
+			if failures >= cfg.maxErrors {
+				return cli.Exit(fmt.Sprintf(
+					"lost contact with printer after %d failed requests",
+					failures), printExitLost)
+			}
+		} else {
+			failures = 0
+			switch {
+			case s.Status == types.Halted:
+				return cli.Exit("printer halted", printExitHalted)
+			case isPrinting(s.Status):
+				started = true
+				fmt.Fprintln(w, printProgress(s))
+			case started:
+				if last != nil && last.Status == types.Stopped {
+					return cli.Exit("print cancelled", printExitCancelled)
+				}
+				fmt.Fprintf(w, "print finished in %s\n",
+					formatTime(lastPrintDuration(last, s)))
+				return nil
+			case s.PrintDuration > 0 && s.PrintDuration != cfg.lastDuration:
+				// the print finished before it was seen printing
+				fmt.Fprintf(w, "print finished in %s\n",
+					formatTime(s.PrintDuration))
+				return nil
+			case time.Since(start) > cfg.startTimeout:
+				return cli.Exit(fmt.Sprintf(
+					"print did not start within %s (state %s)",
+					cfg.startTimeout, s.Status), printExitFailed)
+			}
+			last = s
+		}
+		wait := cfg.interval
+		if !started && wait > printStartPoll {
+			wait = printStartPoll
+		}
+		select {
+		case <-ctx.Done():
+			return cli.Exit("interrupted", printExitInterrupted)
+		case <-time.After(wait):
+		}
+	}
+}
+
+func printProgress(s *types.StatusResponse) string {
+	msg := fmt.Sprintf("%s: layer %d, %.1f%%", s.Status, s.CurrentLayer,
+		s.FractionPrinted)
+	if s.TimesLeft.File > 0 {
+		msg += ", " + formatTime(s.TimesLeft.File) + " left"
+	}
+	return msg
+}
+
+func lastPrintDuration(last, s *types.StatusResponse) types.Time {
+	if s.PrintDuration > 0 {
+		return s.PrintDuration
+	}
+	if last != nil {
+		return last.PrintDuration
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/urfave/cli/v2"
+)
+
+func recordCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:      "record",
+		Usage:     "record the traffic with a reprapfirmware device for replay by the mock",
+		ArgsUsage: "host",
+		Action: func(c *cli.Context) error {
+			if c.NArg() != 1 {
+				return fmt.Errorf("one host is required")
+			}
+			if c.Duration("interval") <= 0 {
+				return fmt.Errorf("interval must be positive")
+			}
+			w := stdout
+			if path := c.String("output"); path != "-" {
+				f, err := os.Create(path)
+				if err != nil {
+					return fmt.Errorf("failed to create recording: %w", err)
+				}
+				defer f.Close()
+				w = f
+			}
+
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, os.Interrupt)
+			signal.Notify(sigc, syscall.SIGTERM)
+			defer signal.Stop(sigc)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				select {
+				case <-sigc:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+
+			timeout := c.Duration("timeout")
+			rrf := netrrf.NewClient(c.Args().First(), c.String("password")).
+				WithTimeout(timeout).
+				WithHTTPClient(netrrf.NewRecorder(http.DefaultClient, w))
+			if err := rrf.Authenticate(ctx); err != nil {
+				return err
+			}
+			// legacy firmware has no rr_config but the failure is
+			// still worth recording
+			_, _ = rrf.Config(ctx)
+			for _, gcode := range c.StringSlice("gcode") {
+				if _, err := rrf.SendGCode(ctx, gcode, timeout); err != nil {
+					return err
+				}
+			}
+			return recordStatus(ctx, rrf, c.Int("count"),
+				c.Duration("interval"))
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "output",
+				Aliases: []string{"o"},
+				Usage:   "file to write the recording to, '-' for stdout",
+				Value:   "-",
+			},
+			&cli.IntFlag{
+				Name:    "count",
+				Aliases: []string{"n"},
+				Usage:   "number of times to poll the status, 0 until interrupted",
+				Value:   10,
+			},
+			&cli.DurationFlag{
+				Name:    "interval",
+				Aliases: []string{"i"},
+				Usage:   "interval between polling the status",
+				Value:   2 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Aliases: []string{"t"},
+				Usage:   "timeout for each request to the device",
+				Value:   5 * time.Second,
+			},
+			&cli.StringSliceFlag{
+				Name:    "gcode",
+				Aliases: []string{"g"},
+				Usage:   "G-code to send, and record the reply, before polling",
+			},
+		},
+	}
+}
+
+// recordStatus polls the full status count times, or until the context
+// is cancelled if count is zero.
+func recordStatus(ctx context.Context, rrf *netrrf.Client, count int, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for i := 0; count == 0 || i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if _, err := rrf.FullStatus(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// the device may have rebooted so start a new session
+			rrf.ResetAuthentication()
+		}
+	}
+	return nil
+}
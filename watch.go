@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beanz/rrf-go/pkg/netrrf"
+	"github.com/beanz/rrf-go/pkg/types"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	ansiClear      = "\x1b[H\x1b[2J"
+	ansiHideCursor = "\x1b[?25l"
+	ansiShowCursor = "\x1b[?25h"
+	ansiReset      = "\x1b[0m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+	ansiCyan       = "\x1b[36m"
+)
+
+type hostStatus struct {
+	host   string
+	status *types.StatusResponse
+	err    error
+}
+
+func watchCommand(stdout io.Writer) *cli.Command {
+	return &cli.Command{
+		Name:      "watch",
+		Aliases:   []string{"w"},
+		Usage:     "continuously display the status of reprapfirmware device(s)",
+		ArgsUsage: "host [host...]",
+		Action: func(c *cli.Context) error {
+			hosts := c.Args().Slice()
+			if len(hosts) == 0 {
+				return fmt.Errorf("at least one host is required")
+			}
+			if c.Duration("interval") <= 0 {
+				return fmt.Errorf("interval must be positive")
+			}
+			sigc := make(chan os.Signal, 1)
+			signal.Notify(sigc, os.Interrupt)
+			signal.Notify(sigc, syscall.SIGTERM)
+			defer signal.Stop(sigc)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			updates := make(chan *hostStatus, len(hosts))
+			for _, h := range hosts {
+				go watchHost(ctx, h, c.String("password"),
+					c.Duration("interval"), c.Duration("timeout"), updates)
+			}
+
+			fmt.Fprint(stdout, ansiHideCursor)
+			defer fmt.Fprint(stdout, ansiShowCursor)
+			latest := make(map[string]*hostStatus, len(hosts))
+			for {
+				select {
+				case <-sigc:
+					return nil
+				case u := <-updates:
+					latest[u.host] = u
+					fmt.Fprint(stdout, ansiClear)
+					renderWatch(stdout, hosts, latest, time.Now())
+				}
+			}
+		},
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:    "interval",
+				Aliases: []string{"i"},
+				Usage:   "interval between polling devices",
+				Value:   2 * time.Second,
+			},
+			&cli.DurationFlag{
+				Name:    "timeout",
+				Aliases: []string{"t"},
+				Usage:   "timeout for each request to a device",
+				Value:   5 * time.Second,
+			},
+		},
+	}
+}
+
+func watchHost(ctx context.Context, host, password string, interval, timeout time.Duration, updates chan *hostStatus) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	rrf := netrrf.NewClient(host, password).WithTimeout(timeout)
+	for {
+		s, err := rrf.FullStatus(ctx)
+		if err != nil {
+			// the device may have rebooted so start a new session
+			rrf.ResetAuthentication()
+		}
+		select {
+		case updates <- &hostStatus{host: host, status: s, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func renderWatch(w io.Writer, hosts []string, latest map[string]*hostStatus, now time.Time) {
+	fmt.Fprintf(w, "%s  %s\n\n", appName, now.Format("2006-01-02 15:04:05"))
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tNAME\tSTATE\tPROGRESS\tLAYER\tTEMPS\tPOSITION\tLEFT")
+	for _, h := range hosts {
+		hs, ok := latest[h]
+		if !ok {
+			fmt.Fprintf(tw, "%s\t-\t%s\t-\t-\t-\t-\t-\n",
+				h, ansiYellow+"waiting"+ansiReset)
+			continue
+		}
+		if hs.err != nil {
+			// the error is the final cell so it doesn't widen the columns
+			fmt.Fprintf(tw, "%s\t-\t%s\t-\t-\t-\t-\t%s\n",
+				h, ansiRed+"error"+ansiReset, hs.err)
+			continue
+		}
+		s := hs.status
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			h, s.Name, colourState(s.Status),
+			watchProgress(s), watchLayer(s), watchTemps(s),
+			watchPosition(s), watchTimeLeft(s))
+	}
+	tw.Flush()
+}
+
+func colourState(s types.Status) string {
+	colour := ""
+	switch s {
+	case types.Printing, types.Resuming:
+		colour = ansiGreen
+	case types.Pausing, types.Stopped, types.Busy, types.ToolChanging:
+		colour = ansiYellow
+	case types.Halted, types.Flashing:
+		colour = ansiRed
+	case types.Idle, types.Configuring:
+		colour = ansiCyan
+	}
+	return colour + s.String() + ansiReset
+}
+
+func isPrinting(s types.Status) bool {
+	switch s {
+	case types.Printing, types.Pausing, types.Stopped, types.Resuming:
+		return true
+	}
+	return false
+}
+
+func watchProgress(s *types.StatusResponse) string {
+	if !isPrinting(s.Status) {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", s.FractionPrinted)
+}
+
+func watchLayer(s *types.StatusResponse) string {
+	if !isPrinting(s.Status) {
+		return "-"
+	}
+	return fmt.Sprintf("%d", s.CurrentLayer)
+}
+
+func watchTemps(s *types.StatusResponse) string {
+	temps := []string{}
+	for i, cur := range s.Temps.Current {
+		if cur > 1000 {
+			// 2000 is reported for heaters that are not configured
+			continue
+		}
+		t := fmt.Sprintf("%s %.1f", s.HeaterName(i), cur)
+		if sp, ok := s.HeaterSetpoint(i); ok && sp > 0 {
+			t += fmt.Sprintf("/%.0f", sp)
+		}
+		temps = append(temps, t)
+	}
+	if len(temps) == 0 {
+		return "-"
+	}
+	return strings.Join(temps, " ")
+}
+
+func watchPosition(s *types.StatusResponse) string {
+	names := s.AxisNames
+	if names == "" {
+		names = "XYZUVWABC"
+	}
+	pos := []string{}
+	for i, v := range s.Coordinates.XYZ {
+		if i >= len(names) {
+			break
+		}
+		pos = append(pos, fmt.Sprintf("%c%.2f", names[i], v))
+	}
+	if len(pos) == 0 {
+		return "-"
+	}
+	return strings.Join(pos, " ")
+}
+
+func watchTimeLeft(s *types.StatusResponse) string {
+	if !isPrinting(s.Status) || s.TimesLeft.File <= 0 {
+		return "-"
+	}
+	return formatTime(s.TimesLeft.File)
+}
+
+func formatTime(t types.Time) string {
+	return time.Duration(float64(t) * float64(time.Second)).
+		Round(time.Second).String()
+}